@@ -0,0 +1,31 @@
+package savannah
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir(), "https://example.com/blobs/")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Put("items/1/a.jpg", strings.NewReader("jpeg bytes")))
+	blob, err := store.Open("items/1/a.jpg")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg bytes", string(data))
+	assert.Equal(t, "https://example.com/blobs/items/1/a.jpg", store.URL("items/1/a.jpg"))
+
+	assert.NoError(t, store.Delete("items/1/a.jpg"))
+	_, err = store.Open("items/1/a.jpg")
+	assert.Equal(t, ErrBlobNotFound, err)
+
+	for _, key := range []string{"../secret", "items/../../secret", "/etc/passwd", "", "items//a.jpg"} {
+		assert.Equal(t, ErrBlobNotFound, store.Put(key, strings.NewReader("x")), key)
+	}
+}
@@ -0,0 +1,179 @@
+package savannah
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrCartChanged is returned when the cart's lines changed while it was
+// being checked out.
+var ErrCartChanged = errors.New("the cart changed during checkout, please review it")
+
+// defaultCartTTL is how long a cart is kept after it was last changed.
+const defaultCartTTL = 7 * 24 * time.Hour
+
+// CartLine is an item, or a variant of one, in a customer's cart. Nothing
+// is reserved for it; the name, price and availability are looked up from
+// the catalog every time the cart is viewed.
+type CartLine struct {
+	ID        int       `json:"id"`
+	ItemID    int       `json:"item_id" validate:"required_without=VariantID"`
+	VariantID *int      `json:"variant_id,omitempty"`
+	Qty       int       `json:"qty" validate:"required,gt=0"`
+	AddedAt   time.Time `json:"added_at"`
+
+	Name      string `json:"name,omitempty"`
+	UnitPrice Money  `json:"unit_price"`
+	LineTotal Money  `json:"line_total"`
+	Available int    `json:"available"`
+	// InStock is false when the item was archived or less than Qty of it
+	// is left
+	InStock bool `json:"in_stock"`
+}
+
+// Cart is a customer's cart. Breakdown prices the lines that are in stock,
+// as Create Order would. Once delivery zones are set up it leaves delivery
+// out, the fee depends on where the order is delivered.
+type Cart struct {
+	Lines     []CartLine `json:"lines"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Breakdown *Breakdown `json:"breakdown,omitempty"`
+}
+
+// storedCart returns the customer's cart as stored, emptying it first if it
+// hasn't been touched for the cart TTL.
+func (s Service) storedCart(userID int) (*Cart, error) {
+	cart, err := s.service.FindCart(userID)
+	if err == sql.ErrNoRows {
+		return &Cart{Lines: []CartLine{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(cart.UpdatedAt) > s.cartTTL {
+		if err := s.service.ClearCart(userID); err != nil {
+			return nil, err
+		}
+		return &Cart{Lines: []CartLine{}}, nil
+	}
+	return cart, nil
+}
+
+// Cart returns the customer's cart with live prices and availability.
+func (s Service) Cart(userID int) (*Cart, error) {
+	cart, err := s.storedCart(userID)
+	if err != nil {
+		return nil, err
+	}
+	var available []OrderLine
+	for i := range cart.Lines {
+		line := &cart.Lines[i]
+		if err := s.priceCartLine(line); err != nil {
+			return nil, err
+		}
+		if line.InStock {
+			available = append(available, OrderLine{ItemID: line.ItemID, VariantID: line.VariantID, Qty: line.Qty, UnitPrice: line.UnitPrice, LineTotal: line.LineTotal})
+		}
+	}
+	if len(available) > 0 {
+		pricing := s.pricing
+		zones, err := s.service.ListDeliveryZones()
+		if err != nil {
+			return nil, err
+		}
+		if len(zones) > 0 {
+			pricing.DeliveryFee = Money{}
+		}
+		// a basket in mixed currencies can't be priced, it can't be
+		// ordered either
+		if breakdown, err := pricing.Total(available); err == nil {
+			cart.Breakdown = &breakdown
+		}
+	}
+	return cart, nil
+}
+
+// priceCartLine fills in the line's name, price and availability.
+func (s Service) priceCartLine(line *CartLine) error {
+	item, err := s.service.FindItem(line.ItemID)
+	if err == sql.ErrNoRows {
+		line.InStock = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	line.Name, line.UnitPrice, line.Available = item.Name, item.Price, item.Stock
+	if line.VariantID != nil {
+		variant, err := s.service.FindVariant(*line.VariantID)
+		if err == sql.ErrNoRows {
+			line.InStock = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line.Name = fmt.Sprintf("%s (%s)", item.Name, variant.Name)
+		line.UnitPrice, line.Available = variant.Price, variant.Stock
+	}
+	line.LineTotal = line.UnitPrice.Mul(line.Qty)
+	line.InStock = line.Available >= line.Qty
+	return nil
+}
+
+// AddToCart puts the item or variant in the customer's cart, adding to the
+// quantity of a line for it that's already there. Items that don't exist
+// or were archived fail with sql.ErrNoRows.
+func (s Service) AddToCart(userID int, line CartLine) (*CartLine, error) {
+	if line.VariantID != nil {
+		variant, err := s.service.FindVariant(*line.VariantID)
+		if err != nil {
+			return nil, err
+		}
+		if line.ItemID != 0 && line.ItemID != variant.ItemID {
+			return nil, sql.ErrNoRows
+		}
+		line.ItemID = variant.ItemID
+	}
+	if _, err := s.service.FindItem(line.ItemID); err != nil {
+		return nil, err
+	}
+	// throw away an expired cart rather than add to it
+	if _, err := s.storedCart(userID); err != nil {
+		return nil, err
+	}
+	added, err := s.service.AddCartLine(userID, line)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.priceCartLine(added); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// ExpireCarts throws away the carts that haven't been touched for the cart
+// TTL and reports how many there were.
+func (s Service) ExpireCarts() (int, error) {
+	return s.service.DeleteCartsBefore(time.Now().Add(-s.cartTTL))
+}
+
+// RunCartExpiry expires carts every interval until ctx is done.
+func (s Service) RunCartExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.ExpireCarts(); err != nil {
+			log.Println("carts:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package savannah
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Cart(t *testing.T) {
+	service := NewMockService()
+	store := service.service
+	tea, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 3})
+	assert.NoError(t, err)
+	milk, err := store.CreateItem(Item{Price: NewMoney(500, "KES"), Name: "Milk", Description: "Fresh", Stock: 10})
+	assert.NoError(t, err)
+	small, err := store.CreateVariant(ItemVariant{ItemID: milk.ID, SKU: "MILK-500", Name: "500ml", Price: NewMoney(600, "KES"), Stock: 1})
+	assert.NoError(t, err)
+
+	cart, err := service.Cart(1)
+	assert.NoError(t, err)
+	assert.Empty(t, cart.Lines)
+	assert.Nil(t, cart.Breakdown)
+
+	// adding the same item again adds to its line
+	line, err := service.AddToCart(1, CartLine{ItemID: tea.ID, Qty: 1})
+	assert.NoError(t, err)
+	again, err := service.AddToCart(1, CartLine{ItemID: tea.ID, Qty: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, line.ID, again.ID)
+	assert.Equal(t, 2, again.Qty)
+	assert.Equal(t, NewMoney(20000, "KES"), again.LineTotal)
+
+	// the variant is a line of its own, and its item is filled in
+	variant, err := service.AddToCart(1, CartLine{VariantID: &small.ID, Qty: 2})
+	assert.NoError(t, err)
+	assert.NotEqual(t, line.ID, variant.ID)
+	assert.Equal(t, milk.ID, variant.ItemID)
+	assert.Equal(t, "Milk (500ml)", variant.Name)
+	assert.False(t, variant.InStock)
+
+	_, err = service.AddToCart(1, CartLine{ItemID: 999, Qty: 1})
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = service.AddToCart(1, CartLine{ItemID: tea.ID, VariantID: &small.ID, Qty: 1})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// prices are the catalog's when the cart is viewed
+	tea.Price = NewMoney(12000, "KES")
+	assert.NoError(t, store.UpdateItem(*tea))
+	cart, err = service.Cart(1)
+	assert.NoError(t, err)
+	assert.Len(t, cart.Lines, 2)
+	assert.Equal(t, NewMoney(12000, "KES"), cart.Lines[0].UnitPrice)
+	assert.True(t, cart.Lines[0].InStock)
+	assert.Equal(t, 1, cart.Lines[1].Available)
+	// only the lines in stock are priced
+	assert.Equal(t, NewMoney(24000, "KES"), cart.Breakdown.Subtotal)
+
+	// other customers' carts are their own
+	assert.Equal(t, sql.ErrNoRows, store.UpdateCartLine(2, CartLine{ID: line.ID, Qty: 1}))
+	assert.Equal(t, sql.ErrNoRows, store.RemoveCartLine(2, line.ID))
+
+	assert.NoError(t, store.RemoveCartLine(1, variant.ID))
+	assert.NoError(t, store.UpdateCartLine(1, CartLine{ID: line.ID, Qty: 3}))
+	cart, err = service.Cart(1)
+	assert.NoError(t, err)
+	assert.Len(t, cart.Lines, 1)
+	assert.Equal(t, 3, cart.Lines[0].Qty)
+}
+
+func TestService_Cart_Expiry(t *testing.T) {
+	service := NewMockService()
+	service.cartTTL = time.Hour
+	store := service.service.(*MockInMemDB)
+	tea, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 3})
+	assert.NoError(t, err)
+	_, err = service.AddToCart(1, CartLine{ItemID: tea.ID, Qty: 1})
+	assert.NoError(t, err)
+	_, err = service.AddToCart(2, CartLine{ItemID: tea.ID, Qty: 1})
+	assert.NoError(t, err)
+
+	abandon := func(userID int) {
+		cart := store.Carts[userID]
+		cart.UpdatedAt = time.Now().Add(-2 * time.Hour)
+		store.Carts[userID] = cart
+	}
+
+	// an abandoned cart is empty when it's next looked at
+	abandon(1)
+	cart, err := service.Cart(1)
+	assert.NoError(t, err)
+	assert.Empty(t, cart.Lines)
+	added, err := service.AddToCart(1, CartLine{ItemID: tea.ID, Qty: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, added.Qty)
+
+	abandon(2)
+	expired, err := service.ExpireCarts()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	_, err = store.FindCart(2)
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = store.FindCart(1)
+	assert.NoError(t, err)
+}
+
+func TestMockInMemDB_CheckoutCart(t *testing.T) {
+	service := NewMockService()
+	store := service.service
+	tea, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 3})
+	assert.NoError(t, err)
+	line, err := service.AddToCart(1, CartLine{ItemID: tea.ID, Qty: 2})
+	assert.NoError(t, err)
+	cart, err := store.FindCart(1)
+	assert.NoError(t, err)
+	order := priced(t, store, Orders{UserId: 1, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: tea.ID, Qty: 2}}})
+
+	// a line changed since the cart was read fails the checkout and leaves
+	// the stock alone
+	assert.NoError(t, store.UpdateCartLine(1, CartLine{ID: line.ID, Qty: 1}))
+	_, err = store.CheckoutCart(1, cart.Lines, order, nil)
+	assert.Equal(t, ErrCartChanged, err)
+	item, err := store.FindItem(tea.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, item.Stock)
+
+	assert.NoError(t, store.UpdateCartLine(1, CartLine{ID: line.ID, Qty: 2}))
+	created, err := store.CheckoutCart(1, cart.Lines, order, nil)
+	assert.NoError(t, err)
+	assert.NotZero(t, created.ID)
+	cart, err = store.FindCart(1)
+	assert.NoError(t, err)
+	assert.Empty(t, cart.Lines)
+	item, err = store.FindItem(tea.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, item.Stock)
+}
+
+func TestService_Cart_DeliveryZones(t *testing.T) {
+	service := NewMockService()
+	service.pricing = Pricing{DeliveryFee: NewMoney(10000, "KES")}
+	store := service.service
+	tea, err := store.CreateItem(Item{Price: NewMoney(12000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	_, err = service.AddToCart(1, CartLine{ItemID: tea.ID, Qty: 1})
+	assert.NoError(t, err)
+
+	cart, err := service.Cart(1)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10000, "KES"), cart.Breakdown.DeliveryFee)
+
+	// the zone's fee isn't known until checkout gives a location
+	zone := newCBDZone()
+	assert.NoError(t, zone.check())
+	_, err = store.CreateDeliveryZone(zone)
+	assert.NoError(t, err)
+	cart, err = service.Cart(1)
+	assert.NoError(t, err)
+	assert.Zero(t, cart.Breakdown.DeliveryFee.Amount)
+	assert.Equal(t, NewMoney(12000, "KES"), cart.Breakdown.Total)
+}
@@ -14,7 +14,6 @@ import (
 func main() {
 	var wait time.Duration
 	cfg := savannah.LoadConfig()
-	fmt.Println(cfg)
 	server := savannah.NewServer(*cfg)
 	srve := http.Server{
 		Addr:         fmt.Sprintf("0.0.0.0:%s", cfg.Port),
@@ -22,6 +21,12 @@ func main() {
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	// send queued SMSes, expire abandoned carts and old idempotency keys
+	// until shutdown
+	jobs, stopJobs := context.WithCancel(context.Background())
+	go savannah.NewDispatcher(server.Services).Run(jobs)
+	go server.Services.RunCartExpiry(jobs, time.Hour)
+	go server.Services.RunIdempotencyExpiry(jobs, time.Hour)
 	fmt.Println("serving on port:", cfg.Port)
 	go func() {
 		if err := srve.ListenAndServe(); err != nil {
@@ -31,6 +36,7 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
+	stopJobs()
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
 	srve.Shutdown(ctx)
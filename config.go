@@ -1,6 +1,14 @@
 package savannah
 
-import "os"
+import (
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	ClientID     string
@@ -11,17 +19,213 @@ type Config struct {
 	Port         string
 	AtalkingAPI  string
 	AUsername    string
+	// emails allowed to manage the catalog and other back-office resources
+	AdminEmails []string
+	// directory uploaded files are kept in, and the public address of the
+	// server used to build their URLs
+	BlobDir   string
+	PublicURL string
+	// how long after ordering customers may cancel on their own, admins
+	// can cancel at any time
+	CancelWindow time.Duration
+	// how long responses are kept for replay to retries with the same
+	// Idempotency-Key
+	IdempotencyTTL time.Duration
+	// VAT in basis points (1600 is 16%), whether catalog prices include
+	// it, and the delivery fee in DefaultCurrency's minor unit
+	VATRate      int
+	VATInclusive bool
+	DeliveryFee  int64
+	// how long carts are kept after they were last changed
+	CartTTL time.Duration
+	// the provider orders are paid through, mpesa or fake, and the
+	// M-Pesa Daraja credentials
+	PaymentProvider     string
+	MpesaEnv            string
+	MpesaConsumerKey    string
+	MpesaConsumerSecret string
+	MpesaShortCode      string
+	MpesaPassKey        string
+	// the API user refunds are paid out as, its encrypted password and
+	// the B2C shortcode they're paid from, MpesaShortCode when empty
+	MpesaInitiatorName      string
+	MpesaSecurityCredential string
+	MpesaB2CShortCode       string
+	// secret the payment callback route must be called with, the
+	// callback URL handed to the provider carries it
+	PaymentCallbackToken string
+	// lets the fake provider's callback mark payments paid, for
+	// development only
+	AllowFakePayments bool
+	// who receipts are issued by
+	BusinessName    string
+	BusinessAddress string
+	BusinessPhone   string
+	BusinessEmail   string
+	BusinessTaxPIN  string
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		ClientID:     os.Getenv("CLIENTID"),
-		ClientSecret: os.Getenv("CLIENTSECRET"),
-		DBURL:        os.Getenv("DBURL"),
-		AccProvider:  os.Getenv("ACCPROVIDER"),
-		RedirectURL:  os.Getenv("REDIRECTURL"),
-		Port:         os.Getenv("PORT"),
-		AtalkingAPI:  os.Getenv("ATALKINGAPI"),
-		AUsername:    os.Getenv("AUSERNAME"),
+		ClientID:       os.Getenv("CLIENTID"),
+		ClientSecret:   os.Getenv("CLIENTSECRET"),
+		DBURL:          os.Getenv("DBURL"),
+		AccProvider:    os.Getenv("ACCPROVIDER"),
+		RedirectURL:    os.Getenv("REDIRECTURL"),
+		Port:           os.Getenv("PORT"),
+		AtalkingAPI:    os.Getenv("ATALKINGAPI"),
+		AUsername:      os.Getenv("AUSERNAME"),
+		AdminEmails:    splitList(os.Getenv("ADMINEMAILS")),
+		BlobDir:        getenv("BLOBDIR", "data/blobs"),
+		PublicURL:      strings.TrimSuffix(os.Getenv("PUBLICURL"), "/"),
+		CancelWindow:   getduration("CANCELWINDOW", 30*time.Minute),
+		IdempotencyTTL: getduration("IDEMPOTENCYTTL", 24*time.Hour),
+		VATRate:        getrate("VATRATE", 1600),
+		VATInclusive:   getbool("VATINCLUSIVE", true),
+		DeliveryFee:    getint("DELIVERYFEE", 0),
+		CartTTL:        getduration("CARTTTL", defaultCartTTL),
+
+		PaymentProvider:     getenv("PAYMENTPROVIDER", "fake"),
+		MpesaEnv:            getenv("MPESAENV", "sandbox"),
+		MpesaConsumerKey:    os.Getenv("MPESACONSUMERKEY"),
+		MpesaConsumerSecret: os.Getenv("MPESACONSUMERSECRET"),
+		MpesaShortCode:      os.Getenv("MPESASHORTCODE"),
+		MpesaPassKey:        os.Getenv("MPESAPASSKEY"),
+
+		MpesaInitiatorName:      os.Getenv("MPESAINITIATORNAME"),
+		MpesaSecurityCredential: os.Getenv("MPESASECURITYCREDENTIAL"),
+		MpesaB2CShortCode:       os.Getenv("MPESAB2CSHORTCODE"),
+		PaymentCallbackToken:    os.Getenv("PAYMENTCALLBACKTOKEN"),
+		AllowFakePayments:       getbool("ALLOWFAKEPAYMENTS", false),
+
+		BusinessName:    getenv("BUSINESSNAME", "Savannah"),
+		BusinessAddress: os.Getenv("BUSINESSADDRESS"),
+		BusinessPhone:   os.Getenv("BUSINESSPHONE"),
+		BusinessEmail:   os.Getenv("BUSINESSEMAIL"),
+		BusinessTaxPIN:  os.Getenv("BUSINESSTAXPIN"),
+	}
+}
+
+// Payments is the provider orders are paid through.
+func (cfg *Config) Payments() PaymentProvider {
+	switch cfg.PaymentProvider {
+	case "mpesa":
+		if cfg.PaymentCallbackToken == "" {
+			log.Fatalf("PAYMENTCALLBACKTOKEN: required with the mpesa provider")
+		}
+		token := "?token=" + url.QueryEscape(cfg.PaymentCallbackToken)
+		provider := NewMpesaProvider(cfg.MpesaEnv, cfg.MpesaConsumerKey, cfg.MpesaConsumerSecret, cfg.MpesaShortCode, cfg.MpesaPassKey,
+			cfg.PublicURL+"/payments/mpesa/callback"+token)
+		provider.InitiatorName = cfg.MpesaInitiatorName
+		provider.SecurityCredential = cfg.MpesaSecurityCredential
+		provider.B2CShortCode = cfg.MpesaB2CShortCode
+		provider.RefundCallbackURL = cfg.PublicURL + "/payments/mpesa/refunds/callback" + token
+		return provider
+	case "fake":
+		// its payments could never be settled, and a production deploy
+		// that forgot PAYMENTPROVIDER shouldn't start taking orders
+		if !cfg.AllowFakePayments {
+			log.Fatalf("PAYMENTPROVIDER: the fake provider needs ALLOWFAKEPAYMENTS=true, use mpesa in production")
+		}
+		log.Println("payments: using the fake provider, orders can be marked paid without paying")
+		return FakePaymentProvider{}
+	}
+	log.Fatalf("PAYMENTPROVIDER: unknown provider %q", cfg.PaymentProvider)
+	return nil
+}
+
+// Pricing is the store's VAT and delivery fee settings.
+func (cfg *Config) Pricing() Pricing {
+	return Pricing{
+		VATRate:      cfg.VATRate,
+		VATInclusive: cfg.VATInclusive,
+		DeliveryFee:  NewMoney(cfg.DeliveryFee, DefaultCurrency),
+	}
+}
+
+// Business is who receipts are issued by.
+func (cfg *Config) Business() Business {
+	return Business{
+		Name:    cfg.BusinessName,
+		Address: cfg.BusinessAddress,
+		Phone:   cfg.BusinessPhone,
+		Email:   cfg.BusinessEmail,
+		TaxPIN:  cfg.BusinessTaxPIN,
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getduration reads a duration such as "30m" or "2h".
+func getduration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return d
+}
+
+// getrate reads a percentage such as "16" or "7.5" as basis points.
+func getrate(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	percent, err := strconv.ParseFloat(v, 64)
+	if err != nil || percent < 0 {
+		log.Fatalf("%s: invalid percentage %q", key, v)
+	}
+	return int(math.Round(percent * 100))
+}
+
+func getbool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return b
+}
+
+func getint(key string, fallback int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return n
+}
+
+func (cfg *Config) IsAdmin(email string) bool {
+	for _, admin := range cfg.AdminEmails {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
+	return list
 }
@@ -0,0 +1,187 @@
+package savannah
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Coupon is a discount code customers can redeem on an order. It takes
+// either PercentOff or AmountOff off the basket, or off the lines it
+// applies to when ItemIDs or CategoryIDs restrict it.
+type Coupon struct {
+	ID int `json:"id"`
+	// Code is generated when left out, codes are matched case-insensitively
+	Code       string `json:"code" validate:"omitempty,min=4,max=32,alphanum"`
+	PercentOff int    `json:"percent_off,omitempty" validate:"gte=0,lte=100"`
+	AmountOff  Money  `json:"amount_off" validate:"gte=0"`
+	// MinBasket is the subtotal the basket must reach for the code to work
+	MinBasket Money      `json:"min_basket" validate:"gte=0"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	// limits on redemptions across all customers and per customer, 0 means
+	// no limit
+	MaxRedemptions int        `json:"max_redemptions" validate:"gte=0"`
+	MaxPerCustomer int        `json:"max_per_customer" validate:"gte=0"`
+	Redemptions    int        `json:"redemptions"`
+	ItemIDs        []int      `json:"item_ids"`
+	CategoryIDs    []int      `json:"category_ids"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+}
+
+// couponAlphabet leaves out characters that are easily mistaken for one
+// another, such as 0 and O or 1 and I.
+const couponAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const couponCodeLength = 8
+
+// normalizeCouponCode is how codes are stored and looked up.
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// check validates what the validator tags can't: exactly one kind of
+// discount, amounts in a single currency and a window that ends after it
+// starts. It fills in the currency when no amount names one, and empty
+// restrictions.
+func (c *Coupon) check() error {
+	if (c.PercentOff > 0) == (c.AmountOff.Amount > 0) {
+		return errors.New("set one of percent_off or amount_off")
+	}
+	currency := c.AmountOff.Currency
+	if currency == "" {
+		currency = c.MinBasket.Currency
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if c.MinBasket.Amount > 0 && c.MinBasket.Currency != currency {
+		return ErrCurrencyMismatch
+	}
+	c.AmountOff.Currency, c.MinBasket.Currency = currency, currency
+	if c.StartsAt != nil && c.EndsAt != nil && !c.EndsAt.After(*c.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	if c.ItemIDs == nil {
+		c.ItemIDs = []int{}
+	}
+	if c.CategoryIDs == nil {
+		c.CategoryIDs = []int{}
+	}
+	return nil
+}
+
+// CouponError is returned when a coupon can't be used on an order.
+type CouponError struct {
+	Code   string
+	Reason string
+}
+
+func (e *CouponError) Error() string {
+	return fmt.Sprintf("coupon %s %s", e.Code, e.Reason)
+}
+
+// CreateCoupon stores the coupon, generating a code for it if it has none.
+func (s Service) CreateCoupon(coupon Coupon) (*Coupon, error) {
+	if coupon.Code != "" {
+		coupon.Code = normalizeCouponCode(coupon.Code)
+		return s.service.CreateCoupon(coupon)
+	}
+	// a generated code is unlikely to be taken, try a few before giving up
+	for attempt := 0; ; attempt++ {
+		coupon.Code = Generate(couponCodeLength, couponAlphabet)
+		created, err := s.service.CreateCoupon(coupon)
+		if !errors.Is(err, ErrConflict) || attempt == 4 {
+			return created, err
+		}
+	}
+}
+
+// couponDiscount looks up the order's coupon and works out what it takes
+// off the priced lines. It checks the coupon's window, minimum basket and
+// limits as they are now; CreateOrders checks the limits again as it
+// redeems the coupon.
+func (s Service) couponDiscount(order *Orders, subtotal Money) (Discount, error) {
+	code := normalizeCouponCode(order.CouponCode)
+	coupon, err := s.service.FindCouponByCode(code)
+	if err == sql.ErrNoRows {
+		return Discount{}, &CouponError{Code: code, Reason: "is not valid"}
+	}
+	if err != nil {
+		return Discount{}, err
+	}
+	now := time.Now()
+	switch {
+	case coupon.StartsAt != nil && now.Before(*coupon.StartsAt):
+		return Discount{}, &CouponError{Code: code, Reason: "is not valid yet"}
+	case coupon.EndsAt != nil && !now.Before(*coupon.EndsAt):
+		return Discount{}, &CouponError{Code: code, Reason: "has expired"}
+	case coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions:
+		return Discount{}, &CouponError{Code: code, Reason: "has been used up"}
+	case subtotal.Currency != coupon.AmountOff.Currency && (coupon.AmountOff.Amount > 0 || coupon.MinBasket.Amount > 0):
+		return Discount{}, &CouponError{Code: code, Reason: "can't be used in " + subtotal.Currency}
+	case subtotal.Amount < coupon.MinBasket.Amount:
+		return Discount{}, &CouponError{Code: code, Reason: "needs a basket of at least " + coupon.MinBasket.String()}
+	}
+	if coupon.MaxPerCustomer > 0 && order.UserId != 0 {
+		used, err := s.service.CouponRedemptionsByUser(coupon.ID, order.UserId)
+		if err != nil {
+			return Discount{}, err
+		}
+		if used >= coupon.MaxPerCustomer {
+			return Discount{}, &CouponError{Code: code, Reason: "has already been used the most times it can be"}
+		}
+	}
+
+	eligible := Money{Currency: subtotal.Currency}
+	for _, line := range order.Lines {
+		ok, err := s.couponApplies(coupon, line.ItemID)
+		if err != nil {
+			return Discount{}, err
+		}
+		if ok {
+			eligible.Amount += line.LineTotal.Amount
+		}
+	}
+	if eligible.Amount == 0 {
+		return Discount{}, &CouponError{Code: code, Reason: "doesn't apply to anything in the basket"}
+	}
+	order.CouponID, order.CouponCode = &coupon.ID, coupon.Code
+	if coupon.PercentOff > 0 {
+		return Discount{Amount: Money{Amount: divRound(eligible.Amount*int64(coupon.PercentOff), 100), Currency: eligible.Currency}}, nil
+	}
+	if coupon.AmountOff.Amount < eligible.Amount {
+		return Discount{Amount: coupon.AmountOff}, nil
+	}
+	return Discount{Amount: eligible}, nil
+}
+
+// couponApplies reports whether the coupon discounts the item.
+func (s Service) couponApplies(coupon *Coupon, itemID int) (bool, error) {
+	if len(coupon.ItemIDs) == 0 && len(coupon.CategoryIDs) == 0 {
+		return true, nil
+	}
+	for _, id := range coupon.ItemIDs {
+		if id == itemID {
+			return true, nil
+		}
+	}
+	if len(coupon.CategoryIDs) == 0 {
+		return false, nil
+	}
+	categories, err := s.service.ItemCategories(itemID)
+	if err != nil {
+		return false, err
+	}
+	for _, category := range categories {
+		for _, id := range coupon.CategoryIDs {
+			if category.ID == id {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,150 @@
+package savannah
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoupon_Check(t *testing.T) {
+	assert.Error(t, (&Coupon{}).check())
+	assert.Error(t, (&Coupon{PercentOff: 10, AmountOff: NewMoney(500, "KES")}).check())
+	assert.Equal(t, ErrCurrencyMismatch, (&Coupon{AmountOff: NewMoney(500, "KES"), MinBasket: NewMoney(1000, "USD")}).check())
+	start := time.Now()
+	assert.Error(t, (&Coupon{PercentOff: 10, StartsAt: &start, EndsAt: &start}).check())
+
+	coupon := Coupon{PercentOff: 10}
+	assert.NoError(t, coupon.check())
+	assert.Equal(t, DefaultCurrency, coupon.MinBasket.Currency)
+	assert.NotNil(t, coupon.ItemIDs)
+}
+
+func TestService_CreateCoupon_GeneratesCode(t *testing.T) {
+	service := NewMockService()
+	coupon, err := service.CreateCoupon(Coupon{PercentOff: 10})
+	assert.NoError(t, err)
+	assert.Len(t, coupon.Code, couponCodeLength)
+	for _, c := range coupon.Code {
+		assert.True(t, strings.ContainsRune(couponAlphabet, c), coupon.Code)
+	}
+
+	coupon, err = service.CreateCoupon(Coupon{Code: " welcome10 ", PercentOff: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, "WELCOME10", coupon.Code)
+	_, err = service.CreateCoupon(Coupon{Code: "Welcome10", PercentOff: 5})
+	assert.ErrorIs(t, err, ErrConflict)
+}
+
+func TestService_PriceOrder_Coupon(t *testing.T) {
+	service := NewMockService()
+	store := service.service
+	tea, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 10})
+	assert.NoError(t, err)
+	mug, err := store.CreateItem(Item{Price: NewMoney(5000, "KES"), Name: "Mug", Description: "Enamel", Stock: 10})
+	assert.NoError(t, err)
+	drinks, err := store.CreateCategory(Category{Name: "Drinks"})
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetItemCategories(tea.ID, []int{drinks.ID}))
+	basket := func(code string) Orders {
+		return Orders{UserId: 1, CouponCode: code, Time: time.Now(), Lines: []OrderLine{
+			{ItemID: tea.ID, Qty: 2},
+			{ItemID: mug.ID, Qty: 1},
+		}}
+	}
+	create := func(coupon Coupon) {
+		assert.NoError(t, coupon.check())
+		_, err := service.CreateCoupon(coupon)
+		assert.NoError(t, err)
+	}
+	yesterday := time.Now().AddDate(0, 0, -1)
+	create(Coupon{Code: "DRINKS25", PercentOff: 25, CategoryIDs: []int{drinks.ID}})
+	create(Coupon{Code: "MUGS", AmountOff: NewMoney(8000, "KES"), ItemIDs: []int{mug.ID}})
+	create(Coupon{Code: "BIGSPEND", AmountOff: NewMoney(1000, "KES"), MinBasket: NewMoney(50000, "KES")})
+	create(Coupon{Code: "EXPIRED", PercentOff: 50, EndsAt: &yesterday})
+
+	// a quarter off the tea only
+	order := basket("drinks25")
+	assert.NoError(t, service.PriceOrder(&order))
+	assert.Equal(t, NewMoney(5000, "KES"), order.Breakdown.Discount)
+	assert.Equal(t, NewMoney(20000, "KES"), order.Total)
+	assert.Equal(t, "DRINKS25", order.CouponCode)
+	assert.NotNil(t, order.CouponID)
+
+	// a fixed amount only takes off as much as the lines it applies to
+	order = basket("MUGS")
+	assert.NoError(t, service.PriceOrder(&order))
+	assert.Equal(t, NewMoney(5000, "KES"), order.Breakdown.Discount)
+
+	for code, reason := range map[string]string{
+		"BIGSPEND": "needs a basket",
+		"EXPIRED":  "has expired",
+		"NOPE":     "is not valid",
+	} {
+		order = basket(code)
+		err := service.PriceOrder(&order)
+		var couponErr *CouponError
+		if assert.ErrorAs(t, err, &couponErr, code) {
+			assert.Contains(t, couponErr.Reason, reason)
+		}
+	}
+}
+
+func TestMockInMemDB_RedeemCoupon(t *testing.T) {
+	service := NewMockService()
+	store := service.service
+	item, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 100})
+	assert.NoError(t, err)
+	coupon, err := service.CreateCoupon(Coupon{Code: "FIRST3", PercentOff: 10, MaxRedemptions: 3, MaxPerCustomer: 1})
+	assert.NoError(t, err)
+
+	// every customer prices their order before anyone has redeemed the
+	// coupon, only three of them get to
+	orders := make([]Orders, 10)
+	for i := range orders {
+		orders[i] = Orders{UserId: i + 1, CouponCode: "FIRST3", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}
+		assert.NoError(t, service.PriceOrder(&orders[i]))
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var placed []*Orders
+	for _, order := range orders {
+		wg.Add(1)
+		go func(order Orders) {
+			defer wg.Done()
+			created, err := store.CreateOrders(order, nil)
+			if err != nil {
+				var couponErr *CouponError
+				assert.ErrorAs(t, err, &couponErr)
+				return
+			}
+			mu.Lock()
+			placed = append(placed, created)
+			mu.Unlock()
+		}(order)
+	}
+	wg.Wait()
+	assert.Len(t, placed, 3)
+	found, err := store.FindCoupon(coupon.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, found.Redemptions)
+	// a rejected order takes no stock
+	stocked, err := store.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 97, stocked.Stock)
+
+	// the same customer can't use it twice
+	again := Orders{UserId: placed[0].UserId, CouponCode: "FIRST3", Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}
+	var couponErr *CouponError
+	assert.ErrorAs(t, service.PriceOrder(&again), &couponErr)
+
+	// cancelling gives the redemption back
+	_, err = service.TransitionOrder(placed[0].ID, StatusCancelled, adminEmail, "changed mind", nil)
+	assert.NoError(t, err)
+	found, err = store.FindCoupon(coupon.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, found.Redemptions)
+	assert.NoError(t, service.PriceOrder(&again))
+}
@@ -2,173 +2,2190 @@ package savannah
 
 import (
 	"database/sql"
-	_ "github.com/lib/pq"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type DB struct {
 	db *sql.DB
 }
 
+// itemColumns is selected explicitly because items carries columns, like
+// the generated search_vector, that Item doesn't map.
+const itemColumns = "id, price, currency, name, description, stock, deleted_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanItem scans the itemColumns of a row, followed by any extra columns.
+func scanItem(row scanner, item *Item, extra ...interface{}) error {
+	dest := []interface{}{
+		&item.ID,
+		&item.Price.Amount,
+		&item.Price.Currency,
+		&item.Name,
+		&item.Description,
+		&item.Stock,
+		&item.DeletedAt,
+	}
+	return row.Scan(append(dest, extra...)...)
+}
+
+const orderColumns = "id, contact, address_id, user_id, total, currency, status, time, deleted_at, " +
+	"subtotal, discount, delivery_fee, tax, tax_rate, tax_inclusive, coupon_id, coupon_code, payment_status, " +
+	"delivery_lat, delivery_lng, delivery_zone_id"
+
+func scanOrder(row scanner, order *Orders) error {
+	breakdown := &order.Breakdown
+	var lat, lng sql.NullFloat64
+	err := row.Scan(
+		&order.ID,
+		&order.Contact,
+		&order.AddressID,
+		&order.UserId,
+		&order.Total.Amount,
+		&order.Total.Currency,
+		&order.Status,
+		&order.Time,
+		&order.DeletedAt,
+		&breakdown.Subtotal.Amount,
+		&breakdown.Discount.Amount,
+		&breakdown.DeliveryFee.Amount,
+		&breakdown.Tax.Amount,
+		&breakdown.TaxRate,
+		&breakdown.TaxInclusive,
+		&order.CouponID,
+		&order.CouponCode,
+		&order.PaymentStatus,
+		&lat,
+		&lng,
+		&order.DeliveryZoneID,
+	)
+	if err != nil {
+		return err
+	}
+	order.DeliveryLocation = nil
+	if lat.Valid && lng.Valid {
+		order.DeliveryLocation = &LatLng{Lat: lat.Float64, Lng: lng.Float64}
+	}
+	// the breakdown is kept in the order's currency
+	currency := order.Total.Currency
+	breakdown.Subtotal.Currency = currency
+	breakdown.Discount.Currency = currency
+	breakdown.DeliveryFee.Currency = currency
+	breakdown.Tax.Currency = currency
+	breakdown.Total = order.Total
+	return nil
+}
+
+const orderLineColumns = "id, item_id, variant_id, qty, unit_price, line_total, currency"
+
+// scanOrderLine scans the orderLineColumns of a row, preceded by any
+// leading columns.
+func scanOrderLine(row scanner, line *OrderLine, leading ...interface{}) error {
+	dest := append(leading,
+		&line.ID,
+		&line.ItemID,
+		&line.VariantID,
+		&line.Qty,
+		&line.UnitPrice.Amount,
+		&line.LineTotal.Amount,
+		&line.UnitPrice.Currency,
+	)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	line.LineTotal.Currency = line.UnitPrice.Currency
+	return nil
+}
+
+const userColumns = "id, code, email, deleted_at"
+
+func scanUser(row scanner, user *User) error {
+	return row.Scan(
+		&user.ID,
+		&user.Code,
+		&user.Email,
+		&user.DeletedAt,
+	)
+}
+
+const variantColumns = "id, item_id, sku, gtin, name, price, currency, stock"
+
+func scanVariant(row scanner, variant *ItemVariant) error {
+	return row.Scan(
+		&variant.ID,
+		&variant.ItemID,
+		&variant.SKU,
+		&variant.GTIN,
+		&variant.Name,
+		&variant.Price.Amount,
+		&variant.Price.Currency,
+		&variant.Stock,
+	)
+}
+
 func Newdb(conn *sql.DB) *DB {
 	return &DB{
 		db: conn,
 	}
 }
 
+// translateError maps postgres constraint violations onto ErrConflict so
+// handlers don't have to know about pq error codes.
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23503", "23505": // foreign_key_violation, unique_violation
+			return fmt.Errorf("%w: %s", ErrConflict, pqErr.Message)
+		}
+	}
+	return err
+}
+
+// affected reports sql.ErrNoRows when an UPDATE or DELETE matched nothing.
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return translateError(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (v *DB) CreateUser(user User) (*User, error) {
 	sqlStatement := `
 		INSERT INTO users (code, email)
 		VALUES ($1, $2)
-		RETURNING *;
+		RETURNING ` + userColumns + `;
 	`
-	err := v.db.QueryRow(sqlStatement, user.Code, user.Email).Scan(
-		&user.ID,
-		&user.Code,
-		&user.Email,
-	)
+	err := scanUser(v.db.QueryRow(sqlStatement, user.Code, user.Email), &user)
 	return &user, err
 }
 
 func (v *DB) CreateItem(item Item) (*Item, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	sqlStatement := `
-		INSERT INTO items (price, name, description)
-		VALUES ($1, $2, $3)
-		RETURNING *;
+		INSERT INTO items (price, currency, name, description, stock)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + itemColumns + `;
 	`
-	err := v.db.QueryRow(sqlStatement, item.Price, item.Name, item.Description).Scan(
-		&item.ID,
-		&item.Price,
-		&item.Name,
-		&item.Description,
-	)
-	return &item, err
+	item.Price = withCurrency(item.Price)
+	row := tx.QueryRow(sqlStatement, item.Price.Amount, item.Price.Currency, item.Name, item.Description, item.Stock)
+	if err := scanItem(row, &item); err != nil {
+		return nil, translateError(err)
+	}
+	if err := recordPrice(tx, item.ID, nil, item.Price); err != nil {
+		return nil, err
+	}
+	return &item, tx.Commit()
 }
 
-func (v *DB) CreateOrders(order Orders) (*Orders, error) {
+// recordPrice appends a price to the item's price history. variantID is
+// nil for the price of the item itself.
+func recordPrice(tx *sql.Tx, itemID int, variantID *int, price Money) error {
 	sqlStatement := `
-		INSERT INTO orders (item_id, qty, time,user_id)
-		VALUES ($1, $2, $3,$4)
-		RETURNING *;
+		INSERT INTO item_price_history (item_id, variant_id, price, currency)
+		VALUES ($1, $2, $3, $4)
 	`
-	err := v.db.QueryRow(sqlStatement, order.ItemID, order.Qty, order.Time, order.UserId).Scan(
-		&order.ID,
-		&order.UserId,
-		&order.ItemID,
-		&order.Qty,
-		&order.Time,
-	)
-	return &order, err
+	_, err := tx.Exec(sqlStatement, itemID, variantID, price.Amount, price.Currency)
+	return err
+}
+
+// currentPrice locks the row in table and returns its price, so a price
+// change and its history entry can't interleave with another one.
+func currentPrice(tx *sql.Tx, table string, id int, where string) (Money, error) {
+	var price Money
+	sqlStatement := `SELECT price, currency FROM ` + table + ` WHERE id = $1` + where + ` FOR UPDATE`
+	err := tx.QueryRow(sqlStatement, id).Scan(&price.Amount, &price.Currency)
+	return price, err
+}
+
+func (v *DB) ItemPriceHistory(itemID int) ([]PriceChange, error) {
+	sqlStatement := `
+		SELECT item_id, variant_id, price, currency, changed_at FROM item_price_history
+		WHERE item_id = $1
+		ORDER BY changed_at, id
+	`
+	rows, err := v.db.Query(sqlStatement, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []PriceChange{}
+	for rows.Next() {
+		var change PriceChange
+		err := rows.Scan(&change.ItemID, &change.VariantID, &change.Price.Amount, &change.Price.Currency, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// CreateOrders takes every line's quantity out of stock and records the
+// order in one transaction, so either the whole basket is ordered or none
+// of it is. The stock check and decrement are a single conditional UPDATE,
+// so concurrent orders can't oversell an item. The lines must have been
+// priced with Service.PriceOrder; a price that changed since fails the
+// order with ErrPriceChanged.
+func (v *DB) CreateOrders(order Orders, notify func(order *Orders) *Notification) (*Orders, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := createOrder(tx, &order, notify); err != nil {
+		return nil, err
+	}
+	return &order, tx.Commit()
+}
+
+// createOrder is CreateOrders as part of tx.
+func createOrder(tx *sql.Tx, order *Orders, notify func(order *Orders) *Notification) error {
+	err := checkLines(order)
+	if err != nil {
+		return err
+	}
+
+	// take stock in a fixed order so two baskets sharing items lock their
+	// rows in the same order and can't deadlock
+	lines := make([]*OrderLine, len(order.Lines))
+	for i := range order.Lines {
+		lines[i] = &order.Lines[i]
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].ItemID != lines[j].ItemID {
+			return lines[i].ItemID < lines[j].ItemID
+		}
+		return variantOf(*lines[i]) < variantOf(*lines[j])
+	})
+	for _, line := range lines {
+		var price Money
+		if line.VariantID != nil {
+			price, err = takeVariantStock(tx, line.ItemID, *line.VariantID, line.Qty)
+		} else {
+			price, err = takeStock(tx, line.ItemID, line.Qty)
+		}
+		if err != nil {
+			return err
+		}
+		if price != line.UnitPrice {
+			return ErrPriceChanged
+		}
+	}
+
+	breakdown := order.Breakdown
+	var lat, lng *float64
+	if order.DeliveryLocation != nil {
+		lat, lng = &order.DeliveryLocation.Lat, &order.DeliveryLocation.Lng
+	}
+	sqlStatement := `
+		INSERT INTO orders (contact, address_id, total, currency, time,user_id,
+			subtotal, discount, delivery_fee, tax, tax_rate, tax_inclusive, coupon_id, coupon_code,
+			delivery_lat, delivery_lng, delivery_zone_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING ` + orderColumns + `;
+	`
+	row := tx.QueryRow(sqlStatement, order.Contact, order.AddressID, order.Total.Amount, order.Total.Currency, order.Time, order.UserId,
+		breakdown.Subtotal.Amount, breakdown.Discount.Amount, breakdown.DeliveryFee.Amount, breakdown.Tax.Amount,
+		breakdown.TaxRate, breakdown.TaxInclusive, order.CouponID, order.CouponCode, lat, lng, order.DeliveryZoneID)
+	if err := scanOrder(row, order); err != nil {
+		return translateError(err)
+	}
+	sqlStatement = `
+		INSERT INTO order_items (order_id, item_id, variant_id, qty, unit_price, line_total, currency)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id;
+	`
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		row := tx.QueryRow(sqlStatement, order.ID, line.ItemID, line.VariantID, line.Qty,
+			line.UnitPrice.Amount, line.LineTotal.Amount, line.UnitPrice.Currency)
+		if err := row.Scan(&line.ID); err != nil {
+			return translateError(err)
+		}
+	}
+	if order.CouponID != nil {
+		if err := redeemCoupon(tx, order); err != nil {
+			return err
+		}
+	}
+	if notify != nil {
+		if notification := notify(order); notification != nil {
+			notification.OrderID = &order.ID
+			if err := queueNotification(tx, notification); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func variantOf(line OrderLine) int {
+	if line.VariantID == nil {
+		return 0
+	}
+	return *line.VariantID
+}
+
+// checkLines works out the line totals again from the unit prices and
+// checks they add up to the subtotal, so the lines stored with an order
+// always agree with what it charges.
+func checkLines(order *Orders) error {
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		line.LineTotal = line.UnitPrice.Mul(line.Qty)
+	}
+	subtotal, err := orderTotal(order.Lines)
+	if err != nil {
+		return err
+	}
+	if subtotal != order.Breakdown.Subtotal {
+		return ErrSubtotalMismatch
+	}
+	return nil
+}
+
+// orderTotal adds up the line totals. Lines in different currencies can't
+// be added up and fail with ErrCurrencyMismatch.
+func orderTotal(lines []OrderLine) (Money, error) {
+	var total Money
+	for _, line := range lines {
+		if total.Currency != "" && line.LineTotal.Currency != total.Currency {
+			return Money{}, ErrCurrencyMismatch
+		}
+		total = total.Add(line.LineTotal)
+	}
+	return total, nil
+}
+
+// takeStock returns the item's price as of the decrement, which is the
+// price the order is charged at.
+func takeStock(tx *sql.Tx, itemID, qty int) (Money, error) {
+	sqlStatement := `
+		UPDATE items
+		SET stock = stock - $2
+		WHERE id = $1 AND stock >= $2 AND deleted_at IS NULL
+		RETURNING price, currency
+	`
+	var price Money
+	err := tx.QueryRow(sqlStatement, itemID, qty).Scan(&price.Amount, &price.Currency)
+	if err != sql.ErrNoRows {
+		return price, err
+	}
+	var available int
+	err = tx.QueryRow(`SELECT stock FROM items WHERE id = $1 AND deleted_at IS NULL`, itemID).Scan(&available)
+	if err != nil {
+		return price, err
+	}
+	return price, &OutOfStockError{ItemID: itemID, Requested: qty, Available: available}
+}
+
+// takeVariantStock is takeStock for orders of a specific variant. The
+// variant must belong to itemID.
+func takeVariantStock(tx *sql.Tx, itemID, variantID, qty int) (Money, error) {
+	sqlStatement := `
+		UPDATE item_variants
+		SET stock = stock - $3
+		WHERE id = $1 AND item_id = $2 AND stock >= $3
+			AND item_id IN (SELECT id FROM items WHERE deleted_at IS NULL)
+		RETURNING price, currency
+	`
+	var price Money
+	err := tx.QueryRow(sqlStatement, variantID, itemID, qty).Scan(&price.Amount, &price.Currency)
+	if err != sql.ErrNoRows {
+		return price, err
+	}
+	var available int
+	sqlStatement = `
+		SELECT item_variants.stock FROM item_variants
+		JOIN items ON items.id = item_variants.item_id
+		WHERE item_variants.id = $1 AND item_variants.item_id = $2 AND items.deleted_at IS NULL
+	`
+	err = tx.QueryRow(sqlStatement, variantID, itemID).Scan(&available)
+	if err != nil {
+		return price, err
+	}
+	return price, &OutOfStockError{ItemID: itemID, VariantID: variantID, Requested: qty, Available: available}
 }
 
 func (v *DB) FindItem(id int) (*Item, error) {
 	sqlStatement := `
-		SELECT * FROM items
+		SELECT ` + itemColumns + ` FROM items
+		WHERE items.id = $1 AND items.deleted_at IS NULL
+	`
+	var item Item
+	err := scanItem(v.db.QueryRow(sqlStatement, id), &item)
+	return &item, err
+}
+
+func (v *DB) FindItemIncludingArchived(id int) (*Item, error) {
+	sqlStatement := `
+		SELECT ` + itemColumns + ` FROM items
 		WHERE items.id = $1
 	`
 	var item Item
-	err := v.db.QueryRow(sqlStatement, id).Scan(
-		&item.ID,
-		&item.Price,
-		&item.Name,
-		&item.Description,
-	)
+	err := scanItem(v.db.QueryRow(sqlStatement, id), &item)
 	return &item, err
 }
 
-func (v *DB) FindOrders(id int) (*Orders, error) {
+func (v *DB) ListItems(filter ItemFilter) (*ItemPage, error) {
+	key, desc, err := parseSort(filter.Sort, itemSorts)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		where []string
+		args  []interface{}
+	)
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.Name != "" {
+		where = append(where, "name ILIKE '%' || "+arg(escapeLike(filter.Name))+" || '%'")
+	}
+	if !filter.IncludeArchived {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if filter.Tag != "" {
+		where = append(where, `id IN (
+			SELECT item_tags.item_id FROM item_tags
+			JOIN tags ON tags.id = item_tags.tag_id
+			WHERE tags.name = `+arg(normalizeTag(filter.Tag))+`)`)
+	}
+	if filter.CategoryID != 0 {
+		where = append(where, `id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE id = `+arg(filter.CategoryID)+`
+				UNION ALL
+				SELECT categories.id FROM categories JOIN tree ON categories.parent_id = tree.id
+			)
+			SELECT item_categories.item_id FROM item_categories
+			WHERE item_categories.category_id IN (SELECT id FROM tree))`)
+	}
+	if filter.MinPrice != nil {
+		where = append(where, "price >= "+arg(*filter.MinPrice))
+	}
+	if filter.MaxPrice != nil {
+		where = append(where, "price <= "+arg(*filter.MaxPrice))
+	}
+	op, direction := ">", "ASC"
+	if desc {
+		op, direction = "<", "DESC"
+	}
+	column := itemSorts[key]
+	if filter.Cursor != "" {
+		var cursor itemCursor
+		if err := decodeCursor(filter.Cursor, &cursor); err != nil {
+			return nil, err
+		}
+		if key == "id" {
+			where = append(where, "id "+op+" "+arg(cursor.ID))
+		} else {
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", column, op, arg(cursor.value(key)), arg(cursor.ID)))
+		}
+	}
+	sqlStatement := "SELECT " + itemColumns + " FROM items"
+	if len(where) > 0 {
+		sqlStatement += " WHERE " + strings.Join(where, " AND ")
+	}
+	if key == "id" {
+		sqlStatement += fmt.Sprintf(" ORDER BY id %s", direction)
+	} else {
+		sqlStatement += fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+	}
+	limit := pageSize(filter.Limit)
+	sqlStatement += " LIMIT " + arg(limit+1)
+
+	rows, err := v.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := ItemPage{Items: []Item{}}
+	for rows.Next() {
+		var item Item
+		if err := scanItem(rows, &item); err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = encodeCursor(newItemCursor(page.Items[limit-1]))
+	}
+	return &page, nil
+}
+
+func (v *DB) SearchItems(query string, limit int) ([]ItemSearchResult, error) {
 	sqlStatement := `
-		SELECT * FROM orders
-		WHERE orders.id = $1
+		SELECT ` + itemColumns + `,
+			ts_rank(search_vector, query) AS rank,
+			ts_headline('english', name || ' ' || description, query,
+				'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxFragments=2, MaxWords=20, MinWords=5') AS snippet
+		FROM items, websearch_to_tsquery('english', $1) query
+		WHERE search_vector @@ query AND deleted_at IS NULL
+		ORDER BY rank DESC, id
+		LIMIT $2
 	`
-	var order Orders
-	err := v.db.QueryRow(sqlStatement, id).Scan(
-		&order.ID,
-		&order.UserId,
-		&order.ItemID,
-		&order.Qty,
-		&order.Time)
-	return &order, err
+	rows, err := v.db.Query(sqlStatement, query, pageSize(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []ItemSearchResult{}
+	for rows.Next() {
+		var result ItemSearchResult
+		if err := scanItem(rows, &result.Item, &result.Rank, &result.Snippet); err != nil {
+			return nil, err
+		}
+		result.Snippet = markSnippet(result.Snippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
 }
 
-func (v *DB) FindUser(id int) (*User, error) {
+// snippetMarker turns the control characters ts_headline is asked to put
+// around matches into <mark></mark>, once the item text around them is
+// escaped.
+var snippetMarker = strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>")
+
+// markSnippet HTML escapes a ts_headline snippet, keeping its matches
+// marked, so item text can't inject markup.
+func markSnippet(snippet string) string {
+	return snippetMarker.Replace(html.EscapeString(snippet))
+}
+
+func (v *DB) CreateCategory(category Category) (*Category, error) {
 	sqlStatement := `
-		SELECT * FROM users
-		WHERE users.id = $1
+		INSERT INTO categories (parent_id, name)
+		VALUES ($1, $2)
+		RETURNING id, parent_id, name;
 	`
-	var user User
-	err := v.db.QueryRow(sqlStatement, id).Scan(
-		&user.ID,
-		&user.Code,
-		&user.Email,
+	err := v.db.QueryRow(sqlStatement, category.ParentID, category.Name).Scan(
+		&category.ID,
+		&category.ParentID,
+		&category.Name,
 	)
-	return &user, err
+	return &category, translateError(err)
 }
-func (v *DB) FindUserbyEmail(email string) (*User, error) {
+
+func (v *DB) FindCategory(id int) (*Category, error) {
 	sqlStatement := `
-		SELECT * FROM users
-		WHERE users.email = $1
+		SELECT id, parent_id, name FROM categories
+		WHERE categories.id = $1
 	`
-	var user User
-	err := v.db.QueryRow(sqlStatement, email).Scan(
-		&user.ID,
-		&user.Code,
-		&user.Email,
+	var category Category
+	err := v.db.QueryRow(sqlStatement, id).Scan(
+		&category.ID,
+		&category.ParentID,
+		&category.Name,
 	)
-	return &user, err
+	return &category, err
 }
-func (v *DB) DeleteItem(id int) error {
+
+func (v *DB) ListCategories() ([]Category, error) {
 	sqlStatement := `
-		DELETE FROM items
-		WHERE items.id = $1
+		SELECT id, parent_id, name FROM categories
+		ORDER BY name, id
 	`
-	_, err := v.db.Exec(sqlStatement, id)
-	return err
+	return v.queryCategories(sqlStatement)
 }
 
-func (v *DB) DeleteOrders(id int) error {
+func (v *DB) ItemCategories(itemID int) ([]Category, error) {
 	sqlStatement := `
-		DELETE FROM orders
-		WHERE orders.id = $1
+		SELECT categories.id, categories.parent_id, categories.name FROM categories
+		JOIN item_categories ON item_categories.category_id = categories.id
+		WHERE item_categories.item_id = $1
+		ORDER BY categories.name, categories.id
 	`
-	_, err := v.db.Exec(sqlStatement, id)
-	return err
+	return v.queryCategories(sqlStatement, itemID)
 }
 
-func (v *DB) DeleteUser(id int) error {
+func (v *DB) queryCategories(sqlStatement string, args ...interface{}) ([]Category, error) {
+	rows, err := v.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	categories := []Category{}
+	for rows.Next() {
+		var category Category
+		if err := rows.Scan(&category.ID, &category.ParentID, &category.Name); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// SetItemCategories replaces the categories an item is filed under.
+func (v *DB) SetItemCategories(itemID int, categoryIDs []int) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM item_categories WHERE item_id = $1`, itemID); err != nil {
+		return err
+	}
+	for _, categoryID := range categoryIDs {
+		sqlStatement := `
+			INSERT INTO item_categories (item_id, category_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`
+		if _, err := tx.Exec(sqlStatement, itemID, categoryID); err != nil {
+			return translateError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SetItemTags replaces an item's tags, creating tags that don't exist yet.
+func (v *DB) SetItemTags(itemID int, tags []string) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM item_tags WHERE item_id = $1`, itemID); err != nil {
+		return err
+	}
+	for _, tag := range normalizeTags(tags) {
+		sqlStatement := `
+			WITH tag AS (
+				INSERT INTO tags (name) VALUES ($2)
+				ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+				RETURNING id
+			)
+			INSERT INTO item_tags (item_id, tag_id)
+			SELECT $1, id FROM tag
+		`
+		if _, err := tx.Exec(sqlStatement, itemID, tag); err != nil {
+			return translateError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (v *DB) ItemTags(itemID int) ([]string, error) {
 	sqlStatement := `
-		DELETE FROM users
-		WHERE users.id = $1
+		SELECT tags.name FROM tags
+		JOIN item_tags ON item_tags.tag_id = tags.id
+		WHERE item_tags.item_id = $1
+		ORDER BY tags.name
 	`
-	_, err := v.db.Exec(sqlStatement, id)
-	return err
+	rows, err := v.db.Query(sqlStatement, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
 }
 
-func (v *DB) UpdateItem(item Item) error {
+func (v *DB) CreateVariant(variant ItemVariant) (*ItemVariant, error) {
 	sqlStatement := `
-		UPDATE items
-		SET price = $2, name = $3, description = $4
-		WHERE id = $1
+		INSERT INTO item_variants (item_id, sku, gtin, name, price, currency, stock)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + variantColumns + `;
 	`
-	_, err := v.db.Exec(sqlStatement, item.ID, item.Price, item.Name, item.Description)
-	return err
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	variant.Price = withCurrency(variant.Price)
+	row := tx.QueryRow(sqlStatement, variant.ItemID, variant.SKU, variant.GTIN, variant.Name,
+		variant.Price.Amount, variant.Price.Currency, variant.Stock)
+	if err := scanVariant(row, &variant); err != nil {
+		return nil, translateError(err)
+	}
+	if err := recordPrice(tx, variant.ItemID, &variant.ID, variant.Price); err != nil {
+		return nil, err
+	}
+	return &variant, tx.Commit()
 }
 
-func (v *DB) UpdateOrders(order Orders) error {
+func (v *DB) FindVariant(id int) (*ItemVariant, error) {
+	return v.findVariant("id = $1", id)
+}
+
+func (v *DB) FindVariantBySKU(sku string) (*ItemVariant, error) {
+	return v.findVariant("sku = $1", sku)
+}
+
+func (v *DB) FindVariantByGTIN(gtin string) (*ItemVariant, error) {
+	return v.findVariant("gtin = $1", gtin)
+}
+
+func (v *DB) findVariant(where string, arg interface{}) (*ItemVariant, error) {
+	sqlStatement := `SELECT ` + variantColumns + ` FROM item_variants WHERE ` + where
+	var variant ItemVariant
+	err := scanVariant(v.db.QueryRow(sqlStatement, arg), &variant)
+	return &variant, err
+}
+
+func (v *DB) ListItemVariants(itemID int) ([]ItemVariant, error) {
 	sqlStatement := `
-		UPDATE orders
-		SET item_id = $2, qty = $3, time = $4, user_id = $5
-		WHERE id = $1
+		SELECT ` + variantColumns + ` FROM item_variants
+		WHERE item_id = $1
+		ORDER BY id
 	`
-	_, err := v.db.Exec(sqlStatement, order.ID, order.ItemID, order.Qty, order.Time, order.UserId)
-	return err
+	rows, err := v.db.Query(sqlStatement, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	variants := []ItemVariant{}
+	for rows.Next() {
+		var variant ItemVariant
+		if err := scanVariant(rows, &variant); err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, rows.Err()
 }
 
-func (v *DB) UpdateUser(user User) error {
+func (v *DB) UpdateVariant(variant ItemVariant) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := currentPrice(tx, "item_variants", variant.ID, "")
+	if err != nil {
+		return err
+	}
 	sqlStatement := `
-		UPDATE users
-		SET  code = $2, email = $3
+		UPDATE item_variants
+		SET sku = $2, gtin = $3, name = $4, price = $5, currency = $6, stock = $7
 		WHERE id = $1
+		RETURNING item_id
 	`
-	_, err := v.db.Exec(sqlStatement, user.ID, user.Code, user.Email)
-	return err
+	variant.Price = withCurrency(variant.Price)
+	row := tx.QueryRow(sqlStatement, variant.ID, variant.SKU, variant.GTIN, variant.Name,
+		variant.Price.Amount, variant.Price.Currency, variant.Stock)
+	if err := row.Scan(&variant.ItemID); err != nil {
+		return translateError(err)
+	}
+	if variant.Price != old {
+		if err := recordPrice(tx, variant.ItemID, &variant.ID, variant.Price); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (v *DB) DeleteVariant(id int) error {
+	sqlStatement := `
+		DELETE FROM item_variants
+		WHERE item_variants.id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+const addressColumns = "id, user_id, label, contact, line1, line2, city, created_at"
+
+func scanAddress(row scanner, address *Address) error {
+	return row.Scan(
+		&address.ID,
+		&address.UserID,
+		&address.Label,
+		&address.Contact,
+		&address.Line1,
+		&address.Line2,
+		&address.City,
+		&address.CreatedAt,
+	)
+}
+
+func (v *DB) CreateAddress(address Address) (*Address, error) {
+	sqlStatement := `
+		INSERT INTO addresses (user_id, label, contact, line1, line2, city)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + addressColumns + `;
+	`
+	row := v.db.QueryRow(sqlStatement, address.UserID, address.Label, address.Contact, address.Line1, address.Line2, address.City)
+	err := scanAddress(row, &address)
+	return &address, translateError(err)
+}
+
+func (v *DB) FindAddress(id int) (*Address, error) {
+	sqlStatement := `
+		SELECT ` + addressColumns + ` FROM addresses
+		WHERE addresses.id = $1
+	`
+	var address Address
+	err := scanAddress(v.db.QueryRow(sqlStatement, id), &address)
+	return &address, err
+}
+
+func (v *DB) ListAddresses(userID int) ([]Address, error) {
+	sqlStatement := `
+		SELECT ` + addressColumns + ` FROM addresses
+		WHERE user_id = $1
+		ORDER BY id
+	`
+	rows, err := v.db.Query(sqlStatement, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	addresses := []Address{}
+	for rows.Next() {
+		var address Address
+		if err := scanAddress(rows, &address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+func (v *DB) UpdateAddress(address Address) error {
+	sqlStatement := `
+		UPDATE addresses
+		SET label = $2, contact = $3, line1 = $4, line2 = $5, city = $6
+		WHERE id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, address.ID, address.Label, address.Contact, address.Line1, address.Line2, address.City))
+}
+
+func (v *DB) DeleteAddress(id int) error {
+	sqlStatement := `
+		DELETE FROM addresses
+		WHERE addresses.id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+const itemImageColumns = "id, item_id, key, thumbnail_key, content_type, width, height, size, created_at"
+
+func scanItemImage(row scanner, image *ItemImage) error {
+	return row.Scan(
+		&image.ID,
+		&image.ItemID,
+		&image.Key,
+		&image.ThumbnailKey,
+		&image.ContentType,
+		&image.Width,
+		&image.Height,
+		&image.Size,
+		&image.CreatedAt,
+	)
+}
+
+func (v *DB) CreateItemImage(image ItemImage) (*ItemImage, error) {
+	sqlStatement := `
+		INSERT INTO item_images (item_id, key, thumbnail_key, content_type, width, height, size)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + itemImageColumns + `;
+	`
+	row := v.db.QueryRow(sqlStatement, image.ItemID, image.Key, image.ThumbnailKey, image.ContentType,
+		image.Width, image.Height, image.Size)
+	err := scanItemImage(row, &image)
+	return &image, translateError(err)
+}
+
+func (v *DB) FindItemImage(id int) (*ItemImage, error) {
+	sqlStatement := `
+		SELECT ` + itemImageColumns + ` FROM item_images
+		WHERE item_images.id = $1
+	`
+	var image ItemImage
+	err := scanItemImage(v.db.QueryRow(sqlStatement, id), &image)
+	return &image, err
+}
+
+func (v *DB) ListItemImages(itemID int) ([]ItemImage, error) {
+	sqlStatement := `
+		SELECT ` + itemImageColumns + ` FROM item_images
+		WHERE item_id = $1
+		ORDER BY id
+	`
+	rows, err := v.db.Query(sqlStatement, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := []ItemImage{}
+	for rows.Next() {
+		var image ItemImage
+		if err := scanItemImage(rows, &image); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+func (v *DB) DeleteItemImage(id int) error {
+	sqlStatement := `
+		DELETE FROM item_images
+		WHERE item_images.id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) FindOrders(id int) (*Orders, error) {
+	return v.findOrder("orders.id = $1 AND orders.deleted_at IS NULL", id)
+}
+
+func (v *DB) FindOrdersIncludingArchived(id int) (*Orders, error) {
+	return v.findOrder("orders.id = $1", id)
+}
+
+func (v *DB) findOrder(where string, arg interface{}) (*Orders, error) {
+	sqlStatement := `
+		SELECT ` + orderColumns + ` FROM orders
+		WHERE ` + where
+	var order Orders
+	if err := scanOrder(v.db.QueryRow(sqlStatement, arg), &order); err != nil {
+		return nil, err
+	}
+	var err error
+	order.Lines, err = v.orderLines(order.ID)
+	return &order, err
+}
+
+func (v *DB) ListOrdersByUser(userID int, filter OrderFilter) (*OrderPage, error) {
+	args := []interface{}{userID}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := []string{"user_id = $1", "deleted_at IS NULL"}
+	if filter.Status != "" {
+		where = append(where, "status = "+arg(filter.Status))
+	}
+	if filter.From != nil {
+		where = append(where, "time >= "+arg(*filter.From))
+	}
+	if filter.To != nil {
+		where = append(where, "time < "+arg(*filter.To))
+	}
+	if filter.Cursor != "" {
+		var cursor orderCursor
+		if err := decodeCursor(filter.Cursor, &cursor); err != nil {
+			return nil, err
+		}
+		where = append(where, fmt.Sprintf("(time, id) < (%s, %s)", arg(cursor.Time), arg(cursor.ID)))
+	}
+	limit := pageSize(filter.Limit)
+	sqlStatement := "SELECT " + orderColumns + " FROM orders WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY time DESC, id DESC LIMIT " + arg(limit+1)
+
+	rows, err := v.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := OrderPage{Orders: []Orders{}}
+	for rows.Next() {
+		var order Orders
+		if err := scanOrder(rows, &order); err != nil {
+			return nil, err
+		}
+		page.Orders = append(page.Orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Orders) > limit {
+		page.Orders = page.Orders[:limit]
+		page.NextCursor = encodeCursor(newOrderCursor(page.Orders[limit-1]))
+	}
+	return &page, v.fillOrderLines(page.Orders)
+}
+
+// fillOrderLines loads the lines of a page of orders in one query.
+func (v *DB) fillOrderLines(orders []Orders) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(orders))
+	index := make(map[int]int, len(orders))
+	for i, order := range orders {
+		ids[i] = int64(order.ID)
+		index[order.ID] = i
+		orders[i].Lines = []OrderLine{}
+	}
+	sqlStatement := `
+		SELECT order_id, ` + orderLineColumns + ` FROM order_items
+		WHERE order_id = ANY($1)
+		ORDER BY id
+	`
+	rows, err := v.db.Query(sqlStatement, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderID int
+		var line OrderLine
+		if err := scanOrderLine(rows, &line, &orderID); err != nil {
+			return err
+		}
+		i := index[orderID]
+		orders[i].Lines = append(orders[i].Lines, line)
+	}
+	return rows.Err()
+}
+
+func (v *DB) orderLines(orderID int) ([]OrderLine, error) {
+	sqlStatement := `
+		SELECT ` + orderLineColumns + ` FROM order_items
+		WHERE order_id = $1
+		ORDER BY id
+	`
+	rows, err := v.db.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lines := []OrderLine{}
+	for rows.Next() {
+		var line OrderLine
+		if err := scanOrderLine(rows, &line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+func (v *DB) FindUser(id int) (*User, error) {
+	sqlStatement := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE users.id = $1 AND users.deleted_at IS NULL
+	`
+	var user User
+	err := scanUser(v.db.QueryRow(sqlStatement, id), &user)
+	return &user, err
+}
+
+func (v *DB) FindUserIncludingArchived(id int) (*User, error) {
+	sqlStatement := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE users.id = $1
+	`
+	var user User
+	err := scanUser(v.db.QueryRow(sqlStatement, id), &user)
+	return &user, err
+}
+
+func (v *DB) FindUserbyEmail(email string) (*User, error) {
+	sqlStatement := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE users.email = $1 AND users.deleted_at IS NULL
+	`
+	var user User
+	err := scanUser(v.db.QueryRow(sqlStatement, email), &user)
+	return &user, err
+}
+
+func (v *DB) FindUserbyEmailIncludingArchived(email string) (*User, error) {
+	sqlStatement := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE users.email = $1
+		ORDER BY deleted_at DESC NULLS FIRST, id
+		LIMIT 1
+	`
+	var user User
+	err := scanUser(v.db.QueryRow(sqlStatement, email), &user)
+	return &user, err
+}
+
+// DeleteItem archives the item. Orders keep pointing at it, but it drops
+// out of finds, listings and search until it is restored.
+func (v *DB) DeleteItem(id int) error {
+	sqlStatement := `
+		UPDATE items
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) DeleteOrders(id int) error {
+	sqlStatement := `
+		UPDATE orders
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) DeleteUser(id int) error {
+	sqlStatement := `
+		UPDATE users
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) RestoreItem(id int) error {
+	sqlStatement := `
+		UPDATE items
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) RestoreOrders(id int) error {
+	sqlStatement := `
+		UPDATE orders
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) RestoreUser(id int) error {
+	sqlStatement := `
+		UPDATE users
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+// UpdateItem records the new price in the item's price history when it
+// differs from the current one.
+func (v *DB) UpdateItem(item Item) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := currentPrice(tx, "items", item.ID, " AND deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	sqlStatement := `
+		UPDATE items
+		SET price = $2, currency = $3, name = $4, description = $5, stock = $6
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	item.Price = withCurrency(item.Price)
+	err = affected(tx.Exec(sqlStatement, item.ID, item.Price.Amount, item.Price.Currency, item.Name, item.Description, item.Stock))
+	if err != nil {
+		return err
+	}
+	if item.Price != old {
+		if err := recordPrice(tx, item.ID, nil, item.Price); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (v *DB) UpdateOrderStatus(change OrderStatusChange, notification *Notification) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setOrderStatus(tx, change, notification); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelOrder cancels the order and puts the stock its lines took back, in
+// the same transaction.
+func (v *DB) CancelOrder(change OrderStatusChange, notification *Notification) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	change.To = StatusCancelled
+	if err := setOrderStatus(tx, change, notification); err != nil {
+		return err
+	}
+	sqlStatement := `
+		UPDATE items
+		SET stock = items.stock + restock.qty
+		FROM (
+			SELECT item_id, SUM(qty) AS qty FROM order_items
+			WHERE order_id = $1 AND variant_id IS NULL
+			GROUP BY item_id
+		) AS restock
+		WHERE items.id = restock.item_id
+	`
+	if _, err := tx.Exec(sqlStatement, change.OrderID); err != nil {
+		return err
+	}
+	sqlStatement = `
+		UPDATE item_variants
+		SET stock = item_variants.stock + restock.qty
+		FROM (
+			SELECT variant_id, SUM(qty) AS qty FROM order_items
+			WHERE order_id = $1 AND variant_id IS NOT NULL
+			GROUP BY variant_id
+		) AS restock
+		WHERE item_variants.id = restock.variant_id
+	`
+	if _, err := tx.Exec(sqlStatement, change.OrderID); err != nil {
+		return err
+	}
+	sqlStatement = `
+		WITH released AS (
+			DELETE FROM coupon_redemptions WHERE order_id = $1 RETURNING coupon_id
+		)
+		UPDATE coupons
+		SET redemptions = redemptions - 1
+		WHERE id IN (SELECT coupon_id FROM released)
+	`
+	if _, err := tx.Exec(sqlStatement, change.OrderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setOrderStatus moves the order from change.From to change.To, records
+// the change in its history and queues notification if there is one.
+func setOrderStatus(tx *sql.Tx, change OrderStatusChange, notification *Notification) error {
+	sqlStatement := `
+		UPDATE orders
+		SET status = $3
+		WHERE id = $1 AND status = $2 AND deleted_at IS NULL
+	`
+	if err := affected(tx.Exec(sqlStatement, change.OrderID, change.From, change.To)); err != nil {
+		return err
+	}
+	sqlStatement = `
+		INSERT INTO order_status_history (order_id, from_status, to_status, actor, note)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	if _, err := tx.Exec(sqlStatement, change.OrderID, change.From, change.To, change.Actor, change.Note); err != nil {
+		return err
+	}
+	if notification == nil {
+		return nil
+	}
+	notification.OrderID = &change.OrderID
+	return queueNotification(tx, notification)
+}
+
+func (v *DB) OrderStatusHistory(orderID int) ([]OrderStatusChange, error) {
+	sqlStatement := `
+		SELECT order_id, from_status, to_status, actor, note, changed_at FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY changed_at, id
+	`
+	rows, err := v.db.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		if err := rows.Scan(&change.OrderID, &change.From, &change.To, &change.Actor, &change.Note, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// UpdateOrders updates the order header. Lines are fixed once ordered
+// since their stock has already been taken.
+func (v *DB) UpdateOrders(order Orders) error {
+	sqlStatement := `
+		UPDATE orders
+		SET time = $2, user_id = $3
+		WHERE id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, order.ID, order.Time, order.UserId))
+}
+
+func (v *DB) UpdateUser(user User) error {
+	sqlStatement := `
+		UPDATE users
+		SET  code = $2, email = $3
+		WHERE id = $1
+	`
+	_, err := v.db.Exec(sqlStatement, user.ID, user.Code, user.Email)
+	return err
+}
+
+const notificationColumns = "id, order_id, recipient, message, status, attempts, last_error, next_attempt_at, created_at, sent_at"
+
+func scanNotification(row scanner, notification *Notification) error {
+	return row.Scan(
+		&notification.ID,
+		&notification.OrderID,
+		&notification.Recipient,
+		&notification.Message,
+		&notification.Status,
+		&notification.Attempts,
+		&notification.LastError,
+		&notification.NextAttemptAt,
+		&notification.CreatedAt,
+		&notification.SentAt,
+	)
+}
+
+// queueNotification adds the notification to the outbox as part of tx, so
+// it is only sent if tx commits.
+func queueNotification(tx *sql.Tx, notification *Notification) error {
+	sqlStatement := `
+		INSERT INTO notifications (order_id, recipient, message)
+		VALUES ($1, $2, $3)
+		RETURNING ` + notificationColumns + `;
+	`
+	row := tx.QueryRow(sqlStatement, notification.OrderID, notification.Recipient, notification.Message)
+	return scanNotification(row, notification)
+}
+
+// ClaimNotifications pushes the due notifications' next attempt past the
+// lease as it reads them. SKIP LOCKED lets dispatchers claim batches side
+// by side without waiting on, or sending, each other's notifications.
+func (v *DB) ClaimNotifications(limit int, lease time.Duration) ([]Notification, error) {
+	sqlStatement := `
+		UPDATE notifications
+		SET next_attempt_at = now() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM notifications
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + notificationColumns + `;
+	`
+	rows, err := v.db.Query(sqlStatement, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanNotifications(rows)
+}
+
+func (v *DB) MarkNotificationSent(id int) error {
+	sqlStatement := `
+		UPDATE notifications
+		SET status = 'sent', attempts = attempts + 1, last_error = '', sent_at = now()
+		WHERE id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) MarkNotificationFailed(id int, lastError string, retryAfter time.Duration) error {
+	status := NotificationPending
+	if retryAfter <= 0 {
+		status = NotificationFailed
+	}
+	sqlStatement := `
+		UPDATE notifications
+		SET status = $2, attempts = attempts + 1, last_error = $3,
+			next_attempt_at = now() + $4 * interval '1 second'
+		WHERE id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id, status, lastError, retryAfter.Seconds()))
+}
+
+func (v *DB) OrderNotifications(orderID int) ([]Notification, error) {
+	sqlStatement := `
+		SELECT ` + notificationColumns + ` FROM notifications
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := v.db.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return scanNotifications(rows)
+}
+
+func scanNotifications(rows *sql.Rows) ([]Notification, error) {
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		var notification Notification
+		if err := scanNotification(rows, &notification); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+// redeemCoupon counts the order against its coupon's limits. The UPDATE
+// takes the coupon's row lock, so orders redeeming the same coupon at once
+// queue up behind each other and each sees the redemptions before it.
+func redeemCoupon(tx *sql.Tx, order *Orders) error {
+	sqlStatement := `
+		UPDATE coupons
+		SET redemptions = redemptions + 1
+		WHERE id = $1 AND deleted_at IS NULL
+			AND (max_redemptions = 0 OR redemptions < max_redemptions)
+			AND (starts_at IS NULL OR starts_at <= now())
+			AND (ends_at IS NULL OR ends_at > now())
+		RETURNING max_per_customer
+	`
+	var maxPerCustomer int
+	err := tx.QueryRow(sqlStatement, *order.CouponID).Scan(&maxPerCustomer)
+	if err == sql.ErrNoRows {
+		return &CouponError{Code: order.CouponCode, Reason: "has been used up"}
+	}
+	if err != nil {
+		return err
+	}
+	if maxPerCustomer > 0 {
+		var used int
+		sqlStatement = `SELECT count(*) FROM coupon_redemptions WHERE coupon_id = $1 AND user_id = $2`
+		if err := tx.QueryRow(sqlStatement, *order.CouponID, order.UserId).Scan(&used); err != nil {
+			return err
+		}
+		if used >= maxPerCustomer {
+			return &CouponError{Code: order.CouponCode, Reason: "has already been used the most times it can be"}
+		}
+	}
+	sqlStatement = `
+		INSERT INTO coupon_redemptions (coupon_id, user_id, order_id)
+		VALUES ($1, $2, $3)
+	`
+	_, err = tx.Exec(sqlStatement, *order.CouponID, order.UserId, order.ID)
+	return translateError(err)
+}
+
+const couponColumns = "id, code, percent_off, amount_off, min_basket, currency, starts_at, ends_at, " +
+	"max_redemptions, max_per_customer, redemptions, item_ids, category_ids, created_at, deleted_at"
+
+func scanCoupon(row scanner, coupon *Coupon) error {
+	var itemIDs, categoryIDs pq.Int64Array
+	err := row.Scan(
+		&coupon.ID,
+		&coupon.Code,
+		&coupon.PercentOff,
+		&coupon.AmountOff.Amount,
+		&coupon.MinBasket.Amount,
+		&coupon.AmountOff.Currency,
+		&coupon.StartsAt,
+		&coupon.EndsAt,
+		&coupon.MaxRedemptions,
+		&coupon.MaxPerCustomer,
+		&coupon.Redemptions,
+		&itemIDs,
+		&categoryIDs,
+		&coupon.CreatedAt,
+		&coupon.DeletedAt,
+	)
+	if err != nil {
+		return err
+	}
+	coupon.MinBasket.Currency = coupon.AmountOff.Currency
+	coupon.ItemIDs, coupon.CategoryIDs = intSlice(itemIDs), intSlice(categoryIDs)
+	return nil
+}
+
+func intSlice(ids pq.Int64Array) []int {
+	ints := make([]int, len(ids))
+	for i, id := range ids {
+		ints[i] = int(id)
+	}
+	return ints
+}
+
+func (v *DB) CreateCoupon(coupon Coupon) (*Coupon, error) {
+	sqlStatement := `
+		INSERT INTO coupons (code, percent_off, amount_off, min_basket, currency, starts_at, ends_at,
+			max_redemptions, max_per_customer, item_ids, category_ids)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING ` + couponColumns + `;
+	`
+	row := v.db.QueryRow(sqlStatement, coupon.Code, coupon.PercentOff, coupon.AmountOff.Amount, coupon.MinBasket.Amount,
+		coupon.AmountOff.Currency, coupon.StartsAt, coupon.EndsAt, coupon.MaxRedemptions, coupon.MaxPerCustomer,
+		pq.Array(coupon.ItemIDs), pq.Array(coupon.CategoryIDs))
+	if err := scanCoupon(row, &coupon); err != nil {
+		return nil, translateError(err)
+	}
+	return &coupon, nil
+}
+
+func (v *DB) FindCoupon(id int) (*Coupon, error) {
+	sqlStatement := `SELECT ` + couponColumns + ` FROM coupons WHERE id = $1`
+	var coupon Coupon
+	if err := scanCoupon(v.db.QueryRow(sqlStatement, id), &coupon); err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+func (v *DB) FindCouponByCode(code string) (*Coupon, error) {
+	sqlStatement := `SELECT ` + couponColumns + ` FROM coupons WHERE code = $1 AND deleted_at IS NULL`
+	var coupon Coupon
+	if err := scanCoupon(v.db.QueryRow(sqlStatement, code), &coupon); err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+func (v *DB) ListCoupons() ([]Coupon, error) {
+	sqlStatement := `
+		SELECT ` + couponColumns + ` FROM coupons
+		WHERE deleted_at IS NULL
+		ORDER BY created_at DESC, id DESC
+	`
+	rows, err := v.db.Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	coupons := []Coupon{}
+	for rows.Next() {
+		var coupon Coupon
+		if err := scanCoupon(rows, &coupon); err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	return coupons, rows.Err()
+}
+
+// UpdateCoupon changes everything but the coupon's code and redemptions.
+func (v *DB) UpdateCoupon(coupon Coupon) error {
+	sqlStatement := `
+		UPDATE coupons
+		SET percent_off = $2, amount_off = $3, min_basket = $4, currency = $5, starts_at = $6, ends_at = $7,
+			max_redemptions = $8, max_per_customer = $9, item_ids = $10, category_ids = $11
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, coupon.ID, coupon.PercentOff, coupon.AmountOff.Amount, coupon.MinBasket.Amount,
+		coupon.AmountOff.Currency, coupon.StartsAt, coupon.EndsAt, coupon.MaxRedemptions, coupon.MaxPerCustomer,
+		pq.Array(coupon.ItemIDs), pq.Array(coupon.CategoryIDs)))
+}
+
+// DeleteCoupon archives the coupon, orders that redeemed it keep pointing
+// to it.
+func (v *DB) DeleteCoupon(id int) error {
+	sqlStatement := `
+		UPDATE coupons
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+func (v *DB) CouponRedemptionsByUser(couponID, userID int) (int, error) {
+	sqlStatement := `SELECT count(*) FROM coupon_redemptions WHERE coupon_id = $1 AND user_id = $2`
+	var used int
+	err := v.db.QueryRow(sqlStatement, couponID, userID).Scan(&used)
+	return used, err
+}
+
+const deliveryZoneColumns = "id, name, polygon_lats, polygon_lngs, center_lat, center_lng, radius_m, " +
+	"min_order, currency, fee_min_subtotals, fee_amounts, created_at, deleted_at"
+
+func scanDeliveryZone(row scanner, zone *DeliveryZone) error {
+	var lats, lngs pq.Float64Array
+	var centerLat, centerLng sql.NullFloat64
+	var minSubtotals, amounts pq.Int64Array
+	err := row.Scan(
+		&zone.ID,
+		&zone.Name,
+		&lats,
+		&lngs,
+		&centerLat,
+		&centerLng,
+		&zone.RadiusMeters,
+		&zone.MinOrder.Amount,
+		&zone.MinOrder.Currency,
+		&minSubtotals,
+		&amounts,
+		&zone.CreatedAt,
+		&zone.DeletedAt,
+	)
+	if err != nil {
+		return err
+	}
+	zone.Polygon = nil
+	for i := range lats {
+		zone.Polygon = append(zone.Polygon, LatLng{Lat: lats[i], Lng: lngs[i]})
+	}
+	zone.Center = nil
+	if centerLat.Valid && centerLng.Valid {
+		zone.Center = &LatLng{Lat: centerLat.Float64, Lng: centerLng.Float64}
+	}
+	currency := zone.MinOrder.Currency
+	zone.Fees = make([]DeliveryFee, len(amounts))
+	for i := range amounts {
+		zone.Fees[i] = DeliveryFee{MinSubtotal: NewMoney(minSubtotals[i], currency), Fee: NewMoney(amounts[i], currency)}
+	}
+	return nil
+}
+
+// deliveryZoneArgs are the zone's columns from name on, as stored.
+func deliveryZoneArgs(zone DeliveryZone) []interface{} {
+	// nil arrays would be stored as NULL
+	lats, lngs := pq.Float64Array{}, pq.Float64Array{}
+	for _, corner := range zone.Polygon {
+		lats, lngs = append(lats, corner.Lat), append(lngs, corner.Lng)
+	}
+	var centerLat, centerLng *float64
+	if zone.Center != nil {
+		centerLat, centerLng = &zone.Center.Lat, &zone.Center.Lng
+	}
+	minSubtotals, amounts := make(pq.Int64Array, len(zone.Fees)), make(pq.Int64Array, len(zone.Fees))
+	for i, fee := range zone.Fees {
+		minSubtotals[i], amounts[i] = fee.MinSubtotal.Amount, fee.Fee.Amount
+	}
+	return []interface{}{zone.Name, lats, lngs, centerLat, centerLng, zone.RadiusMeters,
+		zone.MinOrder.Amount, zone.MinOrder.Currency, minSubtotals, amounts}
+}
+
+func (v *DB) CreateDeliveryZone(zone DeliveryZone) (*DeliveryZone, error) {
+	sqlStatement := `
+		INSERT INTO delivery_zones (name, polygon_lats, polygon_lngs, center_lat, center_lng, radius_m,
+			min_order, currency, fee_min_subtotals, fee_amounts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING ` + deliveryZoneColumns + `;
+	`
+	row := v.db.QueryRow(sqlStatement, deliveryZoneArgs(zone)...)
+	if err := scanDeliveryZone(row, &zone); err != nil {
+		return nil, translateError(err)
+	}
+	return &zone, nil
+}
+
+func (v *DB) FindDeliveryZone(id int) (*DeliveryZone, error) {
+	sqlStatement := `SELECT ` + deliveryZoneColumns + ` FROM delivery_zones WHERE id = $1`
+	var zone DeliveryZone
+	if err := scanDeliveryZone(v.db.QueryRow(sqlStatement, id), &zone); err != nil {
+		return nil, err
+	}
+	return &zone, nil
+}
+
+func (v *DB) ListDeliveryZones() ([]DeliveryZone, error) {
+	sqlStatement := `
+		SELECT ` + deliveryZoneColumns + ` FROM delivery_zones
+		WHERE deleted_at IS NULL
+		ORDER BY name, id
+	`
+	rows, err := v.db.Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	zones := []DeliveryZone{}
+	for rows.Next() {
+		var zone DeliveryZone
+		if err := scanDeliveryZone(rows, &zone); err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
+
+func (v *DB) UpdateDeliveryZone(zone DeliveryZone) error {
+	sqlStatement := `
+		UPDATE delivery_zones
+		SET name = $2, polygon_lats = $3, polygon_lngs = $4, center_lat = $5, center_lng = $6, radius_m = $7,
+			min_order = $8, currency = $9, fee_min_subtotals = $10, fee_amounts = $11
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, append([]interface{}{zone.ID}, deliveryZoneArgs(zone)...)...))
+}
+
+func (v *DB) DeleteDeliveryZone(id int) error {
+	sqlStatement := `
+		UPDATE delivery_zones
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	return affected(v.db.Exec(sqlStatement, id))
+}
+
+const cartLineColumns = "id, item_id, variant_id, qty, added_at"
+
+func scanCartLine(row scanner, line *CartLine) error {
+	return row.Scan(
+		&line.ID,
+		&line.ItemID,
+		&line.VariantID,
+		&line.Qty,
+		&line.AddedAt,
+	)
+}
+
+func (v *DB) FindCart(userID int) (*Cart, error) {
+	cart := Cart{Lines: []CartLine{}}
+	err := v.db.QueryRow(`SELECT updated_at FROM carts WHERE user_id = $1`, userID).Scan(&cart.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	sqlStatement := `
+		SELECT ` + cartLineColumns + ` FROM cart_items
+		WHERE user_id = $1
+		ORDER BY added_at, id
+	`
+	rows, err := v.db.Query(sqlStatement, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var line CartLine
+		if err := scanCartLine(rows, &line); err != nil {
+			return nil, err
+		}
+		cart.Lines = append(cart.Lines, line)
+	}
+	return &cart, rows.Err()
+}
+
+// touchCart creates the customer's cart if need be and marks it as changed
+// now.
+func touchCart(tx *sql.Tx, userID int) error {
+	sqlStatement := `
+		INSERT INTO carts (user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO UPDATE SET updated_at = now()
+	`
+	_, err := tx.Exec(sqlStatement, userID)
+	return translateError(err)
+}
+
+func (v *DB) AddCartLine(userID int, line CartLine) (*CartLine, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := touchCart(tx, userID); err != nil {
+		return nil, err
+	}
+	sqlStatement := `
+		INSERT INTO cart_items (user_id, item_id, variant_id, qty)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, item_id, (COALESCE(variant_id, 0)))
+		DO UPDATE SET qty = cart_items.qty + EXCLUDED.qty
+		RETURNING ` + cartLineColumns + `;
+	`
+	row := tx.QueryRow(sqlStatement, userID, line.ItemID, line.VariantID, line.Qty)
+	if err := scanCartLine(row, &line); err != nil {
+		return nil, translateError(err)
+	}
+	return &line, tx.Commit()
+}
+
+func (v *DB) UpdateCartLine(userID int, line CartLine) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `
+		UPDATE cart_items
+		SET qty = $3
+		WHERE id = $1 AND user_id = $2
+	`
+	if err := affected(tx.Exec(sqlStatement, line.ID, userID, line.Qty)); err != nil {
+		return err
+	}
+	if err := touchCart(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (v *DB) RemoveCartLine(userID, lineID int) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `
+		DELETE FROM cart_items
+		WHERE id = $1 AND user_id = $2
+	`
+	if err := affected(tx.Exec(sqlStatement, lineID, userID)); err != nil {
+		return err
+	}
+	if err := touchCart(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (v *DB) ClearCart(userID int) error {
+	_, err := v.db.Exec(`DELETE FROM carts WHERE user_id = $1`, userID)
+	return err
+}
+
+func (v *DB) DeleteCartsBefore(cutoff time.Time) (int, error) {
+	result, err := v.db.Exec(`DELETE FROM carts WHERE updated_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// CheckoutCart creates the order and takes the lines out of the cart in one
+// transaction. A line is only taken out if it still has the quantity that
+// was ordered, so changes made to the cart during checkout aren't lost.
+func (v *DB) CheckoutCart(userID int, lines []CartLine, order Orders, notify func(order *Orders) *Notification) (*Orders, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := createOrder(tx, &order, notify); err != nil {
+		return nil, err
+	}
+	sqlStatement := `
+		DELETE FROM cart_items
+		WHERE id = $1 AND user_id = $2 AND qty = $3
+	`
+	for _, line := range lines {
+		if err := affected(tx.Exec(sqlStatement, line.ID, userID, line.Qty)); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, ErrCartChanged
+			}
+			return nil, err
+		}
+	}
+	if err := touchCart(tx, userID); err != nil {
+		return nil, err
+	}
+	return &order, tx.Commit()
+}
+
+const paymentColumns = "id, order_id, provider, phone, amount, currency, status, COALESCE(reference, ''), " +
+	"receipt, failure_reason, created_at, updated_at"
+
+func scanPayment(row scanner, payment *Payment) error {
+	return row.Scan(
+		&payment.ID,
+		&payment.OrderID,
+		&payment.Provider,
+		&payment.Phone,
+		&payment.Amount.Amount,
+		&payment.Amount.Currency,
+		&payment.Status,
+		&payment.Reference,
+		&payment.Receipt,
+		&payment.FailureReason,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+}
+
+// CreatePayment marks the order pending first, so payments for the same
+// order queue up behind its row lock and the one-pending-payment index
+// turns away all but the first.
+func (v *DB) CreatePayment(payment Payment) (*Payment, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `
+		UPDATE orders
+		SET payment_status = 'pending'
+		WHERE id = $1 AND payment_status <> 'paid' AND deleted_at IS NULL
+	`
+	if err := affected(tx.Exec(sqlStatement, payment.OrderID)); err != nil {
+		return nil, err
+	}
+	sqlStatement = `
+		INSERT INTO payments (order_id, provider, phone, amount, currency)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + paymentColumns + `;
+	`
+	row := tx.QueryRow(sqlStatement, payment.OrderID, payment.Provider, payment.Phone, payment.Amount.Amount, payment.Amount.Currency)
+	if err := scanPayment(row, &payment); err != nil {
+		return nil, translateError(err)
+	}
+	return &payment, tx.Commit()
+}
+
+func (v *DB) SetPaymentReference(id int, reference string) error {
+	sqlStatement := `
+		UPDATE payments
+		SET reference = $2, updated_at = now()
+		WHERE id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id, reference))
+}
+
+func (v *DB) SettlePayment(id int, status PaymentStatus, receipt, reason string, notification *Notification) (*Refund, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `
+		UPDATE payments
+		SET status = $2, receipt = $3, failure_reason = $4, updated_at = now()
+		WHERE id = $1 AND (status = 'pending' OR (status = 'failed' AND $2 = 'paid'))
+		RETURNING order_id, provider, phone, amount, currency
+	`
+	var payment Payment
+	err = tx.QueryRow(sqlStatement, id, status, receipt, reason).Scan(&payment.OrderID, &payment.Provider,
+		&payment.Phone, &payment.Amount.Amount, &payment.Amount.Currency)
+	if err != nil {
+		return nil, err
+	}
+	payment.ID = id
+	var refund *Refund
+	if status == PaymentPaid {
+		// lock the order so two payments going through at once can't
+		// both be taken for it
+		sqlStatement = `SELECT status, payment_status FROM orders WHERE id = $1 FOR UPDATE`
+		var orderStatus OrderStatus
+		var paymentStatus PaymentStatus
+		if err := tx.QueryRow(sqlStatement, payment.OrderID).Scan(&orderStatus, &paymentStatus); err != nil {
+			return nil, err
+		}
+		if reason := surplusReason(orderStatus, paymentStatus); reason != "" {
+			refund = surplusRefund(payment, reason)
+			sqlStatement = `
+				INSERT INTO refunds (order_id, payment_id, provider, phone, amount, currency, reason, actor)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				RETURNING ` + refundColumns + `;
+			`
+			row := tx.QueryRow(sqlStatement, refund.OrderID, refund.PaymentID, refund.Provider, refund.Phone,
+				refund.Amount.Amount, refund.Amount.Currency, refund.Reason, refund.Actor)
+			if err := scanRefund(row, refund); err != nil {
+				return nil, translateError(err)
+			}
+		}
+	}
+	if refund == nil {
+		// a failed payment only fails the order if no other payment for
+		// it is under way or went through
+		sqlStatement = `
+			UPDATE orders
+			SET payment_status = $2
+			WHERE id = $1 AND ($2 = 'paid' OR (payment_status = 'pending' AND NOT EXISTS (
+				SELECT 1 FROM payments WHERE order_id = $1 AND status = 'pending'
+			)))
+		`
+		if _, err := tx.Exec(sqlStatement, payment.OrderID, status); err != nil {
+			return nil, err
+		}
+	}
+	if notification != nil {
+		notification.OrderID = &payment.OrderID
+		if err := queueNotification(tx, notification); err != nil {
+			return nil, err
+		}
+	}
+	return refund, tx.Commit()
+}
+
+func (v *DB) FindPaymentByReference(provider, reference string) (*Payment, error) {
+	sqlStatement := `SELECT ` + paymentColumns + ` FROM payments WHERE provider = $1 AND reference = $2`
+	var payment Payment
+	if err := scanPayment(v.db.QueryRow(sqlStatement, provider, reference), &payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (v *DB) OrderPayments(orderID int) ([]Payment, error) {
+	sqlStatement := `
+		SELECT ` + paymentColumns + ` FROM payments
+		WHERE order_id = $1
+		ORDER BY created_at DESC, id DESC
+	`
+	rows, err := v.db.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := []Payment{}
+	for rows.Next() {
+		var payment Payment
+		if err := scanPayment(rows, &payment); err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+const refundColumns = "id, order_id, payment_id, provider, phone, amount, currency, reason, status, " +
+	"COALESCE(reference, ''), receipt, failure_reason, actor, created_at, updated_at"
+
+func scanRefund(row scanner, refund *Refund) error {
+	return row.Scan(
+		&refund.ID,
+		&refund.OrderID,
+		&refund.PaymentID,
+		&refund.Provider,
+		&refund.Phone,
+		&refund.Amount.Amount,
+		&refund.Amount.Currency,
+		&refund.Reason,
+		&refund.Status,
+		&refund.Reference,
+		&refund.Receipt,
+		&refund.FailureReason,
+		&refund.Actor,
+		&refund.CreatedAt,
+		&refund.UpdatedAt,
+	)
+}
+
+// CreateRefund locks the payment while it adds up its refunds, so refunds
+// of the same payment made at once can't add up to more than it together.
+func (v *DB) CreateRefund(refund Refund) (*Refund, error) {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `
+		SELECT amount, currency FROM payments
+		WHERE id = $1 AND status = 'paid'
+		FOR UPDATE
+	`
+	var paid Money
+	if err := tx.QueryRow(sqlStatement, refund.PaymentID).Scan(&paid.Amount, &paid.Currency); err != nil {
+		return nil, err
+	}
+	sqlStatement = `SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = $1 AND status <> 'failed'`
+	var refunded int64
+	if err := tx.QueryRow(sqlStatement, refund.PaymentID).Scan(&refunded); err != nil {
+		return nil, err
+	}
+	if refund.Amount.Currency != paid.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+	if refunded+refund.Amount.Amount > paid.Amount {
+		return nil, ErrRefundTooLarge
+	}
+	sqlStatement = `
+		INSERT INTO refunds (order_id, payment_id, provider, phone, amount, currency, reason, actor)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING ` + refundColumns + `;
+	`
+	row := tx.QueryRow(sqlStatement, refund.OrderID, refund.PaymentID, refund.Provider, refund.Phone,
+		refund.Amount.Amount, refund.Amount.Currency, refund.Reason, refund.Actor)
+	if err := scanRefund(row, &refund); err != nil {
+		return nil, translateError(err)
+	}
+	return &refund, tx.Commit()
+}
+
+func (v *DB) SetRefundReference(id int, reference string) error {
+	sqlStatement := `
+		UPDATE refunds
+		SET reference = $2, updated_at = now()
+		WHERE id = $1
+	`
+	return affected(v.db.Exec(sqlStatement, id, reference))
+}
+
+func (v *DB) SettleRefund(id int, status RefundStatus, receipt, reason string, notification *Notification) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `
+		UPDATE refunds
+		SET status = $2, receipt = $3, failure_reason = $4, updated_at = now()
+		WHERE id = $1 AND status = 'pending'
+		RETURNING order_id
+	`
+	var orderID int
+	if err := tx.QueryRow(sqlStatement, id, status, receipt, reason).Scan(&orderID); err != nil {
+		return err
+	}
+	if notification != nil {
+		notification.OrderID = &orderID
+		if err := queueNotification(tx, notification); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (v *DB) FindRefundByReference(provider, reference string) (*Refund, error) {
+	sqlStatement := `SELECT ` + refundColumns + ` FROM refunds WHERE provider = $1 AND reference = $2`
+	var refund Refund
+	if err := scanRefund(v.db.QueryRow(sqlStatement, provider, reference), &refund); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+func (v *DB) OrderRefunds(orderID int) ([]Refund, error) {
+	sqlStatement := `
+		SELECT ` + refundColumns + ` FROM refunds
+		WHERE order_id = $1
+		ORDER BY created_at DESC, id DESC
+	`
+	rows, err := v.db.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	refunds := []Refund{}
+	for rows.Next() {
+		var refund Refund
+		if err := scanRefund(rows, &refund); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
 }
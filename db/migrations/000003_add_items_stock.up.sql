@@ -0,0 +1 @@
+ALTER TABLE items ADD COLUMN IF NOT EXISTS stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0);
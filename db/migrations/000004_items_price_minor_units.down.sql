@@ -0,0 +1,3 @@
+ALTER TABLE items DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE items ALTER COLUMN price TYPE REAL USING price / 100.0;
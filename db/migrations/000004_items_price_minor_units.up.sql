@@ -0,0 +1,3 @@
+ALTER TABLE items ALTER COLUMN price TYPE BIGINT USING ROUND(price * 100)::BIGINT;
+
+ALTER TABLE items ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'KES';
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS item_tags;
+
+DROP TABLE IF EXISTS tags;
+
+DROP TABLE IF EXISTS item_categories;
+
+DROP TABLE IF EXISTS categories;
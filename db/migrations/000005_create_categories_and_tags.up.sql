@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    parent_id INTEGER REFERENCES categories(id),
+    name VARCHAR(255) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id);
+
+CREATE TABLE IF NOT EXISTS item_categories (
+    item_id INTEGER REFERENCES items(id) ON DELETE CASCADE NOT NULL,
+    category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE NOT NULL,
+    PRIMARY KEY (item_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS item_categories_category_id_idx ON item_categories (category_id);
+
+CREATE TABLE IF NOT EXISTS tags (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS item_tags (
+    item_id INTEGER REFERENCES items(id) ON DELETE CASCADE NOT NULL,
+    tag_id INTEGER REFERENCES tags(id) ON DELETE CASCADE NOT NULL,
+    PRIMARY KEY (item_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS item_tags_tag_id_idx ON item_tags (tag_id);
@@ -0,0 +1,3 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS variant_id;
+
+DROP TABLE IF EXISTS item_variants;
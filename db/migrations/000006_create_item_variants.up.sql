@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS item_variants (
+    id SERIAL PRIMARY KEY,
+    item_id INTEGER REFERENCES items(id) ON DELETE CASCADE NOT NULL,
+    sku VARCHAR(64) NOT NULL UNIQUE,
+    gtin CHAR(14) UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    price BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL DEFAULT 'KES',
+    stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS item_variants_item_id_idx ON item_variants (item_id);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS variant_id INTEGER REFERENCES item_variants(id);
@@ -0,0 +1,5 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS deleted_at;
+
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
+
+ALTER TABLE items DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,5 @@
+ALTER TABLE items ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS item_price_history;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS currency;
+ALTER TABLE orders DROP COLUMN IF EXISTS line_total;
+ALTER TABLE orders DROP COLUMN IF EXISTS unit_price;
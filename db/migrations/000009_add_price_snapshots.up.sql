@@ -0,0 +1,34 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS unit_price BIGINT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS line_total BIGINT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency CHAR(3);
+
+-- the price at order time was never kept, today's price is the best guess
+UPDATE orders
+SET unit_price = COALESCE(
+        (SELECT price FROM item_variants WHERE item_variants.id = orders.variant_id),
+        (SELECT price FROM items WHERE items.id = orders.item_id)),
+    currency = COALESCE(
+        (SELECT currency FROM item_variants WHERE item_variants.id = orders.variant_id),
+        (SELECT currency FROM items WHERE items.id = orders.item_id))
+WHERE unit_price IS NULL;
+UPDATE orders SET line_total = unit_price * qty WHERE line_total IS NULL;
+
+ALTER TABLE orders ALTER COLUMN unit_price SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN line_total SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN currency SET NOT NULL;
+
+CREATE TABLE IF NOT EXISTS item_price_history (
+    id SERIAL PRIMARY KEY,
+    item_id INTEGER REFERENCES items(id) ON DELETE CASCADE NOT NULL,
+    variant_id INTEGER REFERENCES item_variants(id) ON DELETE CASCADE,
+    price BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS item_price_history_item_id_idx ON item_price_history (item_id, changed_at);
+
+INSERT INTO item_price_history (item_id, price, currency)
+SELECT id, price, currency FROM items;
+INSERT INTO item_price_history (item_id, variant_id, price, currency)
+SELECT item_id, id, price, currency FROM item_variants;
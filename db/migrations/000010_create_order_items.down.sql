@@ -0,0 +1,27 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS item_id INTEGER REFERENCES items(id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS variant_id INTEGER REFERENCES item_variants(id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS qty INTEGER;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS unit_price BIGINT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS line_total BIGINT;
+
+-- orders can only hold one line again, keep the first one of each
+UPDATE orders
+SET item_id = first_line.item_id,
+    variant_id = first_line.variant_id,
+    qty = first_line.qty,
+    unit_price = first_line.unit_price,
+    line_total = first_line.line_total
+FROM (
+    SELECT DISTINCT ON (order_id) order_id, item_id, variant_id, qty, unit_price, line_total
+    FROM order_items
+    ORDER BY order_id, id
+) AS first_line
+WHERE orders.id = first_line.order_id;
+
+ALTER TABLE orders ALTER COLUMN item_id SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN qty SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN unit_price SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN line_total SET NOT NULL;
+ALTER TABLE orders DROP COLUMN IF EXISTS total;
+
+DROP TABLE IF EXISTS order_items;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE NOT NULL,
+    item_id INTEGER REFERENCES items(id) NOT NULL,
+    variant_id INTEGER REFERENCES item_variants(id),
+    qty INTEGER NOT NULL CHECK (qty > 0),
+    unit_price BIGINT NOT NULL,
+    line_total BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_items_order_id_idx ON order_items (order_id);
+CREATE INDEX IF NOT EXISTS order_items_item_id_idx ON order_items (item_id);
+
+-- every existing order becomes a header with a single line
+INSERT INTO order_items (order_id, item_id, variant_id, qty, unit_price, line_total, currency)
+SELECT id, item_id, variant_id, qty, unit_price, line_total, currency FROM orders;
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total BIGINT;
+UPDATE orders SET total = line_total;
+ALTER TABLE orders ALTER COLUMN total SET NOT NULL;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS item_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS variant_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS qty;
+ALTER TABLE orders DROP COLUMN IF EXISTS unit_price;
+ALTER TABLE orders DROP COLUMN IF EXISTS line_total;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS orders_user_id_time_idx ON orders (user_id, time DESC, id DESC);
@@ -0,0 +1,4 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS address_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS contact;
+
+DROP TABLE IF EXISTS addresses;
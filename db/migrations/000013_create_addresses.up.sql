@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS addresses (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+    label VARCHAR(64) NOT NULL,
+    contact VARCHAR(32) NOT NULL,
+    line1 VARCHAR(255) NOT NULL,
+    line2 VARCHAR(255) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS addresses_user_id_idx ON addresses (user_id);
+
+-- the contact of orders placed so far was never stored
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS contact VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS address_id INTEGER REFERENCES addresses(id) ON DELETE SET NULL;
@@ -0,0 +1,6 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS tax_inclusive;
+ALTER TABLE orders DROP COLUMN IF EXISTS tax_rate;
+ALTER TABLE orders DROP COLUMN IF EXISTS tax;
+ALTER TABLE orders DROP COLUMN IF EXISTS delivery_fee;
+ALTER TABLE orders DROP COLUMN IF EXISTS discount;
+ALTER TABLE orders DROP COLUMN IF EXISTS subtotal;
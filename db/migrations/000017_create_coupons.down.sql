@@ -0,0 +1,4 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS coupon_code;
+ALTER TABLE orders DROP COLUMN IF EXISTS coupon_id;
+DROP TABLE IF EXISTS coupon_redemptions;
+DROP TABLE IF EXISTS coupons;
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS coupons (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    percent_off INTEGER NOT NULL DEFAULT 0 CHECK (percent_off BETWEEN 0 AND 100),
+    amount_off BIGINT NOT NULL DEFAULT 0 CHECK (amount_off >= 0),
+    min_basket BIGINT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL,
+    starts_at TIMESTAMPTZ,
+    ends_at TIMESTAMPTZ,
+    -- 0 means no limit
+    max_redemptions INTEGER NOT NULL DEFAULT 0,
+    max_per_customer INTEGER NOT NULL DEFAULT 0,
+    redemptions INTEGER NOT NULL DEFAULT 0,
+    -- when either is set, only these items or items in these categories
+    -- are discounted
+    item_ids INTEGER[] NOT NULL DEFAULT '{}',
+    category_ids INTEGER[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    deleted_at TIMESTAMP,
+    CHECK ((percent_off > 0) <> (amount_off > 0))
+);
+
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    coupon_id INTEGER REFERENCES coupons(id) NOT NULL,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE NOT NULL UNIQUE,
+    redeemed_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS coupon_redemptions_coupon_user_idx ON coupon_redemptions (coupon_id, user_id);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_id INTEGER REFERENCES coupons(id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(32) NOT NULL DEFAULT '';
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS carts (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    -- carts that haven't been touched for CARTTTL are thrown away
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS carts_updated_at_idx ON carts (updated_at);
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES carts(user_id) ON DELETE CASCADE NOT NULL,
+    item_id INTEGER REFERENCES items(id) ON DELETE CASCADE NOT NULL,
+    variant_id INTEGER REFERENCES item_variants(id) ON DELETE CASCADE,
+    qty INTEGER NOT NULL CHECK (qty > 0),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- one line per item or variant, adding it again adds to the quantity
+CREATE UNIQUE INDEX IF NOT EXISTS cart_items_line_idx ON cart_items (user_id, item_id, (COALESCE(variant_id, 0)));
@@ -0,0 +1,2 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS payment_status;
+DROP TABLE IF EXISTS payments;
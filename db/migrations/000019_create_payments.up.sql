@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS payments (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    phone VARCHAR(32) NOT NULL,
+    amount BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'paid', 'failed')),
+    -- the provider's id for the request, the CheckoutRequestID for M-Pesa
+    reference VARCHAR(64),
+    receipt VARCHAR(64) NOT NULL DEFAULT '',
+    failure_reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payments_order_id_idx ON payments (order_id);
+CREATE UNIQUE INDEX IF NOT EXISTS payments_reference_idx ON payments (provider, reference);
+-- an order has at most one payment in flight
+CREATE UNIQUE INDEX IF NOT EXISTS payments_pending_idx ON payments (order_id) WHERE status = 'pending';
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_status VARCHAR(16) NOT NULL DEFAULT 'unpaid'
+    CHECK (payment_status IN ('unpaid', 'pending', 'paid', 'failed'));
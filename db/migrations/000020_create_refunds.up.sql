@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS refunds (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE NOT NULL,
+    payment_id INTEGER REFERENCES payments(id) ON DELETE CASCADE NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    phone VARCHAR(32) NOT NULL,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    reason TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'completed', 'failed')),
+    -- the provider's id for the refund, the ConversationID for M-Pesa
+    reference VARCHAR(64),
+    receipt VARCHAR(64) NOT NULL DEFAULT '',
+    failure_reason TEXT NOT NULL DEFAULT '',
+    actor VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refunds_order_id_idx ON refunds (order_id);
+CREATE INDEX IF NOT EXISTS refunds_payment_id_idx ON refunds (payment_id);
+CREATE UNIQUE INDEX IF NOT EXISTS refunds_reference_idx ON refunds (provider, reference);
@@ -0,0 +1,4 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS delivery_zone_id;
+ALTER TABLE orders DROP COLUMN IF EXISTS delivery_lng;
+ALTER TABLE orders DROP COLUMN IF EXISTS delivery_lat;
+DROP TABLE IF EXISTS delivery_zones;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS delivery_zones (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    -- a zone is either a polygon, its corners in order, or a circle of
+    -- radius_m metres around the center
+    polygon_lats DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
+    polygon_lngs DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
+    center_lat DOUBLE PRECISION,
+    center_lng DOUBLE PRECISION,
+    radius_m INTEGER NOT NULL DEFAULT 0 CHECK (radius_m >= 0),
+    min_order BIGINT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL,
+    -- the fee schedule, fee_amounts[i] is charged on subtotals from
+    -- fee_min_subtotals[i] up to the next one
+    fee_min_subtotals BIGINT[] NOT NULL,
+    fee_amounts BIGINT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    deleted_at TIMESTAMP,
+    CHECK (cardinality(polygon_lats) = cardinality(polygon_lngs)),
+    CHECK (cardinality(fee_min_subtotals) = cardinality(fee_amounts)),
+    CHECK ((cardinality(polygon_lats) >= 3) <> (center_lat IS NOT NULL AND center_lng IS NOT NULL AND radius_m > 0))
+);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_lat DOUBLE PRECISION;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_lng DOUBLE PRECISION;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_zone_id INTEGER REFERENCES delivery_zones(id);
@@ -0,0 +1,169 @@
+package savannah
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// LatLng is a point on the map in decimal degrees.
+type LatLng struct {
+	Lat float64 `json:"lat" validate:"gte=-90,lte=90"`
+	Lng float64 `json:"lng" validate:"gte=-180,lte=180"`
+}
+
+// DeliveryFee is a step of a zone's fee schedule: Fee is charged on orders
+// with a subtotal of MinSubtotal or more, up to the next step's.
+type DeliveryFee struct {
+	MinSubtotal Money `json:"min_subtotal" validate:"gte=0"`
+	Fee         Money `json:"fee" validate:"gte=0"`
+}
+
+// DeliveryZone is an area we deliver to, either the Polygon with the
+// given corners or the circle of RadiusMeters around Center, and what
+// delivering there costs.
+type DeliveryZone struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name" validate:"required,max=64"`
+	Polygon      []LatLng `json:"polygon,omitempty" validate:"omitempty,min=3,dive"`
+	Center       *LatLng  `json:"center,omitempty"`
+	RadiusMeters int      `json:"radius_m,omitempty" validate:"gte=0"`
+	// MinOrder is the subtotal an order needs to be delivered here
+	MinOrder Money `json:"min_order" validate:"gte=0"`
+	// Fees is the fee schedule, e.g. KSh 200 and free from KSh 3,000; the
+	// first step starts at a subtotal of 0
+	Fees      []DeliveryFee `json:"fees" validate:"required,min=1,dive"`
+	CreatedAt time.Time     `json:"created_at"`
+	DeletedAt *time.Time    `json:"deleted_at,omitempty"`
+}
+
+// DeliveryError is returned when an order can't be delivered where it asks
+// to be.
+type DeliveryError struct {
+	Reason string
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Reason
+}
+
+// check validates what the validator tags can't: exactly one of a polygon
+// or a circle, amounts in a single currency and a fee schedule that starts
+// at 0. It fills in the currency when no amount names one and sorts the
+// schedule.
+func (z *DeliveryZone) check() error {
+	circle := z.Center != nil || z.RadiusMeters > 0
+	if (len(z.Polygon) > 0) == circle {
+		return errors.New("set one of polygon or center and radius_m")
+	}
+	if circle && (z.Center == nil || z.RadiusMeters == 0) {
+		return errors.New("a circle needs both center and radius_m")
+	}
+	amounts := []*Money{&z.MinOrder}
+	for i := range z.Fees {
+		amounts = append(amounts, &z.Fees[i].MinSubtotal, &z.Fees[i].Fee)
+	}
+	currency := ""
+	for _, amount := range amounts {
+		if amount.Amount == 0 {
+			continue
+		}
+		if currency == "" {
+			currency = amount.Currency
+		}
+		if amount.Currency != currency {
+			return ErrCurrencyMismatch
+		}
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	for _, amount := range amounts {
+		amount.Currency = currency
+	}
+	sort.SliceStable(z.Fees, func(i, j int) bool { return z.Fees[i].MinSubtotal.Amount < z.Fees[j].MinSubtotal.Amount })
+	if z.Fees[0].MinSubtotal.Amount != 0 {
+		return errors.New("the first fee must start at a min_subtotal of 0")
+	}
+	return nil
+}
+
+// Contains reports whether the zone covers point.
+func (z *DeliveryZone) Contains(point LatLng) bool {
+	if z.Center != nil {
+		return distanceMeters(*z.Center, point) <= float64(z.RadiusMeters)
+	}
+	return inPolygon(z.Polygon, point)
+}
+
+// Fee is what delivering an order with subtotal here costs.
+func (z *DeliveryZone) Fee(subtotal Money) Money {
+	fee := z.Fees[0].Fee
+	for _, step := range z.Fees {
+		if subtotal.Amount >= step.MinSubtotal.Amount {
+			fee = step.Fee
+		}
+	}
+	return fee
+}
+
+// earthRadius is the mean radius of the Earth in metres.
+const earthRadius = 6371000
+
+// distanceMeters is the great-circle distance between a and b.
+func distanceMeters(a, b LatLng) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLng := rad(b.Lat-a.Lat), rad(b.Lng-a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// inPolygon tells whether point is inside polygon by counting how many of
+// its edges a line running east from the point crosses. Treating degrees
+// as flat coordinates is close enough at the scale of a city.
+func inPolygon(polygon []LatLng, point LatLng) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > point.Lat) != (b.Lat > point.Lat) &&
+			point.Lng < (b.Lng-a.Lng)*(point.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// deliveryZone finds the zone that delivers to location for an order with
+// subtotal. Where zones overlap the cheapest delivery wins, among the
+// zones whose minimum order the subtotal reaches.
+func (s Service) deliveryZone(location LatLng, subtotal Money) (*DeliveryZone, error) {
+	zones, err := s.service.ListDeliveryZones()
+	if err != nil {
+		return nil, err
+	}
+	var best, short *DeliveryZone
+	for i := range zones {
+		zone := &zones[i]
+		if !zone.Contains(location) || zone.MinOrder.Currency != subtotal.Currency {
+			continue
+		}
+		if subtotal.Amount < zone.MinOrder.Amount {
+			if short == nil || zone.MinOrder.Amount < short.MinOrder.Amount {
+				short = zone
+			}
+			continue
+		}
+		if best == nil || zone.Fee(subtotal).Amount < best.Fee(subtotal).Amount {
+			best = zone
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if short != nil {
+		return nil, &DeliveryError{Reason: fmt.Sprintf("delivery to %s needs an order of at least %s", short.Name, short.MinOrder)}
+	}
+	return nil, &DeliveryError{Reason: "we don't deliver to that location yet"}
+}
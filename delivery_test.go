@@ -0,0 +1,129 @@
+package savannah
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	cbd       = LatLng{-1.2864, 36.8172}
+	parklands = LatLng{-1.2620, 36.8150}
+	karen     = LatLng{-1.3197, 36.7076}
+)
+
+// newCBDZone is a box around the Nairobi CBD. Zones are built afresh for
+// each test as check and the stores change them.
+func newCBDZone() DeliveryZone {
+	return DeliveryZone{
+		Name:    "CBD",
+		Polygon: []LatLng{{-1.29, 36.81}, {-1.29, 36.83}, {-1.28, 36.83}, {-1.28, 36.81}},
+		Fees:    []DeliveryFee{{Fee: NewMoney(20000, "KES")}, {MinSubtotal: NewMoney(300000, "KES"), Fee: NewMoney(0, "KES")}},
+	}
+}
+
+// newWestlandsZone is 3km around Westlands, which takes in most of the CBD.
+func newWestlandsZone() DeliveryZone {
+	return DeliveryZone{
+		Name:         "Westlands",
+		Center:       &LatLng{-1.2676, 36.8108},
+		RadiusMeters: 3000,
+		MinOrder:     NewMoney(50000, "KES"),
+		Fees:         []DeliveryFee{{Fee: NewMoney(15000, "KES")}},
+	}
+}
+
+func TestDeliveryZone_Contains(t *testing.T) {
+	cbdZone, westlandsZone := newCBDZone(), newWestlandsZone()
+	assert.True(t, cbdZone.Contains(cbd))
+	assert.False(t, cbdZone.Contains(parklands))
+	assert.False(t, cbdZone.Contains(karen))
+	assert.True(t, westlandsZone.Contains(cbd))
+	assert.True(t, westlandsZone.Contains(parklands))
+	assert.False(t, westlandsZone.Contains(karen))
+
+	assert.InDelta(t, 2208, distanceMeters(*westlandsZone.Center, cbd), 5)
+}
+
+func TestDeliveryZone_Fee(t *testing.T) {
+	cbdZone := newCBDZone()
+	assert.Equal(t, NewMoney(20000, "KES"), cbdZone.Fee(NewMoney(299999, "KES")))
+	assert.Equal(t, NewMoney(0, "KES"), cbdZone.Fee(NewMoney(300000, "KES")))
+}
+
+func TestDeliveryZone_Check(t *testing.T) {
+	cbdZone := newCBDZone()
+	zone := DeliveryZone{Name: "Both", Polygon: cbdZone.Polygon, Center: &cbd, RadiusMeters: 100, Fees: cbdZone.Fees}
+	assert.Error(t, zone.check())
+	zone = DeliveryZone{Name: "No radius", Center: &cbd, Fees: cbdZone.Fees}
+	assert.Error(t, zone.check())
+	zone = DeliveryZone{Name: "Gap", Center: &cbd, RadiusMeters: 100, Fees: []DeliveryFee{{MinSubtotal: NewMoney(100, "KES"), Fee: NewMoney(100, "KES")}}}
+	assert.Error(t, zone.check())
+	zone = DeliveryZone{Name: "Mixed", Center: &cbd, RadiusMeters: 100, MinOrder: NewMoney(100, "USD"), Fees: []DeliveryFee{{Fee: NewMoney(100, "KES")}}}
+	assert.Equal(t, ErrCurrencyMismatch, zone.check())
+
+	zone = DeliveryZone{Name: "Unsorted", Center: &cbd, RadiusMeters: 100,
+		Fees: []DeliveryFee{{MinSubtotal: NewMoney(5000, "KES"), Fee: NewMoney(0, "")}, {Fee: NewMoney(100, "KES")}}}
+	assert.NoError(t, zone.check())
+	assert.Equal(t, int64(0), zone.Fees[0].MinSubtotal.Amount)
+	assert.Equal(t, "KES", zone.MinOrder.Currency)
+	assert.Equal(t, "KES", zone.Fees[1].Fee.Currency)
+}
+
+func TestService_PriceOrder_DeliveryZones(t *testing.T) {
+	service := NewMockService()
+	service.pricing = Pricing{DeliveryFee: NewMoney(10000, "KES")}
+	store := service.service
+	cbdZone, westlandsZone := newCBDZone(), newWestlandsZone()
+	for _, zone := range []*DeliveryZone{&cbdZone, &westlandsZone} {
+		assert.NoError(t, zone.check())
+	}
+	cbdCreated, err := store.CreateDeliveryZone(cbdZone)
+	assert.NoError(t, err)
+	westlands, err := store.CreateDeliveryZone(westlandsZone)
+	assert.NoError(t, err)
+	item, err := store.CreateItem(Item{Price: NewMoney(40000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 100})
+	assert.NoError(t, err)
+	price := func(qty int, location *LatLng) (*Orders, error) {
+		order := Orders{Lines: []OrderLine{{ItemID: item.ID, Qty: qty}}, DeliveryLocation: location}
+		return &order, service.PriceOrder(&order)
+	}
+
+	// with zones set up the flat fee no longer applies
+	_, err = price(1, nil)
+	var delivery *DeliveryError
+	assert.ErrorAs(t, err, &delivery)
+
+	// below Westlands' minimum only the CBD delivers
+	order, err := price(1, &cbd)
+	assert.NoError(t, err)
+	assert.Equal(t, cbdCreated.ID, *order.DeliveryZoneID)
+	assert.Equal(t, NewMoney(20000, "KES"), order.Breakdown.DeliveryFee)
+	// above it Westlands is cheaper, until the CBD's is free
+	order, err = price(2, &cbd)
+	assert.NoError(t, err)
+	assert.Equal(t, westlands.ID, *order.DeliveryZoneID)
+	assert.Equal(t, NewMoney(15000, "KES"), order.Breakdown.DeliveryFee)
+	assert.Equal(t, NewMoney(95000, "KES"), order.Total)
+	order, err = price(8, &cbd)
+	assert.NoError(t, err)
+	assert.Equal(t, cbdCreated.ID, *order.DeliveryZoneID)
+	assert.Equal(t, NewMoney(0, "KES"), order.Breakdown.DeliveryFee)
+
+	_, err = price(1, &parklands)
+	assert.EqualError(t, err, "delivery to Westlands needs an order of at least KSh 500.00")
+	_, err = price(1, &karen)
+	assert.ErrorAs(t, err, &delivery)
+
+	// archived zones no longer deliver
+	assert.NoError(t, store.DeleteDeliveryZone(cbdCreated.ID))
+	_, err = price(1, &cbd)
+	assert.ErrorAs(t, err, &delivery)
+
+	// without any zones the flat fee is back
+	assert.NoError(t, store.DeleteDeliveryZone(westlands.ID))
+	order, err = price(1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10000, "KES"), order.Breakdown.DeliveryFee)
+	assert.Nil(t, order.DeliveryZoneID)
+}
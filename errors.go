@@ -0,0 +1,31 @@
+package savannah
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConflict is returned when a write would violate a uniqueness or
+// referential constraint, e.g. deleting an item that orders still point to.
+var ErrConflict = errors.New("conflict")
+
+// ErrCurrencyMismatch is returned when an order mixes lines priced in
+// different currencies.
+var ErrCurrencyMismatch = errors.New("order lines are priced in different currencies")
+
+// OutOfStockError is returned when an order asks for more of an item than
+// is left in stock.
+type OutOfStockError struct {
+	ItemID int
+	// VariantID is set when the order was for a specific variant
+	VariantID int
+	Requested int
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	if e.VariantID != 0 {
+		return fmt.Sprintf("variant %d of item %d is out of stock: requested %d, available %d", e.VariantID, e.ItemID, e.Requested, e.Available)
+	}
+	return fmt.Sprintf("item %d is out of stock: requested %d, available %d", e.ItemID, e.Requested, e.Available)
+}
@@ -0,0 +1,35 @@
+package savannah
+
+import "strings"
+
+// normalizeGTIN validates a GTIN-8, UPC-A (GTIN-12), EAN-13 or GTIN-14
+// barcode and left pads it with zeros to 14 digits, so a product scanned as
+// UPC-A finds the variant stored with its EAN-13.
+func normalizeGTIN(code string) (string, bool) {
+	code = strings.TrimSpace(code)
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return "", false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	code = strings.Repeat("0", 14-len(code)) + code
+	// the check digit makes the weighted sum, with weights alternating
+	// 3 and 1 from the right, a multiple of ten
+	var sum int
+	for i := 0; i < 13; i++ {
+		digit := int(code[i] - '0')
+		if i%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	if (10-sum%10)%10 != int(code[13]-'0') {
+		return "", false
+	}
+	return code, true
+}
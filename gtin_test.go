@@ -0,0 +1,24 @@
+package savannah
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeGTIN(t *testing.T) {
+	for code, want := range map[string]string{
+		"4006381333931":  "04006381333931",
+		"036000291452":   "00036000291452",
+		"96385074":       "00000096385074",
+		"10012345678902": "10012345678902",
+	} {
+		got, ok := normalizeGTIN(code)
+		assert.True(t, ok, code)
+		assert.Equal(t, want, got)
+	}
+	for _, code := range []string{"4006381333932", "40063813339", "40063813339a1", ""} {
+		_, ok := normalizeGTIN(code)
+		assert.False(t, ok, code)
+	}
+}
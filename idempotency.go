@@ -0,0 +1,188 @@
+package savannah
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore remembers the responses of requests sent with an
+// Idempotency-Key, so a retried request is answered without running it
+// twice. Keys live within a scope, the caller and route, and expire after
+// their TTL.
+type IdempotencyStore interface {
+	// Reserve claims key for a request whose body hashes to hash. It
+	// returns nil when the caller should go ahead and run the request, or
+	// the record left by an earlier request with the same key. The
+	// record's StatusCode is 0 while that request is still running.
+	Reserve(scope, key, hash string, ttl time.Duration) (*IdempotencyRecord, error)
+	// Complete stores the response to a reserved request.
+	Complete(scope, key string, statusCode int, body []byte) error
+	// Release drops a reservation so the request can be retried, e.g.
+	// after it failed with a server error.
+	Release(scope, key string) error
+	// DeleteExpired drops the keys past their TTL and reports how many
+	// there were.
+	DeleteExpired() (int, error)
+}
+
+type IdempotencyRecord struct {
+	Hash       string
+	StatusCode int
+	Body       []byte
+}
+
+// DBIdempotencyStore keeps idempotency keys in the idempotency_keys table.
+type DBIdempotencyStore struct {
+	db *sql.DB
+}
+
+func NewDBIdempotencyStore(conn *sql.DB) *DBIdempotencyStore {
+	return &DBIdempotencyStore{db: conn}
+}
+
+// Reserve inserts the key, taking over an expired one in the same statement
+// so two requests can't both claim it.
+func (s *DBIdempotencyStore) Reserve(scope, key, hash string, ttl time.Duration) (*IdempotencyRecord, error) {
+	insert := `
+		INSERT INTO idempotency_keys (scope, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+		ON CONFLICT (scope, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = NULL, response = NULL,
+			created_at = now(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= now()
+		RETURNING key
+	`
+	find := `
+		SELECT request_hash, COALESCE(status_code, 0), response FROM idempotency_keys
+		WHERE scope = $1 AND key = $2
+	`
+	for {
+		var reserved string
+		err := s.db.QueryRow(insert, scope, key, hash, ttl.Seconds()).Scan(&reserved)
+		if err == nil {
+			return nil, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		var record IdempotencyRecord
+		err = s.db.QueryRow(find, scope, key).Scan(&record.Hash, &record.StatusCode, &record.Body)
+		if err == sql.ErrNoRows {
+			// released in between, try to claim it again
+			continue
+		}
+		return &record, err
+	}
+}
+
+func (s *DBIdempotencyStore) Complete(scope, key string, statusCode int, body []byte) error {
+	sqlStatement := `
+		UPDATE idempotency_keys
+		SET status_code = $3, response = $4
+		WHERE scope = $1 AND key = $2
+	`
+	return affected(s.db.Exec(sqlStatement, scope, key, statusCode, body))
+}
+
+func (s *DBIdempotencyStore) Release(scope, key string) error {
+	sqlStatement := `
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND key = $2
+	`
+	_, err := s.db.Exec(sqlStatement, scope, key)
+	return err
+}
+
+func (s *DBIdempotencyStore) DeleteExpired() (int, error) {
+	sqlStatement := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at <= now()
+	`
+	result, err := s.db.Exec(sqlStatement)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// MemIdempotencyStore is an IdempotencyStore in memory, for tests.
+type MemIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[[2]string]memIdempotencyRecord
+}
+
+type memIdempotencyRecord struct {
+	IdempotencyRecord
+	expires time.Time
+}
+
+func NewMemIdempotencyStore() *MemIdempotencyStore {
+	return &MemIdempotencyStore{records: make(map[[2]string]memIdempotencyRecord)}
+}
+
+func (s *MemIdempotencyStore) Reserve(scope, key, hash string, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[[2]string{scope, key}]; ok && time.Now().Before(record.expires) {
+		return &record.IdempotencyRecord, nil
+	}
+	s.records[[2]string{scope, key}] = memIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Hash: hash},
+		expires:           time.Now().Add(ttl),
+	}
+	return nil, nil
+}
+
+func (s *MemIdempotencyStore) Complete(scope, key string, statusCode int, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[[2]string{scope, key}]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	record.StatusCode, record.Body = statusCode, append([]byte(nil), body...)
+	s.records[[2]string{scope, key}] = record
+	return nil
+}
+
+func (s *MemIdempotencyStore) Release(scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, [2]string{scope, key})
+	return nil
+}
+
+func (s *MemIdempotencyStore) DeleteExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := 0
+	for key, record := range s.records {
+		if !time.Now().Before(record.expires) {
+			delete(s.records, key)
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// RunIdempotencyExpiry drops expired idempotency keys every interval until
+// ctx is done. Reserve takes over expired keys itself, this only keeps keys
+// that are never retried from piling up.
+func (s Service) RunIdempotencyExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.idempotency.DeleteExpired(); err != nil {
+			log.Println("idempotency keys:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package savannah
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemIdempotencyStore_Expiry(t *testing.T) {
+	store := NewMemIdempotencyStore()
+	record, err := store.Reserve("scope", "key", "hash", time.Hour)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+	assert.NoError(t, store.Complete("scope", "key", http.StatusCreated, []byte("{}")))
+
+	record, err = store.Reserve("scope", "key", "other", time.Hour)
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Equal(t, http.StatusCreated, record.StatusCode)
+	}
+
+	// expired keys can be reserved again
+	record, err = store.Reserve("scope", "short", "hash", time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+	time.Sleep(2 * time.Millisecond)
+	record, err = store.Reserve("scope", "short", "other", time.Hour)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestMemIdempotencyStore_DeleteExpired(t *testing.T) {
+	store := NewMemIdempotencyStore()
+	_, err := store.Reserve("scope", "old", "hash", time.Millisecond)
+	assert.NoError(t, err)
+	_, err = store.Reserve("scope", "new", "hash", time.Hour)
+	assert.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+	expired, err := store.DeleteExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	record, err := store.Reserve("scope", "new", "other", time.Hour)
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+}
@@ -0,0 +1,130 @@
+package savannah
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+)
+
+const (
+	maxImageSize      = 5 << 20
+	maxImageDimension = 8000
+	thumbnailSize     = 320
+)
+
+var (
+	ErrImageTooLarge    = errors.New("image is too large")
+	ErrUnsupportedImage = errors.New("unsupported image type, expected jpeg, png or gif")
+)
+
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// processedImage is an upload that passed validation, along with the
+// encoded thumbnail to store next to it. Thumbnails of jpegs are jpegs,
+// everything else gets a png so transparency survives.
+type processedImage struct {
+	data                 []byte
+	contentType          string
+	width, height        int
+	thumbnail            []byte
+	thumbnailContentType string
+}
+
+// processImage checks an upload's size and sniffed content type, decodes it
+// and renders its thumbnail.
+func processImage(r io.Reader) (*processedImage, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, ErrImageTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if _, ok := imageExtensions[contentType]; !ok {
+		return nil, ErrUnsupportedImage
+	}
+	// check the dimensions before decoding, a small file can still claim
+	// a huge canvas
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedImage, err)
+	}
+	if config.Width > maxImageDimension || config.Height > maxImageDimension {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedImage, err)
+	}
+
+	var thumb bytes.Buffer
+	thumbnailContentType := "image/png"
+	small := thumbnail(img, thumbnailSize)
+	if contentType == "image/jpeg" {
+		thumbnailContentType = contentType
+		err = jpeg.Encode(&thumb, small, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&thumb, small)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &processedImage{
+		data:                 data,
+		contentType:          contentType,
+		width:                config.Width,
+		height:               config.Height,
+		thumbnail:            thumb.Bytes(),
+		thumbnailContentType: thumbnailContentType,
+	}, nil
+}
+
+// thumbnail scales src down to fit within max x max, keeping its aspect
+// ratio. Every thumbnail pixel is the average of the source pixels it
+// covers, which keeps detail better than nearest neighbour sampling.
+func thumbnail(src image.Image, max int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= max && h <= max {
+		return src
+	}
+	tw, th := max, h*max/w
+	if h > w {
+		tw, th = w*max/h, max
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := bounds.Min.Y+y*h/th, bounds.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := bounds.Min.X+x*w/tw, bounds.Min.X+(x+1)*w/tw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
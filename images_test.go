@@ -0,0 +1,43 @@
+package savannah
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestProcessImage(t *testing.T) {
+	processed, err := processImage(bytes.NewReader(encodePNG(t, 800, 400)))
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", processed.contentType)
+	assert.Equal(t, 800, processed.width)
+
+	thumb, err := png.Decode(bytes.NewReader(processed.thumbnail))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, thumbnailSize, thumbnailSize/2), thumb.Bounds())
+
+	_, err = processImage(strings.NewReader("GIF89a"))
+	assert.ErrorIs(t, err, ErrUnsupportedImage)
+	_, err = processImage(strings.NewReader("plain text"))
+	assert.ErrorIs(t, err, ErrUnsupportedImage)
+}
+
+func TestThumbnail_KeepsSmallImages(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	assert.Equal(t, img, thumbnail(img, thumbnailSize))
+}
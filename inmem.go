@@ -1,8 +1,13 @@
 package savannah
 
 import (
-	"errors"
+	"database/sql"
+	"html"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
 )
 
 // MockInMemDB is a mock implementation of the database interface
@@ -11,6 +16,26 @@ type MockInMemDB struct {
 	UserData map[int]User
 	ItemData map[int]Item
 	Orders   map[int]Orders
+
+	Categories     map[int]Category
+	ItemCategoryID map[int][]int
+	ItemTagNames   map[int][]string
+	Variants       map[int]ItemVariant
+	Images         map[int]ItemImage
+	Addresses      map[int]Address
+	PriceHistory   []PriceChange
+	StatusHistory  []OrderStatusChange
+	Notifications  map[int]Notification
+	Coupons        map[int]Coupon
+	redemptions    []couponRedemption
+	Carts          map[int]Cart
+	Payments       map[int]Payment
+	Refunds        map[int]Refund
+	DeliveryZones  map[int]DeliveryZone
+}
+
+type couponRedemption struct {
+	CouponID, UserID, OrderID int
 }
 
 func NewMockStore() *MockInMemDB {
@@ -18,15 +43,30 @@ func NewMockStore() *MockInMemDB {
 	item_map := make(map[int]Item)
 	order_map := make(map[int]Orders)
 	return &MockInMemDB{
-		UserData: usermap,
-		ItemData: item_map,
-		Orders:   order_map,
+		UserData:       usermap,
+		ItemData:       item_map,
+		Orders:         order_map,
+		Categories:     make(map[int]Category),
+		ItemCategoryID: make(map[int][]int),
+		ItemTagNames:   make(map[int][]string),
+		Variants:       make(map[int]ItemVariant),
+		Images:         make(map[int]ItemImage),
+		Addresses:      make(map[int]Address),
+		Notifications:  make(map[int]Notification),
+		Coupons:        make(map[int]Coupon),
+		Carts:          make(map[int]Cart),
+		Payments:       make(map[int]Payment),
+		Refunds:        make(map[int]Refund),
+		DeliveryZones:  make(map[int]DeliveryZone),
 	}
 }
 
 func NewMockService() Service {
 	return Service{
-		service: NewMockStore(),
+		service:     NewMockStore(),
+		idempotency: NewMemIdempotencyStore(),
+		cartTTL:     defaultCartTTL,
+		payments:    FakePaymentProvider{},
 	}
 }
 
@@ -42,122 +82,1611 @@ func (m *MockInMemDB) CreateItem(item Item) (*Item, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	item.ID = generateUniqueItemID()
+	item.Price = withCurrency(item.Price)
 	m.ItemData[item.ID] = item
+	m.recordPrice(item.ID, nil, item.Price)
 	return &item, nil
 }
 
-func (m *MockInMemDB) CreateOrders(order Orders) (*Orders, error) {
+// CreateOrders checks every line against stock and its price before taking
+// any of it, so a basket is ordered as a whole or not at all.
+func (m *MockInMemDB) CreateOrders(order Orders, notify func(order *Orders) *Notification) (*Orders, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.createOrder(order, notify)
+}
+
+// createOrder is CreateOrders for callers holding the write lock.
+func (m *MockInMemDB) createOrder(order Orders, notify func(order *Orders) *Notification) (*Orders, error) {
+	items := make(map[int]Item)
+	variants := make(map[int]ItemVariant)
+	order.Lines = append([]OrderLine(nil), order.Lines...)
+	if err := checkLines(&order); err != nil {
+		return nil, err
+	}
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		if line.VariantID != nil {
+			variant, ok := variants[*line.VariantID]
+			if !ok {
+				variant, ok = m.Variants[*line.VariantID]
+			}
+			if !ok || variant.ItemID != line.ItemID || m.ItemData[variant.ItemID].DeletedAt != nil {
+				return nil, sql.ErrNoRows
+			}
+			if variant.Stock < line.Qty {
+				return nil, &OutOfStockError{ItemID: variant.ItemID, VariantID: variant.ID, Requested: line.Qty, Available: variant.Stock}
+			}
+			if variant.Price != line.UnitPrice {
+				return nil, ErrPriceChanged
+			}
+			variant.Stock -= line.Qty
+			variants[variant.ID] = variant
+		} else {
+			item, ok := items[line.ItemID]
+			if !ok {
+				item, ok = m.ItemData[line.ItemID]
+			}
+			if !ok || item.DeletedAt != nil {
+				return nil, sql.ErrNoRows
+			}
+			if item.Stock < line.Qty {
+				return nil, &OutOfStockError{ItemID: item.ID, Requested: line.Qty, Available: item.Stock}
+			}
+			if item.Price != line.UnitPrice {
+				return nil, ErrPriceChanged
+			}
+			item.Stock -= line.Qty
+			items[item.ID] = item
+		}
+		line.ID = generateUniqueOrderLineID()
+	}
+	if order.CouponID != nil {
+		if err := m.redeemable(order); err != nil {
+			return nil, err
+		}
+	}
+	for id, item := range items {
+		m.ItemData[id] = item
+	}
+	for id, variant := range variants {
+		m.Variants[id] = variant
+	}
 	order.ID = generateUniqueOrderID()
+	order.Status = StatusPending
+	order.PaymentStatus = PaymentUnpaid
 	m.Orders[order.ID] = order
-	return &order, nil
+	if order.CouponID != nil {
+		coupon := m.Coupons[*order.CouponID]
+		coupon.Redemptions++
+		m.Coupons[coupon.ID] = coupon
+		m.redemptions = append(m.redemptions, couponRedemption{CouponID: coupon.ID, UserID: order.UserId, OrderID: order.ID})
+	}
+	if notify != nil {
+		if notification := notify(copyOrder(order)); notification != nil {
+			notification.OrderID = &order.ID
+			m.queueNotification(notification)
+		}
+	}
+	return copyOrder(order), nil
+}
+
+// copyOrder keeps callers from writing to the stored order's lines.
+func copyOrder(order Orders) *Orders {
+	order.Lines = append([]OrderLine{}, order.Lines...)
+	return &order
 }
 
 func (m *MockInMemDB) FindUser(id int) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if user, ok := m.UserData[id]; ok && user.DeletedAt == nil {
+		return &user, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) FindUserIncludingArchived(id int) (*User, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	if user, ok := m.UserData[id]; ok {
 		return &user, nil
 	}
-	return nil, errors.New("user not found")
+	return nil, sql.ErrNoRows
 }
 
 func (m *MockInMemDB) FindUserbyEmail(email string) (*User, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	for _, user := range m.UserData {
-		if user.Email == email {
+		if user.Email == email && user.DeletedAt == nil {
 			return &user, nil
 		}
 	}
-	return nil, errors.New("user not found")
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) FindUserbyEmailIncludingArchived(email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var found *User
+	for _, user := range m.UserData {
+		if user.Email == email && (found == nil || found.DeletedAt != nil) {
+			user := user
+			found = &user
+		}
+	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return found, nil
 }
 
 func (m *MockInMemDB) FindItem(id int) (*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if item, ok := m.ItemData[id]; ok && item.DeletedAt == nil {
+		return &item, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) FindItemIncludingArchived(id int) (*Item, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	if item, ok := m.ItemData[id]; ok {
 		return &item, nil
 	}
-	return nil, errors.New("item not found")
+	return nil, sql.ErrNoRows
 }
 
 func (m *MockInMemDB) FindOrders(id int) (*Orders, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if order, ok := m.Orders[id]; ok && order.DeletedAt == nil {
+		return copyOrder(order), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) FindOrdersIncludingArchived(id int) (*Orders, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	if order, ok := m.Orders[id]; ok {
-		return &order, nil
+		return copyOrder(order), nil
 	}
-	return nil, errors.New("order not found")
+	return nil, sql.ErrNoRows
 }
 
-func (m *MockInMemDB) DeleteUser(id int) error {
+func (m *MockInMemDB) ListOrdersByUser(userID int, filter OrderFilter) (*OrderPage, error) {
+	var cursor *orderCursor
+	if filter.Cursor != "" {
+		cursor = &orderCursor{}
+		if err := decodeCursor(filter.Cursor, cursor); err != nil {
+			return nil, err
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orders := []Orders{}
+	for _, order := range m.Orders {
+		if order.UserId != userID || order.DeletedAt != nil {
+			continue
+		}
+		if filter.Status != "" && order.Status != filter.Status {
+			continue
+		}
+		if filter.From != nil && order.Time.Before(*filter.From) {
+			continue
+		}
+		if filter.To != nil && !order.Time.Before(*filter.To) {
+			continue
+		}
+		if cursor != nil && !cursor.before(newOrderCursor(order)) {
+			continue
+		}
+		orders = append(orders, *copyOrder(order))
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return newOrderCursor(orders[i]).before(newOrderCursor(orders[j]))
+	})
+	page := OrderPage{Orders: orders}
+	if limit := pageSize(filter.Limit); len(orders) > limit {
+		page.Orders = orders[:limit]
+		page.NextCursor = encodeCursor(newOrderCursor(orders[limit-1]))
+	}
+	return &page, nil
+}
+
+func (m *MockInMemDB) ListItems(filter ItemFilter) (*ItemPage, error) {
+	key, desc, err := parseSort(filter.Sort, itemSorts)
+	if err != nil {
+		return nil, err
+	}
+	var cursor *itemCursor
+	if filter.Cursor != "" {
+		cursor = &itemCursor{}
+		if err := decodeCursor(filter.Cursor, cursor); err != nil {
+			return nil, err
+		}
+	}
+	// less orders two items by the sort key with id as the tie breaker,
+	// mirroring the ORDER BY used by the postgres implementation.
+	less := func(a, b itemCursor) bool {
+		var cmp int
+		switch key {
+		case "price":
+			if a.Price < b.Price {
+				cmp = -1
+			} else if a.Price > b.Price {
+				cmp = 1
+			}
+		case "name":
+			cmp = strings.Compare(a.Name, b.Name)
+		}
+		if cmp == 0 {
+			cmp = a.ID - b.ID
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var categories map[int]bool
+	if filter.CategoryID != 0 {
+		categories = m.descendants(filter.CategoryID)
+	}
+	items := []Item{}
+	for _, item := range m.ItemData {
+		if item.DeletedAt != nil && !filter.IncludeArchived {
+			continue
+		}
+		if filter.Name != "" && !strings.Contains(strings.ToLower(item.Name), strings.ToLower(filter.Name)) {
+			continue
+		}
+		if filter.Tag != "" && !contains(m.ItemTagNames[item.ID], normalizeTag(filter.Tag)) {
+			continue
+		}
+		if categories != nil && !m.inCategories(item.ID, categories) {
+			continue
+		}
+		if filter.MinPrice != nil && item.Price.Amount < *filter.MinPrice {
+			continue
+		}
+		if filter.MaxPrice != nil && item.Price.Amount > *filter.MaxPrice {
+			continue
+		}
+		if cursor != nil && !less(*cursor, newItemCursor(item)) {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return less(newItemCursor(items[i]), newItemCursor(items[j]))
+	})
+	page := ItemPage{Items: items}
+	if limit := pageSize(filter.Limit); len(items) > limit {
+		page.Items = items[:limit]
+		page.NextCursor = encodeCursor(newItemCursor(items[limit-1]))
+	}
+	return &page, nil
+}
+
+// SearchItems matches every query token against the words of an item's
+// name and description. Name hits weigh more, much like the 'A' and 'B'
+// weights of the postgres search_vector.
+func (m *MockInMemDB) SearchItems(query string, limit int) ([]ItemSearchResult, error) {
+	terms := tokenize(query)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	results := []ItemSearchResult{}
+	for _, item := range m.ItemData {
+		if item.DeletedAt != nil {
+			continue
+		}
+		var rank float32
+		matched := true
+		for _, term := range terms {
+			hits := float32(countToken(tokenize(item.Name), term))*1.0 +
+				float32(countToken(tokenize(item.Description), term))*0.4
+			if hits == 0 {
+				matched = false
+				break
+			}
+			rank += hits
+		}
+		if !matched || len(terms) == 0 {
+			continue
+		}
+		results = append(results, ItemSearchResult{
+			Item:    item,
+			Rank:    rank,
+			Snippet: highlight(item.Name+" "+item.Description, terms),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID < results[j].ID
+	})
+	if limit = pageSize(limit); len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// descendants returns the category and every category below it.
+func (m *MockInMemDB) descendants(id int) map[int]bool {
+	tree := map[int]bool{id: true}
+	for grew := true; grew; {
+		grew = false
+		for _, category := range m.Categories {
+			if category.ParentID != nil && tree[*category.ParentID] && !tree[category.ID] {
+				tree[category.ID] = true
+				grew = true
+			}
+		}
+	}
+	return tree
+}
+
+func (m *MockInMemDB) inCategories(itemID int, categories map[int]bool) bool {
+	for _, id := range m.ItemCategoryID[itemID] {
+		if categories[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPrice appends to the price history; callers hold the write lock.
+func (m *MockInMemDB) recordPrice(itemID int, variantID *int, price Money) {
+	if variantID != nil {
+		id := *variantID
+		variantID = &id
+	}
+	m.PriceHistory = append(m.PriceHistory, PriceChange{ItemID: itemID, VariantID: variantID, Price: price, ChangedAt: time.Now()})
+}
+
+func (m *MockInMemDB) ItemPriceHistory(itemID int) ([]PriceChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history := []PriceChange{}
+	for _, change := range m.PriceHistory {
+		if change.ItemID == itemID {
+			history = append(history, change)
+		}
+	}
+	return history, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockInMemDB) CreateCategory(category Category) (*Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if category.ParentID != nil {
+		if _, ok := m.Categories[*category.ParentID]; !ok {
+			return nil, ErrConflict
+		}
+	}
+	category.ID = generateUniqueCategoryID()
+	m.Categories[category.ID] = category
+	return &category, nil
+}
+
+func (m *MockInMemDB) FindCategory(id int) (*Category, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if category, ok := m.Categories[id]; ok {
+		return &category, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) ListCategories() ([]Category, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	categories := []Category{}
+	for _, category := range m.Categories {
+		categories = append(categories, category)
+	}
+	sortCategories(categories)
+	return categories, nil
+}
+
+func sortCategories(categories []Category) {
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Name != categories[j].Name {
+			return categories[i].Name < categories[j].Name
+		}
+		return categories[i].ID < categories[j].ID
+	})
+}
+
+func (m *MockInMemDB) SetItemCategories(itemID int, categoryIDs []int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.UserData, id)
+	if _, ok := m.ItemData[itemID]; !ok {
+		return ErrConflict
+	}
+	ids := []int{}
+	for _, id := range categoryIDs {
+		if _, ok := m.Categories[id]; !ok {
+			return ErrConflict
+		}
+		ids = append(ids, id)
+	}
+	m.ItemCategoryID[itemID] = ids
 	return nil
 }
 
-func (m *MockInMemDB) DeleteItem(id int) error {
+func (m *MockInMemDB) ItemCategories(itemID int) ([]Category, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	categories := []Category{}
+	seen := make(map[int]bool)
+	for _, id := range m.ItemCategoryID[itemID] {
+		if !seen[id] {
+			seen[id] = true
+			categories = append(categories, m.Categories[id])
+		}
+	}
+	sortCategories(categories)
+	return categories, nil
+}
+
+func (m *MockInMemDB) SetItemTags(itemID int, tags []string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.ItemData, id)
+	if _, ok := m.ItemData[itemID]; !ok {
+		return ErrConflict
+	}
+	m.ItemTagNames[itemID] = normalizeTags(tags)
 	return nil
 }
 
-func (m *MockInMemDB) DeleteOrders(id int) error {
+func (m *MockInMemDB) ItemTags(itemID int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string{}, m.ItemTagNames[itemID]...), nil
+}
+
+func (m *MockInMemDB) CreateVariant(variant ItemVariant) (*ItemVariant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.ItemData[variant.ItemID]; !ok || m.variantTaken(variant) {
+		return nil, ErrConflict
+	}
+	variant.ID = generateUniqueVariantID()
+	variant.Price = withCurrency(variant.Price)
+	m.Variants[variant.ID] = variant
+	m.recordPrice(variant.ItemID, &variant.ID, variant.Price)
+	return &variant, nil
+}
+
+// variantTaken reports whether another variant already uses the SKU or GTIN.
+func (m *MockInMemDB) variantTaken(variant ItemVariant) bool {
+	for _, other := range m.Variants {
+		if other.ID == variant.ID {
+			continue
+		}
+		if other.SKU == variant.SKU || (variant.GTIN != nil && other.GTIN != nil && *other.GTIN == *variant.GTIN) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockInMemDB) FindVariant(id int) (*ItemVariant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if variant, ok := m.Variants[id]; ok {
+		return &variant, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) FindVariantBySKU(sku string) (*ItemVariant, error) {
+	return m.findVariant(func(variant ItemVariant) bool { return variant.SKU == sku })
+}
+
+func (m *MockInMemDB) FindVariantByGTIN(gtin string) (*ItemVariant, error) {
+	return m.findVariant(func(variant ItemVariant) bool { return variant.GTIN != nil && *variant.GTIN == gtin })
+}
+
+func (m *MockInMemDB) findVariant(match func(ItemVariant) bool) (*ItemVariant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, variant := range m.Variants {
+		if match(variant) {
+			return &variant, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) ListItemVariants(itemID int) ([]ItemVariant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	variants := []ItemVariant{}
+	for _, variant := range m.Variants {
+		if variant.ItemID == itemID {
+			variants = append(variants, variant)
+		}
+	}
+	sort.Slice(variants, func(i, j int) bool { return variants[i].ID < variants[j].ID })
+	return variants, nil
+}
+
+func (m *MockInMemDB) UpdateVariant(variant ItemVariant) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.Orders, id)
+	existing, ok := m.Variants[variant.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if m.variantTaken(variant) {
+		return ErrConflict
+	}
+	variant.ItemID = existing.ItemID
+	variant.Price = withCurrency(variant.Price)
+	m.Variants[variant.ID] = variant
+	if variant.Price != existing.Price {
+		m.recordPrice(variant.ItemID, &variant.ID, variant.Price)
+	}
 	return nil
 }
 
-func (m *MockInMemDB) UpdateUser(user User) error {
+func (m *MockInMemDB) DeleteVariant(id int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.UserData[user.ID] = user
+	if _, ok := m.Variants[id]; !ok {
+		return sql.ErrNoRows
+	}
+	for _, order := range m.Orders {
+		for _, line := range order.Lines {
+			if line.VariantID != nil && *line.VariantID == id {
+				return ErrConflict
+			}
+		}
+	}
+	delete(m.Variants, id)
+	history := m.PriceHistory[:0]
+	for _, change := range m.PriceHistory {
+		if change.VariantID == nil || *change.VariantID != id {
+			history = append(history, change)
+		}
+	}
+	m.PriceHistory = history
 	return nil
 }
 
-func (m *MockInMemDB) UpdateItem(item Item) error {
+func (m *MockInMemDB) CreateAddress(address Address) (*Address, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.ItemData[item.ID] = item
+	address.ID = generateUniqueAddressID()
+	address.CreatedAt = time.Now()
+	m.Addresses[address.ID] = address
+	return &address, nil
+}
+
+func (m *MockInMemDB) FindAddress(id int) (*Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if address, ok := m.Addresses[id]; ok {
+		return &address, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) ListAddresses(userID int) ([]Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	addresses := []Address{}
+	for _, address := range m.Addresses {
+		if address.UserID == userID {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].ID < addresses[j].ID })
+	return addresses, nil
+}
+
+func (m *MockInMemDB) UpdateAddress(address Address) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.Addresses[address.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	address.UserID, address.CreatedAt = existing.UserID, existing.CreatedAt
+	m.Addresses[address.ID] = address
 	return nil
 }
 
-func (m *MockInMemDB) UpdateOrders(order Orders) error {
+// DeleteAddress clears the address off orders that used it, like the ON
+// DELETE SET NULL of orders.address_id.
+func (m *MockInMemDB) DeleteAddress(id int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.Orders[order.ID] = order
+	if _, ok := m.Addresses[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.Addresses, id)
+	for orderID, order := range m.Orders {
+		if order.AddressID != nil && *order.AddressID == id {
+			order.AddressID = nil
+			m.Orders[orderID] = order
+		}
+	}
 	return nil
 }
 
-var (
-	userIDCounter  int
-	itemIDCounter  int
-	orderIDCounter int
-	idMutex        sync.Mutex
-)
+func (m *MockInMemDB) CreateItemImage(image ItemImage) (*ItemImage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.ItemData[image.ItemID]; !ok {
+		return nil, ErrConflict
+	}
+	image.ID = generateUniqueImageID()
+	image.CreatedAt = time.Now()
+	m.Images[image.ID] = image
+	return &image, nil
+}
 
-func generateUniqueUserID() int {
-	idMutex.Lock()
-	defer idMutex.Unlock()
-	userIDCounter++
-	return userIDCounter
+func (m *MockInMemDB) FindItemImage(id int) (*ItemImage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if image, ok := m.Images[id]; ok {
+		return &image, nil
+	}
+	return nil, sql.ErrNoRows
 }
 
-func generateUniqueItemID() int {
-	idMutex.Lock()
-	defer idMutex.Unlock()
-	itemIDCounter++
-	return itemIDCounter
+func (m *MockInMemDB) ListItemImages(itemID int) ([]ItemImage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	images := []ItemImage{}
+	for _, image := range m.Images {
+		if image.ItemID == itemID {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
 }
 
-func generateUniqueOrderID() int {
-	idMutex.Lock()
-	defer idMutex.Unlock()
-	orderIDCounter++
-	return orderIDCounter
+func (m *MockInMemDB) DeleteItemImage(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.Images[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.Images, id)
+	return nil
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// countToken counts the tokens that are term. Like websearch_to_tsquery
+// it matches whole words, "tea" doesn't find "teapot", though the mock
+// doesn't stem them.
+func countToken(tokens []string, term string) int {
+	var n int
+	for _, token := range tokens {
+		if token == term {
+			n++
+		}
+	}
+	return n
+}
+
+// highlight HTML escapes text and wraps the words matching terms in
+// <mark></mark>, the way DB.SearchItems does.
+func highlight(text string, terms []string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = html.EscapeString(word)
+		for _, term := range terms {
+			if countToken(tokenize(word), term) > 0 {
+				words[i] = "<mark>" + words[i] + "</mark>"
+				break
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func (m *MockInMemDB) DeleteUser(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.UserData[id]
+	if !ok || user.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	user.DeletedAt = now()
+	m.UserData[id] = user
+	return nil
+}
+
+func (m *MockInMemDB) DeleteItem(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.ItemData[id]
+	if !ok || item.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	item.DeletedAt = now()
+	m.ItemData[id] = item
+	return nil
+}
+
+func (m *MockInMemDB) DeleteOrders(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.Orders[id]
+	if !ok || order.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	order.DeletedAt = now()
+	m.Orders[id] = order
+	return nil
+}
+
+func (m *MockInMemDB) RestoreUser(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.UserData[id]
+	if !ok || user.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	user.DeletedAt = nil
+	m.UserData[id] = user
+	return nil
+}
+
+func (m *MockInMemDB) RestoreItem(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.ItemData[id]
+	if !ok || item.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	item.DeletedAt = nil
+	m.ItemData[id] = item
+	return nil
+}
+
+func (m *MockInMemDB) RestoreOrders(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.Orders[id]
+	if !ok || order.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	order.DeletedAt = nil
+	m.Orders[id] = order
+	return nil
+}
+
+func now() *time.Time {
+	t := time.Now()
+	return &t
+}
+
+// updates keep the archived state, like the UPDATE statements of DB which
+// never touch deleted_at
+
+func (m *MockInMemDB) UpdateUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user.DeletedAt = m.UserData[user.ID].DeletedAt
+	m.UserData[user.ID] = user
+	return nil
+}
+
+func (m *MockInMemDB) UpdateItem(item Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.ItemData[item.ID]
+	if !ok || existing.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	item.Price = withCurrency(item.Price)
+	m.ItemData[item.ID] = item
+	if item.Price != existing.Price {
+		m.recordPrice(item.ID, nil, item.Price)
+	}
+	return nil
+}
+
+func (m *MockInMemDB) UpdateOrderStatus(change OrderStatusChange, notification *Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.setOrderStatus(change, notification)
+}
+
+// setOrderStatus is UpdateOrderStatus for callers holding the write lock.
+func (m *MockInMemDB) setOrderStatus(change OrderStatusChange, notification *Notification) error {
+	order, ok := m.Orders[change.OrderID]
+	if !ok || order.DeletedAt != nil || order.Status != change.From {
+		return sql.ErrNoRows
+	}
+	order.Status = change.To
+	m.Orders[order.ID] = order
+	change.ChangedAt = time.Now()
+	m.StatusHistory = append(m.StatusHistory, change)
+	if notification != nil {
+		notification.OrderID = &change.OrderID
+		m.queueNotification(notification)
+	}
+	return nil
+}
+
+func (m *MockInMemDB) CancelOrder(change OrderStatusChange, notification *Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change.To = StatusCancelled
+	if err := m.setOrderStatus(change, notification); err != nil {
+		return err
+	}
+	for _, line := range m.Orders[change.OrderID].Lines {
+		if line.VariantID != nil {
+			if variant, ok := m.Variants[*line.VariantID]; ok {
+				variant.Stock += line.Qty
+				m.Variants[variant.ID] = variant
+			}
+			continue
+		}
+		if item, ok := m.ItemData[line.ItemID]; ok {
+			item.Stock += line.Qty
+			m.ItemData[item.ID] = item
+		}
+	}
+	for i, redemption := range m.redemptions {
+		if redemption.OrderID == change.OrderID {
+			coupon := m.Coupons[redemption.CouponID]
+			coupon.Redemptions--
+			m.Coupons[coupon.ID] = coupon
+			m.redemptions = append(m.redemptions[:i], m.redemptions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MockInMemDB) OrderStatusHistory(orderID int) ([]OrderStatusChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history := []OrderStatusChange{}
+	for _, change := range m.StatusHistory {
+		if change.OrderID == orderID {
+			history = append(history, change)
+		}
+	}
+	return history, nil
+}
+
+// queueNotification is for callers holding the write lock.
+func (m *MockInMemDB) queueNotification(notification *Notification) {
+	now := time.Now()
+	notification.ID = generateUniqueNotificationID()
+	notification.Status = NotificationPending
+	notification.NextAttemptAt, notification.CreatedAt = now, now
+	m.Notifications[notification.ID] = *notification
+}
+
+func (m *MockInMemDB) ClaimNotifications(limit int, lease time.Duration) ([]Notification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	due := []Notification{}
+	for _, notification := range m.Notifications {
+		if notification.Status == NotificationPending && !notification.NextAttemptAt.After(now) {
+			due = append(due, notification)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].NextAttemptAt = now.Add(lease)
+		m.Notifications[due[i].ID] = due[i]
+	}
+	return due, nil
+}
+
+func (m *MockInMemDB) MarkNotificationSent(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	notification, ok := m.Notifications[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	notification.Status = NotificationSent
+	notification.Attempts++
+	notification.LastError = ""
+	notification.SentAt = &now
+	m.Notifications[id] = notification
+	return nil
+}
+
+func (m *MockInMemDB) MarkNotificationFailed(id int, lastError string, retryAfter time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	notification, ok := m.Notifications[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	notification.Status = NotificationPending
+	if retryAfter <= 0 {
+		notification.Status = NotificationFailed
+	}
+	notification.Attempts++
+	notification.LastError = lastError
+	notification.NextAttemptAt = time.Now().Add(retryAfter)
+	m.Notifications[id] = notification
+	return nil
+}
+
+func (m *MockInMemDB) OrderNotifications(orderID int) ([]Notification, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	notifications := []Notification{}
+	for _, notification := range m.Notifications {
+		if notification.OrderID != nil && *notification.OrderID == orderID {
+			notifications = append(notifications, notification)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].ID < notifications[j].ID })
+	return notifications, nil
+}
+
+// redeemable checks the order's coupon against its limits like
+// redeemCoupon in db.go, for callers holding the write lock.
+func (m *MockInMemDB) redeemable(order Orders) error {
+	coupon, ok := m.Coupons[*order.CouponID]
+	now := time.Now()
+	if !ok || coupon.DeletedAt != nil ||
+		(coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions) ||
+		(coupon.StartsAt != nil && now.Before(*coupon.StartsAt)) ||
+		(coupon.EndsAt != nil && !now.Before(*coupon.EndsAt)) {
+		return &CouponError{Code: order.CouponCode, Reason: "has been used up"}
+	}
+	if coupon.MaxPerCustomer > 0 && m.couponRedemptionsBy(coupon.ID, order.UserId) >= coupon.MaxPerCustomer {
+		return &CouponError{Code: order.CouponCode, Reason: "has already been used the most times it can be"}
+	}
+	return nil
+}
+
+func (m *MockInMemDB) couponRedemptionsBy(couponID, userID int) int {
+	used := 0
+	for _, redemption := range m.redemptions {
+		if redemption.CouponID == couponID && redemption.UserID == userID {
+			used++
+		}
+	}
+	return used
+}
+
+func (m *MockInMemDB) CreateCoupon(coupon Coupon) (*Coupon, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.Coupons {
+		if other.Code == coupon.Code {
+			return nil, ErrConflict
+		}
+	}
+	coupon.ID = generateUniqueCouponID()
+	coupon.Redemptions = 0
+	coupon.CreatedAt = time.Now()
+	m.Coupons[coupon.ID] = coupon
+	return &coupon, nil
+}
+
+func (m *MockInMemDB) FindCoupon(id int) (*Coupon, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if coupon, ok := m.Coupons[id]; ok {
+		return &coupon, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) FindCouponByCode(code string) (*Coupon, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, coupon := range m.Coupons {
+		if coupon.Code == code && coupon.DeletedAt == nil {
+			return &coupon, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) ListCoupons() ([]Coupon, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	coupons := []Coupon{}
+	for _, coupon := range m.Coupons {
+		if coupon.DeletedAt == nil {
+			coupons = append(coupons, coupon)
+		}
+	}
+	sort.Slice(coupons, func(i, j int) bool { return coupons[i].ID > coupons[j].ID })
+	return coupons, nil
+}
+
+func (m *MockInMemDB) UpdateCoupon(coupon Coupon) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.Coupons[coupon.ID]
+	if !ok || existing.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	coupon.Code, coupon.Redemptions = existing.Code, existing.Redemptions
+	coupon.CreatedAt = existing.CreatedAt
+	m.Coupons[coupon.ID] = coupon
+	return nil
+}
+
+func (m *MockInMemDB) DeleteCoupon(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coupon, ok := m.Coupons[id]
+	if !ok || coupon.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	coupon.DeletedAt = &now
+	m.Coupons[id] = coupon
+	return nil
+}
+
+func (m *MockInMemDB) CouponRedemptionsByUser(couponID, userID int) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.couponRedemptionsBy(couponID, userID), nil
+}
+
+// copyDeliveryZone keeps callers from writing to the stored zone's
+// polygon and fees.
+func copyDeliveryZone(zone DeliveryZone) *DeliveryZone {
+	if zone.Polygon != nil {
+		zone.Polygon = append([]LatLng{}, zone.Polygon...)
+	}
+	if zone.Center != nil {
+		center := *zone.Center
+		zone.Center = &center
+	}
+	zone.Fees = append([]DeliveryFee{}, zone.Fees...)
+	return &zone
+}
+
+func (m *MockInMemDB) CreateDeliveryZone(zone DeliveryZone) (*DeliveryZone, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zone.ID = generateUniqueDeliveryZoneID()
+	zone.CreatedAt = time.Now()
+	zone.DeletedAt = nil
+	m.DeliveryZones[zone.ID] = *copyDeliveryZone(zone)
+	return copyDeliveryZone(zone), nil
+}
+
+func (m *MockInMemDB) FindDeliveryZone(id int) (*DeliveryZone, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if zone, ok := m.DeliveryZones[id]; ok {
+		return copyDeliveryZone(zone), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) ListDeliveryZones() ([]DeliveryZone, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	zones := []DeliveryZone{}
+	for _, zone := range m.DeliveryZones {
+		if zone.DeletedAt == nil {
+			zones = append(zones, *copyDeliveryZone(zone))
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if zones[i].Name != zones[j].Name {
+			return zones[i].Name < zones[j].Name
+		}
+		return zones[i].ID < zones[j].ID
+	})
+	return zones, nil
+}
+
+func (m *MockInMemDB) UpdateDeliveryZone(zone DeliveryZone) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.DeliveryZones[zone.ID]
+	if !ok || existing.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	zone.CreatedAt, zone.DeletedAt = existing.CreatedAt, nil
+	m.DeliveryZones[zone.ID] = *copyDeliveryZone(zone)
+	return nil
+}
+
+func (m *MockInMemDB) DeleteDeliveryZone(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zone, ok := m.DeliveryZones[id]
+	if !ok || zone.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	zone.DeletedAt = &now
+	m.DeliveryZones[id] = zone
+	return nil
+}
+
+func (m *MockInMemDB) FindCart(userID int) (*Cart, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cart, ok := m.Carts[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	cart.Lines = append([]CartLine{}, cart.Lines...)
+	return &cart, nil
+}
+
+// touchCart is for callers holding the write lock, it returns the cart to
+// change.
+func (m *MockInMemDB) touchCart(userID int) Cart {
+	cart := m.Carts[userID]
+	cart.UpdatedAt = time.Now()
+	cart.Lines = append([]CartLine{}, cart.Lines...)
+	return cart
+}
+
+func (m *MockInMemDB) AddCartLine(userID int, line CartLine) (*CartLine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.ItemData[line.ItemID]; !ok {
+		return nil, ErrConflict
+	}
+	cart := m.touchCart(userID)
+	defer func() { m.Carts[userID] = cart }()
+	for i, existing := range cart.Lines {
+		if existing.ItemID == line.ItemID && variantID(existing.VariantID) == variantID(line.VariantID) {
+			cart.Lines[i].Qty += line.Qty
+			added := cart.Lines[i]
+			return &added, nil
+		}
+	}
+	line.ID = generateUniqueCartLineID()
+	line.AddedAt = time.Now()
+	cart.Lines = append(cart.Lines, line)
+	return &line, nil
+}
+
+func variantID(id *int) int {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
+
+func (m *MockInMemDB) UpdateCartLine(userID int, line CartLine) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cart := m.touchCart(userID)
+	for i, existing := range cart.Lines {
+		if existing.ID == line.ID {
+			cart.Lines[i].Qty = line.Qty
+			m.Carts[userID] = cart
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MockInMemDB) RemoveCartLine(userID, lineID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cart := m.touchCart(userID)
+	for i, existing := range cart.Lines {
+		if existing.ID == lineID {
+			cart.Lines = append(cart.Lines[:i], cart.Lines[i+1:]...)
+			m.Carts[userID] = cart
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MockInMemDB) ClearCart(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.Carts, userID)
+	return nil
+}
+
+func (m *MockInMemDB) DeleteCartsBefore(cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for userID, cart := range m.Carts {
+		if cart.UpdatedAt.Before(cutoff) {
+			delete(m.Carts, userID)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// CheckoutCart checks the lines are in the cart as they were before ordering
+// anything, so a changed cart leaves stock and the cart alone.
+func (m *MockInMemDB) CheckoutCart(userID int, lines []CartLine, order Orders, notify func(order *Orders) *Notification) (*Orders, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cart := m.touchCart(userID)
+	for _, line := range lines {
+		i := cartLineIndex(cart.Lines, line.ID)
+		if i < 0 || cart.Lines[i].Qty != line.Qty {
+			return nil, ErrCartChanged
+		}
+		cart.Lines = append(cart.Lines[:i], cart.Lines[i+1:]...)
+	}
+	created, err := m.createOrder(order, notify)
+	if err != nil {
+		return nil, err
+	}
+	m.Carts[userID] = cart
+	return created, nil
+}
+
+func cartLineIndex(lines []CartLine, id int) int {
+	for i, line := range lines {
+		if line.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// UpdateOrders only updates the header, like DB.UpdateOrders.
+func (m *MockInMemDB) UpdateOrders(order Orders) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.Orders[order.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	existing.UserId = order.UserId
+	existing.Time = order.Time
+	m.Orders[order.ID] = existing
+	return nil
+}
+
+var (
+	userIDCounter         int
+	itemIDCounter         int
+	orderIDCounter        int
+	orderLineCounter      int
+	categoryIDCounter     int
+	variantIDCounter      int
+	imageIDCounter        int
+	addressIDCounter      int
+	notificationIDCounter int
+	couponIDCounter       int
+	cartLineIDCounter     int
+	paymentIDCounter      int
+	refundIDCounter       int
+	deliveryZoneIDCounter int
+	idMutex               sync.Mutex
+)
+
+func generateUniqueUserID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	userIDCounter++
+	return userIDCounter
+}
+
+func generateUniqueItemID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	itemIDCounter++
+	return itemIDCounter
+}
+
+func generateUniqueOrderID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	orderIDCounter++
+	return orderIDCounter
+}
+
+func generateUniqueOrderLineID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	orderLineCounter++
+	return orderLineCounter
+}
+
+func generateUniqueCategoryID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	categoryIDCounter++
+	return categoryIDCounter
+}
+
+func generateUniqueVariantID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	variantIDCounter++
+	return variantIDCounter
+}
+
+func generateUniqueImageID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	imageIDCounter++
+	return imageIDCounter
+}
+
+func generateUniqueAddressID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	addressIDCounter++
+	return addressIDCounter
+}
+
+func generateUniqueNotificationID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	notificationIDCounter++
+	return notificationIDCounter
+}
+
+func generateUniqueCouponID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	couponIDCounter++
+	return couponIDCounter
+}
+
+func generateUniqueCartLineID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	cartLineIDCounter++
+	return cartLineIDCounter
+}
+
+func generateUniquePaymentID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	paymentIDCounter++
+	return paymentIDCounter
+}
+
+func generateUniqueRefundID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	refundIDCounter++
+	return refundIDCounter
+}
+
+func (m *MockInMemDB) CreatePayment(payment Payment) (*Payment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order, ok := m.Orders[payment.OrderID]
+	if !ok || order.DeletedAt != nil || order.PaymentStatus == PaymentPaid {
+		return nil, sql.ErrNoRows
+	}
+	for _, existing := range m.Payments {
+		if existing.OrderID == payment.OrderID && existing.Status == PaymentPending {
+			return nil, ErrConflict
+		}
+	}
+	now := time.Now()
+	payment.ID = generateUniquePaymentID()
+	payment.Status = PaymentPending
+	payment.CreatedAt, payment.UpdatedAt = now, now
+	m.Payments[payment.ID] = payment
+	order.PaymentStatus = PaymentPending
+	m.Orders[order.ID] = order
+	return &payment, nil
+}
+
+func (m *MockInMemDB) SetPaymentReference(id int, reference string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payment, ok := m.Payments[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	payment.Reference, payment.UpdatedAt = reference, time.Now()
+	m.Payments[id] = payment
+	return nil
+}
+
+func (m *MockInMemDB) SettlePayment(id int, status PaymentStatus, receipt, reason string, notification *Notification) (*Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payment, ok := m.Payments[id]
+	if !ok || !(payment.Status == PaymentPending || payment.Status == PaymentFailed && status == PaymentPaid) {
+		return nil, sql.ErrNoRows
+	}
+	payment.Status, payment.Receipt, payment.FailureReason, payment.UpdatedAt = status, receipt, reason, time.Now()
+	m.Payments[id] = payment
+
+	order := m.Orders[payment.OrderID]
+	var refund *Refund
+	if reason := surplusReason(order.Status, order.PaymentStatus); status == PaymentPaid && reason != "" {
+		refund = surplusRefund(payment, reason)
+		now := time.Now()
+		refund.ID = generateUniqueRefundID()
+		refund.Status = RefundPending
+		refund.CreatedAt, refund.UpdatedAt = now, now
+		m.Refunds[refund.ID] = *refund
+	} else if status == PaymentPaid || order.PaymentStatus == PaymentPending && !m.paymentPending(order.ID) {
+		order.PaymentStatus = status
+		m.Orders[order.ID] = order
+	}
+	if notification != nil {
+		notification.OrderID = &payment.OrderID
+		m.queueNotification(notification)
+	}
+	return refund, nil
+}
+
+// paymentPending is for callers holding the lock.
+func (m *MockInMemDB) paymentPending(orderID int) bool {
+	for _, payment := range m.Payments {
+		if payment.OrderID == orderID && payment.Status == PaymentPending {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockInMemDB) FindPaymentByReference(provider, reference string) (*Payment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, payment := range m.Payments {
+		if payment.Provider == provider && payment.Reference == reference && reference != "" {
+			return &payment, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) OrderPayments(orderID int) ([]Payment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	payments := []Payment{}
+	for _, payment := range m.Payments {
+		if payment.OrderID == orderID {
+			payments = append(payments, payment)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		if !payments[i].CreatedAt.Equal(payments[j].CreatedAt) {
+			return payments[i].CreatedAt.After(payments[j].CreatedAt)
+		}
+		return payments[i].ID > payments[j].ID
+	})
+	return payments, nil
+}
+
+func (m *MockInMemDB) CreateRefund(refund Refund) (*Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payment, ok := m.Payments[refund.PaymentID]
+	if !ok || payment.Status != PaymentPaid {
+		return nil, sql.ErrNoRows
+	}
+	if refund.Amount.Currency != payment.Amount.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+	refunded := int64(0)
+	for _, existing := range m.Refunds {
+		if existing.PaymentID == payment.ID && existing.Status != RefundFailed {
+			refunded += existing.Amount.Amount
+		}
+	}
+	if refunded+refund.Amount.Amount > payment.Amount.Amount {
+		return nil, ErrRefundTooLarge
+	}
+	now := time.Now()
+	refund.ID = generateUniqueRefundID()
+	refund.Status = RefundPending
+	refund.CreatedAt, refund.UpdatedAt = now, now
+	m.Refunds[refund.ID] = refund
+	return &refund, nil
+}
+
+func (m *MockInMemDB) SetRefundReference(id int, reference string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	refund, ok := m.Refunds[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	refund.Reference, refund.UpdatedAt = reference, time.Now()
+	m.Refunds[id] = refund
+	return nil
+}
+
+func (m *MockInMemDB) SettleRefund(id int, status RefundStatus, receipt, reason string, notification *Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	refund, ok := m.Refunds[id]
+	if !ok || refund.Status != RefundPending {
+		return sql.ErrNoRows
+	}
+	refund.Status, refund.Receipt, refund.FailureReason, refund.UpdatedAt = status, receipt, reason, time.Now()
+	m.Refunds[id] = refund
+	if notification != nil {
+		notification.OrderID = &refund.OrderID
+		m.queueNotification(notification)
+	}
+	return nil
+}
+
+func (m *MockInMemDB) FindRefundByReference(provider, reference string) (*Refund, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, refund := range m.Refunds {
+		if refund.Provider == provider && refund.Reference == reference && reference != "" {
+			return &refund, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockInMemDB) OrderRefunds(orderID int) ([]Refund, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	refunds := []Refund{}
+	for _, refund := range m.Refunds {
+		if refund.OrderID == orderID {
+			refunds = append(refunds, refund)
+		}
+	}
+	sort.Slice(refunds, func(i, j int) bool {
+		if !refunds[i].CreatedAt.Equal(refunds[j].CreatedAt) {
+			return refunds[i].CreatedAt.After(refunds[j].CreatedAt)
+		}
+		return refunds[i].ID > refunds[j].ID
+	})
+	return refunds, nil
+}
+
+func generateUniqueDeliveryZoneID() int {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	deliveryZoneIDCounter++
+	return deliveryZoneIDCounter
 }
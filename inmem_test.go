@@ -1,11 +1,14 @@
 package savannah
 
 import (
+	"database/sql"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var db database
@@ -89,7 +92,7 @@ func TestMockInMemDB_DeleteUser(t *testing.T) {
 }
 func TestMockInMemDB_CreateItem(t *testing.T) {
 	item := Item{
-		Price:       29.99,
+		Price:       NewMoney(2999, "KES"),
 		Name:        "Sample Item",
 		Description: "A sample description",
 	}
@@ -102,7 +105,7 @@ func TestMockInMemDB_CreateItem(t *testing.T) {
 
 func TestMockInMemDB_FindItem(t *testing.T) {
 	item := Item{
-		Price:       29.99,
+		Price:       NewMoney(2999, "KES"),
 		Name:        "Sample Item",
 		Description: "A sample description",
 	}
@@ -119,7 +122,7 @@ func TestMockInMemDB_FindItem(t *testing.T) {
 
 func TestMockInMemDB_UpdateItem(t *testing.T) {
 	item := Item{
-		Price:       29.99,
+		Price:       NewMoney(2999, "KES"),
 		Name:        "Sample Item",
 		Description: "A sample description",
 	}
@@ -130,7 +133,7 @@ func TestMockInMemDB_UpdateItem(t *testing.T) {
 
 	updatedItem := Item{
 		ID:          createdItem.ID,
-		Price:       39.99,
+		Price:       NewMoney(3999, "KES"),
 		Name:        "Updated Item",
 		Description: "An updated description",
 	}
@@ -146,7 +149,7 @@ func TestMockInMemDB_UpdateItem(t *testing.T) {
 
 func TestMockInMemDB_DeleteItem(t *testing.T) {
 	item := Item{
-		Price:       29.99,
+		Price:       NewMoney(2999, "KES"),
 		Name:        "Sample Item",
 		Description: "A sample description",
 	}
@@ -161,28 +164,213 @@ func TestMockInMemDB_DeleteItem(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestMockInMemDB_ArchiveAndRestoreItem(t *testing.T) {
+	item := createStockedItem(t, 5)
+	_, err := db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	// priced while the item is still on sale
+	late := priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()})
+
+	// items with orders can be archived, the orders keep pointing at them
+	assert.NoError(t, db.DeleteItem(item.ID))
+	assert.Equal(t, sql.ErrNoRows, db.DeleteItem(item.ID))
+
+	archived, err := db.FindItemIncludingArchived(item.ID)
+	assert.NoError(t, err)
+	assert.NotNil(t, archived.DeletedAt)
+
+	page, err := db.ListItems(ItemFilter{Limit: 100})
+	assert.NoError(t, err)
+	for _, listed := range page.Items {
+		assert.NotEqual(t, item.ID, listed.ID)
+	}
+	page, err = db.ListItems(ItemFilter{Limit: 100, IncludeArchived: true})
+	assert.NoError(t, err)
+	var listed bool
+	for _, i := range page.Items {
+		listed = listed || i.ID == item.ID
+	}
+	assert.True(t, listed)
+
+	_, err = db.CreateOrders(late, nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, db.RestoreItem(item.ID))
+	assert.Equal(t, sql.ErrNoRows, db.RestoreItem(item.ID))
+	restored, err := db.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+}
+
+func createStockedItem(t *testing.T, stock int) *Item {
+	item, err := db.CreateItem(Item{
+		Price:       NewMoney(2999, "KES"),
+		Name:        "Stocked Item",
+		Description: "A sample description",
+		Stock:       stock,
+	})
+	assert.NoError(t, err)
+	return item
+}
+
 func TestMockInMemDB_CreateOrders(t *testing.T) {
 	order := Orders{
 		UserId: 1,
-		ItemID: 2,
-		Qty:    3,
+		Lines:  []OrderLine{{ItemID: createStockedItem(t, 10).ID, Qty: 3}},
 		Time:   time.Now(),
 	}
-	createdOrder, err := db.CreateOrders(order)
+	createdOrder, err := db.CreateOrders(priced(t, db, order), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, createdOrder)
 	assert.NotZero(t, createdOrder.ID)
 }
 
+func TestMockInMemDB_CreateOrders_Contact(t *testing.T) {
+	order := Orders{
+		UserId:  1,
+		Contact: "+254700000000",
+		Lines:   []OrderLine{{ItemID: createStockedItem(t, 10).ID, Qty: 1}},
+		Time:    time.Now(),
+	}
+	createdOrder, err := db.CreateOrders(priced(t, db, order), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "+254700000000", createdOrder.Contact)
+
+	found, err := db.FindOrders(createdOrder.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "+254700000000", found.Contact)
+}
+
+func TestMockInMemDB_CreateOrders_PriceSnapshot(t *testing.T) {
+	item := createStockedItem(t, 10)
+	order, err := db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 3}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(2999, "KES"), order.Lines[0].UnitPrice)
+	assert.Equal(t, NewMoney(8997, "KES"), order.Lines[0].LineTotal)
+
+	item.Price = NewMoney(4999, "KES")
+	assert.NoError(t, db.UpdateItem(*item))
+	found, err := db.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(8997, "KES"), found.Lines[0].LineTotal)
+	assert.Equal(t, NewMoney(8997, "KES"), found.Total)
+}
+
+func TestMockInMemDB_CreateOrders_SubtotalMismatch(t *testing.T) {
+	item := createStockedItem(t, 10)
+	order := priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 3}}, Time: time.Now()})
+
+	// line totals are worked out again from the unit price
+	tampered := order
+	tampered.Lines = []OrderLine{order.Lines[0]}
+	tampered.Lines[0].LineTotal = NewMoney(1, "KES")
+	tampered.Breakdown.Subtotal = NewMoney(1, "KES")
+	_, err := db.CreateOrders(tampered, nil)
+	assert.Equal(t, ErrSubtotalMismatch, err)
+
+	order.Breakdown.Subtotal = order.Breakdown.Subtotal.Add(NewMoney(100, "KES"))
+	_, err = db.CreateOrders(order, nil)
+	assert.Equal(t, ErrSubtotalMismatch, err)
+	found, err := db.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, found.Stock)
+}
+
+func TestMockInMemDB_CreateOrders_MultipleLines(t *testing.T) {
+	tea, coffee := createStockedItem(t, 5), createStockedItem(t, 1)
+	order, err := db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{
+		{ItemID: tea.ID, Qty: 2},
+		{ItemID: coffee.ID, Qty: 1},
+	}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	assert.Len(t, order.Lines, 2)
+	assert.Equal(t, NewMoney(3*2999, "KES"), order.Total)
+
+	// the basket is all or nothing, tea stays at 3 when coffee runs out
+	_, err = db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{
+		{ItemID: tea.ID, Qty: 1},
+		{ItemID: coffee.ID, Qty: 1},
+	}, Time: time.Now()}), nil)
+	var outOfStock *OutOfStockError
+	assert.ErrorAs(t, err, &outOfStock)
+	assert.Equal(t, coffee.ID, outOfStock.ItemID)
+	found, err := db.FindItem(tea.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, found.Stock)
+
+	// lines for the same item draw on the same stock
+	_, err = db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{
+		{ItemID: tea.ID, Qty: 2},
+		{ItemID: tea.ID, Qty: 2},
+	}, Time: time.Now()}), nil)
+	assert.ErrorAs(t, err, &outOfStock)
+}
+
+func TestMockInMemDB_ItemPriceHistory(t *testing.T) {
+	item := createStockedItem(t, 10)
+	variant, err := db.CreateVariant(ItemVariant{ItemID: item.ID, SKU: "HIST-1", Name: "Small", Price: NewMoney(1999, "KES")})
+	assert.NoError(t, err)
+
+	item.Price = NewMoney(3499, "KES")
+	assert.NoError(t, db.UpdateItem(*item))
+	// only price changes are recorded
+	item.Name = "Renamed"
+	assert.NoError(t, db.UpdateItem(*item))
+
+	history, err := db.ItemPriceHistory(item.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, NewMoney(2999, "KES"), history[0].Price)
+		assert.Nil(t, history[0].VariantID)
+		assert.Equal(t, variant.ID, *history[1].VariantID)
+		assert.Equal(t, NewMoney(3499, "KES"), history[2].Price)
+	}
+}
+
+func TestMockInMemDB_CreateOrders_OutOfStock(t *testing.T) {
+	item := createStockedItem(t, 2)
+
+	_, err := db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 3}}, Time: time.Now()}), nil)
+	var outOfStock *OutOfStockError
+	assert.ErrorAs(t, err, &outOfStock)
+	assert.Equal(t, 2, outOfStock.Available)
+
+	_, err = db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 2}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	found, err := db.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, found.Stock)
+}
+
+func TestMockInMemDB_CreateOrders_Concurrent(t *testing.T) {
+	item := createStockedItem(t, 5)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var created int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.CreateOrders(priced(t, db, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}), nil); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 5, created)
+}
+
 func TestMockInMemDB_FindOrders(t *testing.T) {
 	order := Orders{
 		UserId: 1,
-		ItemID: 2,
-		Qty:    3,
+		Lines:  []OrderLine{{ItemID: createStockedItem(t, 10).ID, Qty: 3}},
 		Time:   time.Now(),
 	}
 
-	createdOrder, err := db.CreateOrders(order)
+	createdOrder, err := db.CreateOrders(priced(t, db, order), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, createdOrder)
 
@@ -195,20 +383,17 @@ func TestMockInMemDB_FindOrders(t *testing.T) {
 func TestMockInMemDB_UpdateOrders(t *testing.T) {
 	order := Orders{
 		UserId: 1,
-		ItemID: 2,
-		Qty:    3,
+		Lines:  []OrderLine{{ItemID: createStockedItem(t, 10).ID, Qty: 3}},
 		Time:   time.Now(),
 	}
 
-	createdOrder, err := db.CreateOrders(order)
+	createdOrder, err := db.CreateOrders(priced(t, db, order), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, createdOrder)
 
 	updatedOrder := Orders{
 		ID:     createdOrder.ID,
-		UserId: 1,
-		ItemID: 2,
-		Qty:    5,
+		UserId: 2,
 		Time:   time.Now(),
 	}
 	err = db.UpdateOrders(updatedOrder)
@@ -217,18 +402,21 @@ func TestMockInMemDB_UpdateOrders(t *testing.T) {
 	foundOrder, err := db.FindOrders(updatedOrder.ID)
 	assert.NoError(t, err)
 	assert.NotNil(t, foundOrder)
-	assert.Equal(t, updatedOrder.Qty, foundOrder.Qty)
+	assert.Equal(t, updatedOrder.UserId, foundOrder.UserId)
+	// lines can't be changed once ordered
+	assert.Equal(t, createdOrder.Lines, foundOrder.Lines)
+
+	assert.Equal(t, sql.ErrNoRows, db.UpdateOrders(Orders{ID: -1, UserId: 2, Time: time.Now()}))
 }
 
 func TestMockInMemDB_DeleteOrders(t *testing.T) {
 	order := Orders{
 		UserId: 1,
-		ItemID: 2,
-		Qty:    3,
+		Lines:  []OrderLine{{ItemID: createStockedItem(t, 10).ID, Qty: 3}},
 		Time:   time.Now(),
 	}
 
-	createdOrder, err := db.CreateOrders(order)
+	createdOrder, err := db.CreateOrders(priced(t, db, order), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, createdOrder)
 
@@ -237,3 +425,215 @@ func TestMockInMemDB_DeleteOrders(t *testing.T) {
 	_, err = db.FindOrders(createdOrder.ID)
 	assert.Error(t, err)
 }
+
+func TestMockInMemDB_ListOrdersByUser(t *testing.T) {
+	store := NewMockStore()
+	item, err := store.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 10})
+	assert.NoError(t, err)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var ids []int
+	for i := 0; i < 4; i++ {
+		order, err := store.CreateOrders(priced(t, store, Orders{UserId: 7, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: start.AddDate(0, 0, i)}), nil)
+		assert.NoError(t, err)
+		ids = append(ids, order.ID)
+	}
+	_, err = store.CreateOrders(priced(t, store, Orders{UserId: 8, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: start}), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, store.UpdateOrderStatus(OrderStatusChange{OrderID: ids[1], From: StatusPending, To: StatusConfirmed}, nil))
+
+	page, err := store.ListOrdersByUser(7, OrderFilter{Limit: 3})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Orders, 3) {
+		assert.Equal(t, ids[3], page.Orders[0].ID)
+		assert.Len(t, page.Orders[0].Lines, 1)
+	}
+	page, err = store.ListOrdersByUser(7, OrderFilter{Limit: 3, Cursor: page.NextCursor})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Orders, 1) {
+		assert.Equal(t, ids[0], page.Orders[0].ID)
+	}
+	assert.Empty(t, page.NextCursor)
+
+	page, err = store.ListOrdersByUser(7, OrderFilter{Status: StatusConfirmed})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Orders, 1) {
+		assert.Equal(t, ids[1], page.Orders[0].ID)
+	}
+
+	from, to := start.AddDate(0, 0, 1), start.AddDate(0, 0, 3)
+	page, err = store.ListOrdersByUser(7, OrderFilter{From: &from, To: &to})
+	assert.NoError(t, err)
+	assert.Len(t, page.Orders, 2)
+
+	_, err = store.ListOrdersByUser(7, OrderFilter{Cursor: "not a cursor"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestMockInMemDB_ListItems(t *testing.T) {
+	store := NewMockStore()
+	for _, item := range []Item{
+		{Price: NewMoney(10, "KES"), Name: "Green Tea", Description: "Loose leaf"},
+		{Price: NewMoney(30, "KES"), Name: "Black Tea", Description: "Kenyan blend"},
+		{Price: NewMoney(20, "KES"), Name: "Coffee", Description: "Arabica beans"},
+		{Price: NewMoney(40, "KES"), Name: "Tea Pot", Description: "Ceramic"},
+	} {
+		_, err := store.CreateItem(item)
+		assert.NoError(t, err)
+	}
+
+	page, err := store.ListItems(ItemFilter{Name: "tea", Sort: "-price", Limit: 2})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 2)
+	assert.Equal(t, "Tea Pot", page.Items[0].Name)
+	assert.Equal(t, "Black Tea", page.Items[1].Name)
+	assert.NotEmpty(t, page.NextCursor)
+
+	page, err = store.ListItems(ItemFilter{Name: "tea", Sort: "-price", Limit: 2, Cursor: page.NextCursor})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, "Green Tea", page.Items[0].Name)
+	assert.Empty(t, page.NextCursor)
+
+	min, max := int64(15), int64(35)
+	page, err = store.ListItems(ItemFilter{MinPrice: &min, MaxPrice: &max, Sort: "price"})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 2)
+	assert.Equal(t, "Coffee", page.Items[0].Name)
+
+	_, err = store.ListItems(ItemFilter{Sort: "colour"})
+	assert.Equal(t, ErrInvalidSort, err)
+	_, err = store.ListItems(ItemFilter{Cursor: "not a cursor"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestMockInMemDB_SearchItems(t *testing.T) {
+	store := NewMockStore()
+	for _, item := range []Item{
+		{Price: NewMoney(10, "KES"), Name: "Green Tea", Description: "Loose leaf from Kericho"},
+		{Price: NewMoney(20, "KES"), Name: "Coffee", Description: "Arabica beans, pairs well with tea cake"},
+		{Price: NewMoney(40, "KES"), Name: "Milk", Description: "Fresh"},
+		{Price: NewMoney(50, "KES"), Name: "Teapot", Description: "<b>Kericho</b> clay"},
+	} {
+		_, err := store.CreateItem(item)
+		assert.NoError(t, err)
+	}
+
+	results, err := store.SearchItems("tea", 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, "Green Tea", results[0].Name)
+	assert.Greater(t, results[0].Rank, results[1].Rank)
+	assert.Contains(t, results[0].Snippet, "<mark>Tea</mark>")
+
+	results, err = store.SearchItems("tea kericho", 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	// matches whole words, escaping the item text around them
+	results, err = store.SearchItems("kericho clay", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "Teapot <mark>&lt;b&gt;Kericho&lt;/b&gt;</mark> <mark>clay</mark>", results[0].Snippet)
+	}
+
+	results, err = store.SearchItems("tea", 1)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+func TestMockInMemDB_Categories(t *testing.T) {
+	store := NewMockStore()
+	drinks, err := store.CreateCategory(Category{Name: "Drinks"})
+	assert.NoError(t, err)
+	tea, err := store.CreateCategory(Category{Name: "Tea", ParentID: &drinks.ID})
+	assert.NoError(t, err)
+	_, err = store.CreateCategory(Category{Name: "Orphan", ParentID: new(int)})
+	assert.ErrorIs(t, err, ErrConflict)
+
+	greenTea, err := store.CreateItem(Item{Price: NewMoney(10, "KES"), Name: "Green Tea", Description: "Loose leaf"})
+	assert.NoError(t, err)
+	juice, err := store.CreateItem(Item{Price: NewMoney(20, "KES"), Name: "Juice", Description: "Mango"})
+	assert.NoError(t, err)
+	_, err = store.CreateItem(Item{Price: NewMoney(30, "KES"), Name: "Bread", Description: "Brown"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.SetItemCategories(greenTea.ID, []int{tea.ID}))
+	assert.NoError(t, store.SetItemCategories(juice.ID, []int{drinks.ID}))
+	assert.ErrorIs(t, store.SetItemCategories(juice.ID, []int{0}), ErrConflict)
+
+	page, err := store.ListItems(ItemFilter{CategoryID: drinks.ID})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 2)
+
+	page, err = store.ListItems(ItemFilter{CategoryID: tea.ID})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, greenTea.ID, page.Items[0].ID)
+
+	categories, err := store.ItemCategories(greenTea.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Category{*tea}, categories)
+
+	categories, err = store.ListCategories()
+	assert.NoError(t, err)
+	assert.Len(t, categories, 2)
+}
+
+func TestMockInMemDB_Tags(t *testing.T) {
+	store := NewMockStore()
+	item, err := store.CreateItem(Item{Price: NewMoney(10, "KES"), Name: "Green Tea", Description: "Loose leaf"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.SetItemTags(item.ID, []string{"Organic ", "organic", "  fair   trade", ""}))
+	tags, err := store.ItemTags(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fair trade", "organic"}, tags)
+
+	page, err := store.ListItems(ItemFilter{Tag: "ORGANIC"})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 1)
+
+	assert.ErrorIs(t, store.SetItemTags(0, []string{"organic"}), ErrConflict)
+}
+
+func TestMockInMemDB_Variants(t *testing.T) {
+	store := NewMockStore()
+	item, err := store.CreateItem(Item{Price: NewMoney(500, "KES"), Name: "Milk", Description: "Fresh"})
+	assert.NoError(t, err)
+
+	gtin := "04006381333931"
+	small, err := store.CreateVariant(ItemVariant{ItemID: item.ID, SKU: "MILK-500", GTIN: &gtin, Name: "500ml", Price: NewMoney(600, "KES"), Stock: 2})
+	assert.NoError(t, err)
+	_, err = store.CreateVariant(ItemVariant{ItemID: item.ID, SKU: "MILK-500", Name: "Duplicate", Price: NewMoney(600, "KES")})
+	assert.ErrorIs(t, err, ErrConflict)
+
+	found, err := store.FindVariantBySKU("MILK-500")
+	assert.NoError(t, err)
+	assert.Equal(t, small.ID, found.ID)
+	found, err = store.FindVariantByGTIN(gtin)
+	assert.NoError(t, err)
+	assert.Equal(t, small.ID, found.ID)
+
+	_, err = store.CreateOrders(priced(t, store, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, VariantID: &small.ID, Qty: 3}}, Time: time.Now()}), nil)
+	var outOfStock *OutOfStockError
+	assert.ErrorAs(t, err, &outOfStock)
+	assert.Equal(t, small.ID, outOfStock.VariantID)
+
+	_, err = store.CreateOrders(priced(t, store, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, VariantID: &small.ID, Qty: 2}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	found, err = store.FindVariant(small.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, found.Stock)
+
+	variants, err := store.ListItemVariants(item.ID)
+	assert.NoError(t, err)
+	assert.Len(t, variants, 1)
+	assert.ErrorIs(t, store.DeleteVariant(small.ID), ErrConflict)
+}
+
+// priced prices the order the way Service.PriceOrder does before it is
+// created.
+func priced(t *testing.T, store database, order Orders) Orders {
+	t.Helper()
+	require.NoError(t, Service{service: store}.PriceOrder(&order))
+	return order
+}
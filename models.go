@@ -9,34 +9,295 @@ type (
 		ID    int    `json:"id"`
 		Code  string `json:"code"`
 		Email string `json:"email" validate:"required"`
+		// DeletedAt is set once the record is archived
+		DeletedAt *time.Time `json:"deleted_at,omitempty"`
 	}
 	Item struct {
-		ID          int     `json:"id"`
-		Price       float32 `json:"price" validate:"required"`
-		Name        string  `json:"name" validate:"required"`
-		Description string  `json:"description" validate:"required"`
+		ID          int        `json:"id"`
+		Price       Money      `json:"price" validate:"gt=0"`
+		Name        string     `json:"name" validate:"required"`
+		Description string     `json:"description" validate:"required"`
+		Stock       int        `json:"stock" validate:"gte=0"`
+		DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+		// filled in by getItem, they are managed through their own routes
+		Categories []Category  `json:"categories,omitempty"`
+		Tags       []string    `json:"tags,omitempty"`
+		Images     []ItemImage `json:"images,omitempty"`
 	}
+	// ItemImage is an uploaded picture of an item. The blobs live in the
+	// BlobStore under Key and ThumbnailKey; clients get their URLs.
+	ItemImage struct {
+		ID           int       `json:"id"`
+		ItemID       int       `json:"item_id"`
+		Key          string    `json:"-"`
+		ThumbnailKey string    `json:"-"`
+		ContentType  string    `json:"content_type"`
+		Width        int       `json:"width"`
+		Height       int       `json:"height"`
+		Size         int64     `json:"size"`
+		CreatedAt    time.Time `json:"created_at"`
+		URL          string    `json:"url"`
+		ThumbnailURL string    `json:"thumbnail_url"`
+	}
+	// ItemVariant is a sellable size or packaging of an item with its own
+	// price and stock. GTIN holds the barcode zero padded to 14 digits.
+	ItemVariant struct {
+		ID     int     `json:"id"`
+		ItemID int     `json:"item_id"`
+		SKU    string  `json:"sku" validate:"required,max=64"`
+		GTIN   *string `json:"gtin,omitempty" validate:"omitempty,gtin"`
+		Name   string  `json:"name" validate:"required"`
+		Price  Money   `json:"price" validate:"gt=0"`
+		Stock  int     `json:"stock" validate:"gte=0"`
+	}
+	// Category is a node in the catalog tree; root categories have no
+	// parent.
+	Category struct {
+		ID       int    `json:"id"`
+		ParentID *int   `json:"parent_id,omitempty"`
+		Name     string `json:"name" validate:"required"`
+	}
+	// ItemFilter narrows and orders a ListItems call. Zero values mean no
+	// filtering; prices are in minor units and Cursor is the NextCursor of
+	// a previous page.
+	ItemFilter struct {
+		Name string
+		Tag  string
+		// CategoryID limits the listing to a category and its descendants.
+		CategoryID int
+		MinPrice   *int64
+		MaxPrice   *int64
+		Sort       string
+		Cursor     string
+		Limit      int
+		// IncludeArchived lists archived items too
+		IncludeArchived bool
+	}
+	ItemPage struct {
+		Items      []Item `json:"items"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+	// ItemSearchResult is an item matched by SearchItems. Snippet is HTML
+	// escaped item text with the matched terms wrapped in <mark></mark>.
+	ItemSearchResult struct {
+		Item
+		Rank    float32 `json:"rank"`
+		Snippet string  `json:"snippet"`
+	}
+	// Orders is an order header; what was bought is in its Lines. Total
+	// is the sum of the line totals.
 	Orders struct {
-		ID      int       `json:"id"`
-		Contact string    `json:"contact" validate:"required"`
-		UserId  int       `json:"user_id"`
-		ItemID  int       `json:"item_id"  validate:"required"`
-		Qty     int       `json:"qty" validate:"required"`
-		Time    time.Time `json:"time" `
+		ID      int    `json:"id"`
+		Contact string `json:"contact" validate:"required_without=AddressID,max=32"`
+		// AddressID is a saved address of the customer to deliver to, its
+		// contact is used when Contact is empty
+		AddressID *int `json:"address_id,omitempty"`
+		// DeliveryLocation is where the order is delivered, it must be in
+		// a delivery zone and the zone's fee is charged. It is required
+		// once any zone is set up; until then orders pay the flat
+		// Pricing.DeliveryFee.
+		DeliveryLocation *LatLng     `json:"delivery_location,omitempty"`
+		DeliveryZoneID   *int        `json:"delivery_zone_id,omitempty"`
+		UserId           int         `json:"user_id"`
+		Lines            []OrderLine `json:"lines" validate:"required,min=1,dive"`
+		Total            Money       `json:"total"`
+		// Breakdown is how Total was worked out, see Pricing.Total
+		Breakdown Breakdown `json:"breakdown"`
+		// CouponCode is a discount code to redeem on the order
+		CouponCode string      `json:"coupon_code,omitempty"`
+		CouponID   *int        `json:"-"`
+		Status     OrderStatus `json:"status"`
+		// PaymentStatus is how paying for the order went, see Payment
+		PaymentStatus PaymentStatus `json:"payment_status"`
+		Time          time.Time     `json:"time" `
+		DeletedAt     *time.Time    `json:"deleted_at,omitempty"`
+	}
+	// OrderLine is one item, or one variant of an item, in an order.
+	// UnitPrice and LineTotal are what was charged, captured when the order
+	// is created so later price changes don't rewrite it.
+	OrderLine struct {
+		ID     int `json:"id"`
+		ItemID int `json:"item_id" validate:"required_without=VariantID"`
+		// VariantID is set when a specific variant of the item was ordered
+		VariantID *int  `json:"variant_id,omitempty"`
+		Qty       int   `json:"qty" validate:"required,gt=0"`
+		UnitPrice Money `json:"unit_price"`
+		LineTotal Money `json:"line_total"`
+	}
+	// Address is a contact and delivery address saved by a customer so
+	// orders can refer to it.
+	Address struct {
+		ID        int       `json:"id"`
+		UserID    int       `json:"user_id"`
+		Label     string    `json:"label" validate:"required,max=64"`
+		Contact   string    `json:"contact" validate:"required,max=32"`
+		Line1     string    `json:"line1" validate:"required,max=255"`
+		Line2     string    `json:"line2,omitempty" validate:"max=255"`
+		City      string    `json:"city" validate:"required,max=255"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	// OrderFilter narrows a ListOrdersByUser call. Orders are listed
+	// newest first; From is inclusive and To exclusive.
+	OrderFilter struct {
+		Status OrderStatus
+		From   *time.Time
+		To     *time.Time
+		Cursor string
+		Limit  int
+	}
+	OrderPage struct {
+		Orders     []Orders `json:"orders"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+	}
+	// PriceChange is an entry in an item's price history. VariantID is set
+	// when it was one of the item's variants that changed price.
+	PriceChange struct {
+		ItemID    int       `json:"item_id"`
+		VariantID *int      `json:"variant_id,omitempty"`
+		Price     Money     `json:"price"`
+		ChangedAt time.Time `json:"changed_at"`
 	}
 	database interface {
 		CreateUser(user User) (*User, error)
 		CreateItem(item Item) (*Item, error)
-		CreateOrders(order Orders) (*Orders, error)
+		// CreateOrders redeems the order's coupon and queues the
+		// notification notify returns for the created order in the same
+		// transaction, notify may be nil
+		CreateOrders(order Orders, notify func(order *Orders) *Notification) (*Orders, error)
 
+		// finds skip archived records, the IncludingArchived variants
+		// are for admins
 		FindUser(id int) (*User, error)
+		FindUserIncludingArchived(id int) (*User, error)
 		FindUserbyEmail(string) (*User, error)
+		FindUserbyEmailIncludingArchived(string) (*User, error)
 		FindItem(id int) (*Item, error)
+		FindItemIncludingArchived(id int) (*Item, error)
 		FindOrders(id int) (*Orders, error)
+		FindOrdersIncludingArchived(id int) (*Orders, error)
+		ListOrdersByUser(userID int, filter OrderFilter) (*OrderPage, error)
+		ListItems(filter ItemFilter) (*ItemPage, error)
+		SearchItems(query string, limit int) ([]ItemSearchResult, error)
+		// ItemPriceHistory lists the prices an item and its variants have
+		// had, oldest first
+		ItemPriceHistory(itemID int) ([]PriceChange, error)
 
+		CreateCategory(category Category) (*Category, error)
+		FindCategory(id int) (*Category, error)
+		ListCategories() ([]Category, error)
+		SetItemCategories(itemID int, categoryIDs []int) error
+		ItemCategories(itemID int) ([]Category, error)
+		SetItemTags(itemID int, tags []string) error
+		ItemTags(itemID int) ([]string, error)
+
+		CreateVariant(variant ItemVariant) (*ItemVariant, error)
+		FindVariant(id int) (*ItemVariant, error)
+		FindVariantBySKU(sku string) (*ItemVariant, error)
+		FindVariantByGTIN(gtin string) (*ItemVariant, error)
+		ListItemVariants(itemID int) ([]ItemVariant, error)
+		UpdateVariant(variant ItemVariant) error
+		DeleteVariant(id int) error
+
+		CreateAddress(address Address) (*Address, error)
+		FindAddress(id int) (*Address, error)
+		ListAddresses(userID int) ([]Address, error)
+		UpdateAddress(address Address) error
+		DeleteAddress(id int) error
+
+		CreateItemImage(image ItemImage) (*ItemImage, error)
+		FindItemImage(id int) (*ItemImage, error)
+		ListItemImages(itemID int) ([]ItemImage, error)
+		DeleteItemImage(id int) error
+
+		// deletes archive the record, restores bring it back
 		DeleteUser(id int) error
 		DeleteItem(id int) error
 		DeleteOrders(id int) error
+		RestoreUser(id int) error
+		RestoreItem(id int) error
+		RestoreOrders(id int) error
+
+		// UpdateOrderStatus moves an order from change.From to change.To
+		// and records the change, failing with sql.ErrNoRows when the
+		// order isn't in change.From. A non-nil notification is queued
+		// with the change.
+		UpdateOrderStatus(change OrderStatusChange, notification *Notification) error
+		// CancelOrder is UpdateOrderStatus to cancelled that also puts
+		// back the stock the order took and its coupon redemption
+		CancelOrder(change OrderStatusChange, notification *Notification) error
+		OrderStatusHistory(orderID int) ([]OrderStatusChange, error)
+
+		// ClaimNotifications returns up to limit pending notifications
+		// that are due and hides them from other claims for lease
+		ClaimNotifications(limit int, lease time.Duration) ([]Notification, error)
+		MarkNotificationSent(id int) error
+		// MarkNotificationFailed records a failed attempt and retries the
+		// notification after retryAfter, or gives up on it when retryAfter
+		// is zero
+		MarkNotificationFailed(id int, lastError string, retryAfter time.Duration) error
+		OrderNotifications(orderID int) ([]Notification, error)
+
+		// coupons with a code that's taken fail with ErrConflict,
+		// FindCouponByCode skips archived coupons
+		CreateCoupon(coupon Coupon) (*Coupon, error)
+		FindCoupon(id int) (*Coupon, error)
+		FindCouponByCode(code string) (*Coupon, error)
+		ListCoupons() ([]Coupon, error)
+		UpdateCoupon(coupon Coupon) error
+		DeleteCoupon(id int) error
+		CouponRedemptionsByUser(couponID, userID int) (int, error)
+
+		// ListDeliveryZones skips archived zones, DeleteDeliveryZone
+		// archives one so orders delivered there keep pointing to it
+		CreateDeliveryZone(zone DeliveryZone) (*DeliveryZone, error)
+		FindDeliveryZone(id int) (*DeliveryZone, error)
+		ListDeliveryZones() ([]DeliveryZone, error)
+		UpdateDeliveryZone(zone DeliveryZone) error
+		DeleteDeliveryZone(id int) error
+
+		// FindCart fails with sql.ErrNoRows when the customer has no
+		// cart. Changing a cart's lines touches its UpdatedAt.
+		FindCart(userID int) (*Cart, error)
+		// AddCartLine adds to the quantity of the line for the same item
+		// or variant if there is one
+		AddCartLine(userID int, line CartLine) (*CartLine, error)
+		UpdateCartLine(userID int, line CartLine) error
+		RemoveCartLine(userID, lineID int) error
+		ClearCart(userID int) error
+		DeleteCartsBefore(cutoff time.Time) (int, error)
+		// CheckoutCart is CreateOrders that also takes lines out of the
+		// customer's cart, failing with ErrCartChanged when they aren't
+		// in it as they were
+		CheckoutCart(userID int, lines []CartLine, order Orders, notify func(order *Orders) *Notification) (*Orders, error)
+
+		// CreatePayment records a pending payment and marks its order
+		// pending. It fails with sql.ErrNoRows when the order is paid
+		// already and with ErrConflict when it has a pending payment.
+		CreatePayment(payment Payment) (*Payment, error)
+		SetPaymentReference(id int, reference string) error
+		// SettlePayment moves a pending payment, or a failed one that
+		// turned out paid, to status and its order with it, queueing a
+		// non-nil notification. Other payments fail with sql.ErrNoRows.
+		// A payment that turns out paid for an order that was cancelled
+		// or already paid for leaves the order as it is; a pending refund
+		// of all of it is recorded and returned instead.
+		SettlePayment(id int, status PaymentStatus, receipt, reason string, notification *Notification) (*Refund, error)
+		FindPaymentByReference(provider, reference string) (*Payment, error)
+		// OrderPayments lists the order's payments, newest first
+		OrderPayments(orderID int) ([]Payment, error)
+
+		// CreateRefund records a pending refund against a paid payment.
+		// It fails with sql.ErrNoRows when the payment isn't paid and with
+		// ErrRefundTooLarge when the refunds of the payment that didn't
+		// fail would add up to more than it.
+		CreateRefund(refund Refund) (*Refund, error)
+		SetRefundReference(id int, reference string) error
+		// SettleRefund moves a pending refund to status, queueing a non-nil
+		// notification. Other refunds fail with sql.ErrNoRows.
+		SettleRefund(id int, status RefundStatus, receipt, reason string, notification *Notification) error
+		FindRefundByReference(provider, reference string) (*Refund, error)
+		// OrderRefunds lists the order's refunds, newest first
+		OrderRefunds(orderID int) ([]Refund, error)
 
 		UpdateUser(user User) error
 		UpdateItem(item Item) error
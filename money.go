@@ -0,0 +1,126 @@
+package savannah
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultCurrency is assumed when a client sends an amount without one.
+const DefaultCurrency = "KES"
+
+// Money is an amount in the currency's minor unit (cents for KES) together
+// with its ISO 4217 code. Keeping amounts as integers makes totals exact.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type currency struct {
+	symbol   string
+	exponent int
+}
+
+// currencies are the ISO 4217 codes we accept, with the number of minor
+// unit digits each one has.
+var currencies = map[string]currency{
+	"KES": {"KSh", 2},
+	"UGX": {"USh", 0},
+	"TZS": {"TSh", 2},
+	"RWF": {"FRw", 0},
+	"USD": {"$", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+}
+
+func NewMoney(amount int64, code string) Money {
+	return Money{Amount: amount, Currency: code}
+}
+
+// withCurrency fills in DefaultCurrency for amounts built without one.
+func withCurrency(m Money) Money {
+	if m.Currency == "" {
+		m.Currency = DefaultCurrency
+	}
+	return m
+}
+
+// Mul returns the amount multiplied by qty, e.g. a line total.
+func (m Money) Mul(qty int) Money {
+	return Money{Amount: m.Amount * int64(qty), Currency: m.Currency}
+}
+
+// Add returns the sum of two amounts. Both must be in the same currency; a
+// zero Money without a currency takes on the other's.
+func (m Money) Add(o Money) Money {
+	if m.Currency == "" {
+		m.Currency = o.Currency
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}
+}
+
+// String renders the amount in major units with the currency symbol and
+// thousands separators, e.g. "KSh 1,250.00" or "$12.50".
+func (m Money) String() string {
+	c, ok := currencies[m.Currency]
+	if !ok {
+		c = currency{symbol: m.Currency, exponent: 2}
+	}
+	amount, sign := m.Amount, ""
+	if amount < 0 {
+		amount, sign = -amount, "-"
+	}
+	var unit int64 = 1
+	for i := 0; i < c.exponent; i++ {
+		unit *= 10
+	}
+	major := groupThousands(strconv.FormatInt(amount/unit, 10))
+	if c.exponent > 0 {
+		major += fmt.Sprintf(".%0*d", c.exponent, amount%unit)
+	}
+	if utf8.RuneCountInString(c.symbol) > 1 {
+		return sign + c.symbol + " " + major
+	}
+	return sign + c.symbol + major
+}
+
+func groupThousands(digits string) string {
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// UnmarshalJSON normalises the currency code, defaults it to
+// DefaultCurrency and rejects codes we don't know.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	type money Money
+	var v money
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v.Currency = strings.ToUpper(strings.TrimSpace(v.Currency))
+	if v.Currency == "" {
+		v.Currency = DefaultCurrency
+	}
+	if _, ok := currencies[v.Currency]; !ok {
+		return fmt.Errorf("unsupported currency %q", v.Currency)
+	}
+	*m = Money(v)
+	return nil
+}
+
+// moneyAmount lets validator tags like gt=0 apply to a Money's amount.
+func moneyAmount(field reflect.Value) interface{} {
+	if m, ok := field.Interface().(Money); ok {
+		return m.Amount
+	}
+	return nil
+}
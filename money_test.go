@@ -0,0 +1,39 @@
+package savannah
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoney_String(t *testing.T) {
+	assert.Equal(t, "KSh 1,234,567.05", NewMoney(123456705, "KES").String())
+	assert.Equal(t, "KSh 0.99", NewMoney(99, "KES").String())
+	assert.Equal(t, "-$12.50", NewMoney(-1250, "USD").String())
+	assert.Equal(t, "USh 15,000", NewMoney(15000, "UGX").String())
+}
+
+func TestMoney_Arithmetic(t *testing.T) {
+	price := NewMoney(1999, "KES")
+	assert.Equal(t, NewMoney(5997, "KES"), price.Mul(3))
+	assert.Equal(t, NewMoney(1999, "KES"), Money{}.Add(price))
+	assert.Equal(t, NewMoney(3998, "KES"), price.Add(price))
+}
+
+func TestMoney_UnmarshalJSON(t *testing.T) {
+	var m Money
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 2500, "currency": "usd"}`), &m))
+	assert.Equal(t, NewMoney(2500, "USD"), m)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 2500}`), &m))
+	assert.Equal(t, NewMoney(2500, DefaultCurrency), m)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": 2500, "currency": "XYZ"}`), &m))
+}
+
+func TestMoney_Validation(t *testing.T) {
+	validate := newValidator()
+	assert.NoError(t, validate.Struct(Item{Price: NewMoney(100, "KES"), Name: "Item", Description: "Priced"}))
+	assert.Error(t, validate.Struct(Item{Price: NewMoney(0, "KES"), Name: "Item", Description: "Free"}))
+}
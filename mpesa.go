@@ -0,0 +1,375 @@
+package savannah
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MpesaProvider takes payments with M-Pesa Express (STK Push) through
+// Safaricom's Daraja API: the customer gets a prompt on their phone to
+// enter their M-Pesa PIN, and Daraja posts the outcome to CallbackURL.
+// Refunds are sent back to the customer's phone as B2C payments, which
+// unlike reversals can be for part of a payment.
+type MpesaProvider struct {
+	ConsumerKey    string
+	ConsumerSecret string
+	// the paybill or till number paid into, and its Lipa na M-Pesa passkey
+	ShortCode string
+	PassKey   string
+	// where Daraja posts outcomes, the payment callback route
+	CallbackURL string
+	// the API user B2C payments are made as, its encrypted password, the
+	// shortcode they're paid from and where Daraja posts their outcomes,
+	// the refund callback route
+	InitiatorName      string
+	SecurityCredential string
+	B2CShortCode       string
+	RefundCallbackURL  string
+
+	host   string
+	client *http.Client
+	// how long a call to Daraja may take, mpesaDeadline
+	deadline time.Duration
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewMpesaProvider(env, consumerKey, consumerSecret, shortCode, passKey, callbackURL string) *MpesaProvider {
+	return &MpesaProvider{
+		ConsumerKey:    consumerKey,
+		ConsumerSecret: consumerSecret,
+		ShortCode:      shortCode,
+		PassKey:        passKey,
+		CallbackURL:    callbackURL,
+		host:           GetMpesaHost(env),
+		client:         &http.Client{},
+		deadline:       mpesaDeadline,
+	}
+}
+
+// mpesaDeadline is how long a call to Daraja may take altogether, fetching
+// an access token included. STK pushes are sent while an order is being
+// placed, so this stays well within the server's 30s WriteTimeout.
+const mpesaDeadline = 15 * time.Second
+
+func GetMpesaHost(env string) string {
+	if env == "production" {
+		return "https://api.safaricom.co.ke"
+	}
+	return "https://sandbox.safaricom.co.ke"
+}
+
+// mpesaTime is the time zone Daraja's timestamps are in.
+var mpesaTime = time.FixedZone("EAT", 3*60*60)
+
+func (p *MpesaProvider) Name() string {
+	return "mpesa"
+}
+
+// accessToken returns an OAuth token for the API, fetching a new one when
+// the last one is about to expire.
+func (p *MpesaProvider) accessToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Now().Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.host+"/oauth/v1/generate?grant_type=client_credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(p.ConsumerKey, p.ConsumerSecret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting an access token: %s", resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	seconds, err := strconv.Atoi(body.ExpiresIn)
+	if err != nil {
+		return "", fmt.Errorf("getting an access token: expires_in %q", body.ExpiresIn)
+	}
+	// renew a minute early so a token doesn't expire on its way to Daraja
+	p.token, p.tokenExpiry = body.AccessToken, time.Now().Add(time.Duration(seconds-60)*time.Second)
+	return p.token, nil
+}
+
+// Round rounds shillings with cents up to the next whole shilling, M-Pesa
+// takes nothing smaller.
+func (p *MpesaProvider) Round(amount Money) Money {
+	if amount.Currency == "KES" {
+		amount.Amount = (amount.Amount + 99) / 100 * 100
+	}
+	return amount
+}
+
+// Initiate sends the customer an STK Push prompt for the payment's amount,
+// rounded like Round, and returns its CheckoutRequestID.
+func (p *MpesaProvider) Initiate(payment Payment) (string, error) {
+	if payment.Amount.Currency != "KES" {
+		return "", fmt.Errorf("M-Pesa doesn't take %s", payment.Amount.Currency)
+	}
+	phone, ok := normalizeMpesaPhone(payment.Phone)
+	if !ok {
+		return "", fmt.Errorf("%q is not a Kenyan phone number", payment.Phone)
+	}
+	timestamp := time.Now().In(mpesaTime).Format("20060102150405")
+	reference := fmt.Sprintf("Order %d", payment.OrderID)
+	request := map[string]interface{}{
+		"BusinessShortCode": p.ShortCode,
+		"Password":          base64.StdEncoding.EncodeToString([]byte(p.ShortCode + p.PassKey + timestamp)),
+		"Timestamp":         timestamp,
+		"TransactionType":   "CustomerPayBillOnline",
+		"Amount":            p.Round(payment.Amount).Amount / 100,
+		"PartyA":            phone,
+		"PartyB":            p.ShortCode,
+		"PhoneNumber":       phone,
+		"CallBackURL":       p.CallbackURL,
+		"AccountReference":  reference,
+		"TransactionDesc":   reference,
+	}
+	var body struct {
+		CheckoutRequestID string `json:"CheckoutRequestID"`
+	}
+	if err := p.post("/mpesa/stkpush/v1/processrequest", request, &body); err != nil {
+		return "", fmt.Errorf("STK push: %v", err)
+	}
+	return body.CheckoutRequestID, nil
+}
+
+// post sends a request to the API and decodes its response into response,
+// within the provider's deadline. Requests Daraja doesn't accept fail with the reason
+// it gives.
+func (p *MpesaProvider) post(path string, request, response interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.deadline)
+	defer cancel()
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.host+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		ResponseCode        string `json:"ResponseCode"`
+		ResponseDescription string `json:"ResponseDescription"`
+		ErrorMessage        string `json:"errorMessage"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return errors.New(resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || status.ResponseCode != "0" {
+		if status.ErrorMessage != "" {
+			return errors.New(status.ErrorMessage)
+		}
+		if status.ResponseDescription != "" {
+			return errors.New(status.ResponseDescription)
+		}
+		return errors.New(resp.Status)
+	}
+	return json.Unmarshal(body, response)
+}
+
+// ParseCallback reads the outcome of an STK Push Daraja posts to
+// CallbackURL. A ResultCode other than 0 means the payment failed, for
+// instance because the customer cancelled it or didn't answer in time.
+// Successful payments must say how many shillings were paid.
+func (p *MpesaProvider) ParseCallback(r *http.Request) (*PaymentResult, error) {
+	var body struct {
+		Body struct {
+			StkCallback struct {
+				CheckoutRequestID string `json:"CheckoutRequestID"`
+				ResultCode        int    `json:"ResultCode"`
+				ResultDesc        string `json:"ResultDesc"`
+				CallbackMetadata  struct {
+					Item []struct {
+						Name  string      `json:"Name"`
+						Value interface{} `json:"Value"`
+					} `json:"Item"`
+				} `json:"CallbackMetadata"`
+			} `json:"stkCallback"`
+		} `json:"Body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	callback := body.Body.StkCallback
+	if callback.CheckoutRequestID == "" {
+		return nil, errors.New("CheckoutRequestID is required")
+	}
+	result := PaymentResult{Reference: callback.CheckoutRequestID, Paid: callback.ResultCode == 0}
+	if !result.Paid {
+		result.Reason = callback.ResultDesc
+		return &result, nil
+	}
+	for _, item := range callback.CallbackMetadata.Item {
+		switch item.Name {
+		case "MpesaReceiptNumber":
+			result.Receipt, _ = item.Value.(string)
+		case "Amount":
+			if shillings, ok := item.Value.(float64); ok {
+				amount := NewMoney(int64(math.Round(shillings*100)), "KES")
+				result.Amount = &amount
+			}
+		}
+	}
+	if result.Amount == nil {
+		return nil, errors.New("Amount is required")
+	}
+	return &result, nil
+}
+
+// Query asks Daraja what became of an STK Push. A ResultCode other than 0
+// means the payment failed. Daraja refuses to answer while the customer
+// can still enter their PIN, and doesn't say how much was paid or give
+// the M-Pesa receipt, the payment's own amount is taken as paid.
+func (p *MpesaProvider) Query(payment Payment) (*PaymentResult, error) {
+	timestamp := time.Now().In(mpesaTime).Format("20060102150405")
+	request := map[string]interface{}{
+		"BusinessShortCode": p.ShortCode,
+		"Password":          base64.StdEncoding.EncodeToString([]byte(p.ShortCode + p.PassKey + timestamp)),
+		"Timestamp":         timestamp,
+		"CheckoutRequestID": payment.Reference,
+	}
+	var body struct {
+		ResultCode json.Number `json:"ResultCode"`
+		ResultDesc string      `json:"ResultDesc"`
+	}
+	if err := p.post("/mpesa/stkpushquery/v1/query", request, &body); err != nil {
+		return nil, fmt.Errorf("STK push query: %v", err)
+	}
+	if body.ResultCode == "" {
+		return nil, errors.New("STK push query: ResultCode is required")
+	}
+	if body.ResultCode != "0" {
+		return &PaymentResult{Reference: payment.Reference, Reason: body.ResultDesc}, nil
+	}
+	return &PaymentResult{Reference: payment.Reference, Paid: true}, nil
+}
+
+// normalizeMpesaPhone turns a Kenyan mobile number written as 0712345678,
+// +254712345678 or 254712345678 into the 254712345678 Daraja expects.
+func normalizeMpesaPhone(phone string) (string, bool) {
+	phone = strings.NewReplacer(" ", "", "-", "").Replace(phone)
+	phone = strings.TrimPrefix(phone, "+")
+	switch {
+	case strings.HasPrefix(phone, "0") && len(phone) == 10:
+		phone = "254" + phone[1:]
+	case (strings.HasPrefix(phone, "7") || strings.HasPrefix(phone, "1")) && len(phone) == 9:
+		phone = "254" + phone
+	}
+	if len(phone) != 12 || !strings.HasPrefix(phone, "254") {
+		return "", false
+	}
+	for _, c := range phone {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return phone, true
+}
+
+// Refund sends the refund to the phone the payment came from as a B2C
+// payment and returns its ConversationID. B2C payments are in whole
+// shillings.
+func (p *MpesaProvider) Refund(payment Payment, refund Refund) (string, error) {
+	if refund.Amount.Currency != "KES" || refund.Amount.Amount%100 != 0 {
+		return "", fmt.Errorf("M-Pesa can only refund whole shillings, not %s", refund.Amount)
+	}
+	phone, ok := normalizeMpesaPhone(refund.Phone)
+	if !ok {
+		return "", fmt.Errorf("%q is not a Kenyan phone number", refund.Phone)
+	}
+	shortCode := p.B2CShortCode
+	if shortCode == "" {
+		shortCode = p.ShortCode
+	}
+	remarks := refund.Reason
+	if len(remarks) > 100 {
+		remarks = remarks[:100]
+	}
+	if remarks == "" {
+		remarks = "Refund"
+	}
+	request := map[string]interface{}{
+		"InitiatorName":      p.InitiatorName,
+		"SecurityCredential": p.SecurityCredential,
+		"CommandID":          "BusinessPayment",
+		"Amount":             refund.Amount.Amount / 100,
+		"PartyA":             shortCode,
+		"PartyB":             phone,
+		"Remarks":            remarks,
+		"QueueTimeOutURL":    p.RefundCallbackURL,
+		"ResultURL":          p.RefundCallbackURL,
+		"Occasion":           fmt.Sprintf("Refund order %d", refund.OrderID),
+	}
+	var body struct {
+		ConversationID string `json:"ConversationID"`
+	}
+	if err := p.post("/mpesa/b2c/v1/paymentrequest", request, &body); err != nil {
+		return "", fmt.Errorf("B2C payment: %v", err)
+	}
+	return body.ConversationID, nil
+}
+
+// ParseRefundCallback reads the result of a B2C payment Daraja posts to
+// RefundCallbackURL. A ResultCode other than 0 means the refund failed.
+func (p *MpesaProvider) ParseRefundCallback(r *http.Request) (*RefundResult, error) {
+	var body struct {
+		Result struct {
+			ResultCode     int    `json:"ResultCode"`
+			ResultDesc     string `json:"ResultDesc"`
+			ConversationID string `json:"ConversationID"`
+			TransactionID  string `json:"TransactionID"`
+		} `json:"Result"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	result := body.Result
+	if result.ConversationID == "" {
+		return nil, errors.New("ConversationID is required")
+	}
+	if result.ResultCode != 0 {
+		return &RefundResult{Reference: result.ConversationID, Reason: result.ResultDesc}, nil
+	}
+	return &RefundResult{Reference: result.ConversationID, Completed: true, Receipt: result.TransactionID}, nil
+}
@@ -0,0 +1,238 @@
+package savannah
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeMpesaPhone(t *testing.T) {
+	for _, phone := range []string{"0712345678", "+254712345678", "254 712 345 678", "712345678"} {
+		normalized, ok := normalizeMpesaPhone(phone)
+		assert.True(t, ok, phone)
+		assert.Equal(t, "254712345678", normalized, phone)
+	}
+	for _, phone := range []string{"", "+14155550100", "07123", "0712abc678"} {
+		_, ok := normalizeMpesaPhone(phone)
+		assert.False(t, ok, phone)
+	}
+}
+
+func TestMpesaProvider_Round(t *testing.T) {
+	provider := &MpesaProvider{}
+	assert.Equal(t, NewMoney(125100, "KES"), provider.Round(NewMoney(125050, "KES")))
+	assert.Equal(t, NewMoney(125000, "KES"), provider.Round(NewMoney(125000, "KES")))
+	assert.Equal(t, NewMoney(101, "USD"), provider.Round(NewMoney(101, "USD")))
+}
+
+func TestMpesaProvider_Initiate(t *testing.T) {
+	tokens := 0
+	var push map[string]interface{}
+	daraja := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/v1/generate":
+			key, secret, _ := r.BasicAuth()
+			assert.Equal(t, "key", key)
+			assert.Equal(t, "secret", secret)
+			tokens++
+			w.Write([]byte(`{"access_token": "token", "expires_in": "3599"}`))
+		case "/mpesa/stkpush/v1/processrequest":
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			push = nil
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&push))
+			if push["PhoneNumber"] == "254700000001" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errorCode": "400.002.02", "errorMessage": "Bad Request - Invalid PhoneNumber"}`))
+				return
+			}
+			w.Write([]byte(`{"MerchantRequestID": "29115-34620561-1", "CheckoutRequestID": "ws_CO_191220191020363925", "ResponseCode": "0"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daraja.Close()
+	provider := NewMpesaProvider("sandbox", "key", "secret", "174379", "passkey", "https://example.com/payments/mpesa/callback")
+	provider.host = daraja.URL
+
+	reference, err := provider.Initiate(Payment{OrderID: 12, Phone: "0712345678", Amount: NewMoney(125050, "KES")})
+	assert.NoError(t, err)
+	assert.Equal(t, "ws_CO_191220191020363925", reference)
+	assert.Equal(t, "254712345678", push["PartyA"])
+	assert.Equal(t, "174379", push["PartyB"])
+	// cents are rounded up to the shilling
+	assert.Equal(t, float64(1251), push["Amount"])
+	assert.Equal(t, "Order 12", push["AccountReference"])
+	password, err := base64.StdEncoding.DecodeString(push["Password"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "174379passkey"+push["Timestamp"].(string), string(password))
+
+	_, err = provider.Initiate(Payment{OrderID: 13, Phone: "0700000001", Amount: NewMoney(100, "KES")})
+	assert.EqualError(t, err, "STK push: Bad Request - Invalid PhoneNumber")
+	_, err = provider.Initiate(Payment{OrderID: 14, Phone: "0712345678", Amount: NewMoney(100, "USD")})
+	assert.Error(t, err)
+	// the token is reused until it expires
+	assert.Equal(t, 1, tokens)
+}
+
+func TestMpesaProvider_Deadline(t *testing.T) {
+	// a slow token and a slow push together still fail within the deadline
+	daraja := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		if r.URL.Path == "/oauth/v1/generate" {
+			w.Write([]byte(`{"access_token": "token", "expires_in": "3599"}`))
+			return
+		}
+		w.Write([]byte(`{"CheckoutRequestID": "ws_CO_191220191020363925", "ResponseCode": "0"}`))
+	}))
+	defer daraja.Close()
+	provider := NewMpesaProvider("sandbox", "key", "secret", "174379", "passkey", "")
+	provider.host = daraja.URL
+	provider.deadline = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := provider.Initiate(Payment{OrderID: 12, Phone: "0712345678", Amount: NewMoney(100, "KES")})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestMpesaProvider_ParseCallback(t *testing.T) {
+	provider := NewMpesaProvider("sandbox", "key", "secret", "174379", "passkey", "")
+	paid := `{"Body": {"stkCallback": {
+		"MerchantRequestID": "29115-34620561-1",
+		"CheckoutRequestID": "ws_CO_191220191020363925",
+		"ResultCode": 0,
+		"ResultDesc": "The service request is processed successfully.",
+		"CallbackMetadata": {"Item": [
+			{"Name": "Amount", "Value": 1.00},
+			{"Name": "MpesaReceiptNumber", "Value": "NLJ7RT61SV"},
+			{"Name": "TransactionDate", "Value": 20191219102115},
+			{"Name": "PhoneNumber", "Value": 254708374149}
+		]}
+	}}}`
+	result, err := provider.ParseCallback(httptest.NewRequest("POST", "/payments/mpesa/callback", strings.NewReader(paid)))
+	assert.NoError(t, err)
+	amount := NewMoney(100, "KES")
+	assert.Equal(t, &PaymentResult{Reference: "ws_CO_191220191020363925", Paid: true, Receipt: "NLJ7RT61SV", Amount: &amount}, result)
+
+	// a payment without an amount can't be checked against what was asked
+	_, err = provider.ParseCallback(httptest.NewRequest("POST", "/payments/mpesa/callback", strings.NewReader(strings.Replace(paid, `{"Name": "Amount", "Value": 1.00},`, "", 1))))
+	assert.Error(t, err)
+
+	cancelled := `{"Body": {"stkCallback": {
+		"MerchantRequestID": "29115-34620561-1",
+		"CheckoutRequestID": "ws_CO_191220191020363925",
+		"ResultCode": 1032,
+		"ResultDesc": "Request cancelled by user"
+	}}}`
+	result, err = provider.ParseCallback(httptest.NewRequest("POST", "/payments/mpesa/callback", strings.NewReader(cancelled)))
+	assert.NoError(t, err)
+	assert.False(t, result.Paid)
+	assert.Equal(t, "Request cancelled by user", result.Reason)
+
+	_, err = provider.ParseCallback(httptest.NewRequest("POST", "/payments/mpesa/callback", strings.NewReader(`{}`)))
+	assert.Error(t, err)
+}
+
+func TestMpesaProvider_Refund(t *testing.T) {
+	var b2c map[string]interface{}
+	daraja := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/v1/generate":
+			w.Write([]byte(`{"access_token": "token", "expires_in": "3599"}`))
+		case "/mpesa/b2c/v1/paymentrequest":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&b2c))
+			w.Write([]byte(`{"ConversationID": "AG_20191219_00005797af5d7d75f652", "OriginatorConversationID": "16740-34861180-1", "ResponseCode": "0"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daraja.Close()
+	provider := NewMpesaProvider("sandbox", "key", "secret", "174379", "passkey", "")
+	provider.host = daraja.URL
+	provider.InitiatorName, provider.SecurityCredential = "testapi", "credential"
+	provider.RefundCallbackURL = "https://example.com/payments/mpesa/refunds/callback"
+
+	reference, err := provider.Refund(Payment{}, Refund{OrderID: 12, Phone: "0712345678", Amount: NewMoney(40000, "KES"), Reason: "one bag was damaged"})
+	assert.NoError(t, err)
+	assert.Equal(t, "AG_20191219_00005797af5d7d75f652", reference)
+	assert.Equal(t, "254712345678", b2c["PartyB"])
+	// paid from the paybill when there's no B2C shortcode
+	assert.Equal(t, "174379", b2c["PartyA"])
+	assert.Equal(t, float64(400), b2c["Amount"])
+	assert.Equal(t, "testapi", b2c["InitiatorName"])
+	assert.Equal(t, provider.RefundCallbackURL, b2c["ResultURL"])
+
+	_, err = provider.Refund(Payment{}, Refund{OrderID: 12, Phone: "0712345678", Amount: NewMoney(40050, "KES")})
+	assert.Error(t, err)
+
+	completed := `{"Result": {
+		"ResultType": 0,
+		"ResultCode": 0,
+		"ResultDesc": "The service request is processed successfully.",
+		"OriginatorConversationID": "16740-34861180-1",
+		"ConversationID": "AG_20191219_00005797af5d7d75f652",
+		"TransactionID": "NLJ41HAY6Q"
+	}}`
+	result, err := provider.ParseRefundCallback(httptest.NewRequest("POST", "/payments/mpesa/refunds/callback", strings.NewReader(completed)))
+	assert.NoError(t, err)
+	assert.Equal(t, &RefundResult{Reference: "AG_20191219_00005797af5d7d75f652", Completed: true, Receipt: "NLJ41HAY6Q"}, result)
+
+	failed := `{"Result": {
+		"ResultType": 0,
+		"ResultCode": 2001,
+		"ResultDesc": "The initiator information is invalid.",
+		"ConversationID": "AG_20191219_00005797af5d7d75f652"
+	}}`
+	result, err = provider.ParseRefundCallback(httptest.NewRequest("POST", "/payments/mpesa/refunds/callback", strings.NewReader(failed)))
+	assert.NoError(t, err)
+	assert.False(t, result.Completed)
+	assert.Equal(t, "The initiator information is invalid.", result.Reason)
+}
+
+func TestMpesaProvider_Query(t *testing.T) {
+	var query map[string]interface{}
+	daraja := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/v1/generate":
+			w.Write([]byte(`{"access_token": "token", "expires_in": "3599"}`))
+		case "/mpesa/stkpushquery/v1/query":
+			query = nil
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&query))
+			switch query["CheckoutRequestID"] {
+			case "ws_CO_paid":
+				w.Write([]byte(`{"ResponseCode": "0", "CheckoutRequestID": "ws_CO_paid", "ResultCode": "0", "ResultDesc": "The service request is processed successfully."}`))
+			case "ws_CO_cancelled":
+				w.Write([]byte(`{"ResponseCode": "0", "CheckoutRequestID": "ws_CO_cancelled", "ResultCode": "1032", "ResultDesc": "Request cancelled by user"}`))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"errorCode": "500.001.1001", "errorMessage": "The transaction is being processed"}`))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daraja.Close()
+	provider := NewMpesaProvider("sandbox", "key", "secret", "174379", "passkey", "")
+	provider.host = daraja.URL
+
+	result, err := provider.Query(Payment{Reference: "ws_CO_paid"})
+	assert.NoError(t, err)
+	assert.Equal(t, &PaymentResult{Reference: "ws_CO_paid", Paid: true}, result)
+	assert.Equal(t, "174379", query["BusinessShortCode"])
+	password, err := base64.StdEncoding.DecodeString(query["Password"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "174379passkey"+query["Timestamp"].(string), string(password))
+
+	result, err = provider.Query(Payment{Reference: "ws_CO_cancelled"})
+	assert.NoError(t, err)
+	assert.Equal(t, &PaymentResult{Reference: "ws_CO_cancelled", Reason: "Request cancelled by user"}, result)
+
+	_, err = provider.Query(Payment{Reference: "ws_CO_processing"})
+	assert.EqualError(t, err, "STK push query: The transaction is being processed")
+}
@@ -0,0 +1,135 @@
+package savannah
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// NotificationStatus is where a notification is in the outbox. Pending
+// notifications are retried until they are sent or run out of attempts and
+// are marked failed.
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationSent    NotificationStatus = "sent"
+	NotificationFailed  NotificationStatus = "failed"
+)
+
+// Notification is an SMS in the outbox. It is written in the same
+// transaction as the change it tells the customer about and sent later by a
+// Dispatcher, so the change doesn't depend on the SMS provider being up.
+type Notification struct {
+	ID            int                `json:"id"`
+	OrderID       *int               `json:"order_id,omitempty"`
+	Recipient     string             `json:"recipient"`
+	Message       string             `json:"message"`
+	Status        NotificationStatus `json:"status"`
+	Attempts      int                `json:"attempts"`
+	LastError     string             `json:"last_error,omitempty"`
+	NextAttemptAt time.Time          `json:"next_attempt_at"`
+	CreatedAt     time.Time          `json:"created_at"`
+	SentAt        *time.Time         `json:"sent_at,omitempty"`
+}
+
+// Sender delivers an SMS, ATalkingService is the one used in production.
+type Sender interface {
+	Send(to, message string) error
+}
+
+const (
+	dispatchInterval = 5 * time.Second
+	dispatchBatch    = 50
+	// how long a claimed notification is hidden from other dispatchers,
+	// longer than a send can take
+	dispatchLease = 2 * time.Minute
+	// attempts before a notification is given up on, about 2 hours of
+	// retrying with notificationBackoff
+	maxNotificationAttempts = 8
+)
+
+// Dispatcher sends the notifications in the outbox. Several may run against
+// the same database, each notification is claimed by one of them at a time.
+type Dispatcher struct {
+	store       database
+	sender      Sender
+	interval    time.Duration
+	batch       int
+	maxAttempts int
+	backoff     func(attempts int) time.Duration
+}
+
+func NewDispatcher(s Service) *Dispatcher {
+	return &Dispatcher{
+		store:       s.service,
+		sender:      s.sms,
+		interval:    dispatchInterval,
+		batch:       dispatchBatch,
+		maxAttempts: maxNotificationAttempts,
+		backoff:     notificationBackoff,
+	}
+}
+
+// notificationBackoff doubles the wait after every failed attempt, starting
+// at 30 seconds and capped at an hour.
+func notificationBackoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+// Run dispatches due notifications every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			sent, err := d.DispatchOnce()
+			if err != nil {
+				log.Println("outbox:", err)
+			}
+			// a full batch means more may be due already
+			if err != nil || sent < d.batch {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchOnce sends one batch of due notifications and reports how many it
+// claimed. A failed send is retried after backoff, until maxAttempts have
+// been made and the notification is marked failed.
+func (d *Dispatcher) DispatchOnce() (int, error) {
+	due, err := d.store.ClaimNotifications(d.batch, dispatchLease)
+	if err != nil {
+		return 0, err
+	}
+	for _, notification := range due {
+		sendErr := d.sender.Send(notification.Recipient, notification.Message)
+		if sendErr == nil {
+			err = d.store.MarkNotificationSent(notification.ID)
+		} else {
+			var retryAfter time.Duration
+			if attempts := notification.Attempts + 1; attempts < d.maxAttempts {
+				retryAfter = d.backoff(attempts)
+			}
+			log.Printf("outbox: notification %d: %v", notification.ID, sendErr)
+			err = d.store.MarkNotificationFailed(notification.ID, sendErr.Error(), retryAfter)
+		}
+		if err != nil {
+			return len(due), err
+		}
+	}
+	return len(due), nil
+}
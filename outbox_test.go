@@ -0,0 +1,109 @@
+package savannah
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSender records the messages it is asked to send and fails while err
+// is set.
+type fakeSender struct {
+	sent []string
+	err  error
+}
+
+func (s *fakeSender) Send(to, message string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, to+": "+message)
+	return nil
+}
+
+func TestNotificationBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, notificationBackoff(1))
+	assert.Equal(t, time.Minute, notificationBackoff(2))
+	assert.Equal(t, 4*time.Minute, notificationBackoff(4))
+	assert.Equal(t, time.Hour, notificationBackoff(20))
+}
+
+func TestDispatcher_DispatchOnce(t *testing.T) {
+	service := NewMockService()
+	sender := &fakeSender{err: errors.New("provider down")}
+	service.sms = sender
+	store := service.service.(*MockInMemDB)
+	item, err := store.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := store.CreateOrders(priced(t, store, Orders{Contact: "+254700000000", UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}),
+		func(order *Orders) *Notification {
+			return &Notification{Recipient: order.Contact, Message: "Thanks for ordering " + order.Total.String()}
+		})
+	assert.NoError(t, err)
+
+	dispatcher := NewDispatcher(service)
+	dispatcher.backoff = func(int) time.Duration { return time.Nanosecond }
+	claimed, err := dispatcher.DispatchOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, claimed)
+	notifications, err := store.OrderNotifications(order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, notifications, 1) {
+		assert.Equal(t, NotificationPending, notifications[0].Status)
+		assert.Equal(t, 1, notifications[0].Attempts)
+		assert.Equal(t, "provider down", notifications[0].LastError)
+	}
+
+	// the provider is back, the retry goes through
+	sender.err = nil
+	time.Sleep(time.Millisecond)
+	claimed, err = dispatcher.DispatchOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, claimed)
+	assert.Equal(t, []string{"+254700000000: Thanks for ordering " + NewMoney(999, "KES").String()}, sender.sent)
+	notifications, err = store.OrderNotifications(order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, notifications, 1) {
+		assert.Equal(t, NotificationSent, notifications[0].Status)
+		assert.Equal(t, 2, notifications[0].Attempts)
+		assert.NotNil(t, notifications[0].SentAt)
+	}
+
+	// sent notifications aren't claimed again
+	claimed, err = dispatcher.DispatchOnce()
+	assert.NoError(t, err)
+	assert.Zero(t, claimed)
+}
+
+func TestDispatcher_GivesUp(t *testing.T) {
+	service := NewMockService()
+	service.sms = &fakeSender{err: errors.New("invalid phone number")}
+	store := service.service.(*MockInMemDB)
+	item, err := store.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := store.CreateOrders(priced(t, store, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CancelOrder(OrderStatusChange{OrderID: order.ID, From: StatusPending}, &Notification{Recipient: "0", Message: "Your order has been cancelled"}))
+
+	dispatcher := NewDispatcher(service)
+	dispatcher.backoff = func(int) time.Duration { return time.Nanosecond }
+	for i := 0; i < dispatcher.maxAttempts; i++ {
+		time.Sleep(time.Millisecond)
+		claimed, err := dispatcher.DispatchOnce()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, claimed)
+	}
+	notifications, err := store.OrderNotifications(order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, notifications, 1) {
+		assert.Equal(t, NotificationFailed, notifications[0].Status)
+		assert.Equal(t, dispatcher.maxAttempts, notifications[0].Attempts)
+		assert.Equal(t, "invalid phone number", notifications[0].LastError)
+	}
+	time.Sleep(time.Millisecond)
+	claimed, err := dispatcher.DispatchOnce()
+	assert.NoError(t, err)
+	assert.Zero(t, claimed)
+}
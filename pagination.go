@@ -0,0 +1,111 @@
+package savannah
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+// itemSorts maps the accepted sort keys onto their items column. A leading
+// "-" on the key flips the order to descending.
+var itemSorts = map[string]string{
+	"id":    "id",
+	"price": "price",
+	"name":  "name",
+}
+
+// itemCursor is the sort key of the last item on a page. Pages are keyset
+// paginated on (sort column, id) so inserts don't shift later pages.
+type itemCursor struct {
+	ID    int    `json:"id"`
+	Price int64  `json:"price,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
+
+// parseSort returns the sort key without its direction prefix.
+func parseSort(sort string, allowed map[string]string) (key string, desc bool, err error) {
+	if sort == "" {
+		return "id", false, nil
+	}
+	key = strings.TrimPrefix(sort, "-")
+	if _, ok := allowed[key]; !ok {
+		return "", false, ErrInvalidSort
+	}
+	return key, strings.HasPrefix(sort, "-"), nil
+}
+
+func encodeCursor(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// escapeLike quotes the LIKE wildcards in a user supplied substring.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func newItemCursor(item Item) itemCursor {
+	return itemCursor{ID: item.ID, Price: item.Price.Amount, Name: item.Name}
+}
+
+func (c itemCursor) value(key string) interface{} {
+	switch key {
+	case "price":
+		return c.Price
+	case "name":
+		return c.Name
+	}
+	return c.ID
+}
+
+// orderCursor is the last order on a page. Orders are listed newest first,
+// keyset paginated on (time, id).
+type orderCursor struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+func newOrderCursor(order Orders) orderCursor {
+	return orderCursor{ID: order.ID, Time: order.Time}
+}
+
+// before reports whether c sorts before o, i.e. is newer.
+func (c orderCursor) before(o orderCursor) bool {
+	if !c.Time.Equal(o.Time) {
+		return c.Time.After(o.Time)
+	}
+	return c.ID > o.ID
+}
@@ -0,0 +1,274 @@
+package savannah
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// PaymentStatus is where an order, or one attempt at paying for it, is with
+// its payment. Only orders are ever unpaid; a payment starts out pending
+// and is paid or failed once the provider reports back.
+type PaymentStatus string
+
+const (
+	PaymentUnpaid  PaymentStatus = "unpaid"
+	PaymentPending PaymentStatus = "pending"
+	PaymentPaid    PaymentStatus = "paid"
+	PaymentFailed  PaymentStatus = "failed"
+)
+
+// Payment is one attempt at paying for an order through a PaymentProvider.
+type Payment struct {
+	ID       int    `json:"id"`
+	OrderID  int    `json:"order_id"`
+	Provider string `json:"provider"`
+	// Phone is who is asked to pay, as the customer gave it
+	Phone  string        `json:"phone"`
+	Amount Money         `json:"amount"`
+	Status PaymentStatus `json:"status"`
+	// Reference is the provider's id for the payment, the CheckoutRequestID
+	// for M-Pesa
+	Reference     string    `json:"reference,omitempty"`
+	Receipt       string    `json:"receipt,omitempty"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PaymentResult is what a provider's callback says became of a payment.
+type PaymentResult struct {
+	Reference string
+	Paid      bool
+	Receipt   string
+	// Amount is what the provider says was paid, nil when it doesn't say
+	Amount *Money
+	// Reason is why the payment failed
+	Reason string
+}
+
+// PaymentProvider takes payments for orders and refunds them. Round is
+// what the provider actually charges when asked for amount. Initiate
+// asks the customer to pay and returns the provider's reference for the
+// request; the provider later reports the outcome to the payment callback
+// route, whose requests ParseCallback reads. Query asks the provider
+// directly what became of a payment, failing when it can't tell yet.
+// Refunds work the same way through Refund and the refund callback route.
+type PaymentProvider interface {
+	Name() string
+	Round(amount Money) Money
+	Initiate(payment Payment) (reference string, err error)
+	ParseCallback(r *http.Request) (*PaymentResult, error)
+	Query(payment Payment) (*PaymentResult, error)
+	Refund(payment Payment, refund Refund) (reference string, err error)
+	ParseRefundCallback(r *http.Request) (*RefundResult, error)
+}
+
+// PaymentError is returned when the provider turns down a payment request.
+// The attempt is kept, failed, with the reason.
+type PaymentError struct {
+	Provider string
+	Err      error
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Provider, e.Err)
+}
+
+func (e *PaymentError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	ErrAlreadyPaid    = errors.New("the order has already been paid for")
+	ErrPaymentPending = errors.New("a payment for the order is already in progress")
+	ErrNotPayable     = errors.New("the order has nothing to pay for or was cancelled")
+	ErrAmountMismatch = errors.New("the amount paid doesn't match the payment")
+)
+
+// paymentTimeout is how long a payment may stay pending before the customer
+// can start another one. M-Pesa prompts expire after about a minute, so a
+// payment that hasn't been heard back from by then most likely never will.
+const paymentTimeout = 3 * time.Minute
+
+// StartPayment asks the customer to pay for the order from phone. The
+// payment is for the order's total as the provider rounds it, which is
+// what the customer is charged. The provider is asked what became of a
+// pending payment that has timed out before another is started, so the
+// customer isn't charged twice: one that went through fails with
+// ErrAlreadyPaid, and while the provider can't tell, ErrPaymentPending.
+func (s Service) StartPayment(order *Orders, phone string) (*Payment, error) {
+	if order.Status == StatusCancelled || order.Total.Amount <= 0 {
+		return nil, ErrNotPayable
+	}
+	if order.PaymentStatus == PaymentPaid {
+		return nil, ErrAlreadyPaid
+	}
+	payments, err := s.service.OrderPayments(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		if payment.Status != PaymentPending || time.Since(payment.CreatedAt) <= paymentTimeout {
+			continue
+		}
+		if payment.Reference == "" {
+			// the provider never took the request, there's nothing to ask about
+			_, err := s.service.SettlePayment(payment.ID, PaymentFailed, "", "timed out", nil)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			continue
+		}
+		result, err := s.payments.Query(payment)
+		if err != nil {
+			log.Printf("order %d: asking about payment %d: %v", order.ID, payment.ID, err)
+			return nil, ErrPaymentPending
+		}
+		settled, err := s.SettlePayment(*result)
+		if err != nil {
+			return nil, err
+		}
+		if settled.Status == PaymentPaid {
+			return nil, ErrAlreadyPaid
+		}
+	}
+
+	payment, err := s.service.CreatePayment(Payment{
+		OrderID:  order.ID,
+		Provider: s.payments.Name(),
+		Phone:    phone,
+		Amount:   s.payments.Round(order.Total),
+	})
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return nil, ErrPaymentPending
+		}
+		if err == sql.ErrNoRows {
+			return nil, ErrAlreadyPaid
+		}
+		return nil, err
+	}
+	reference, err := s.payments.Initiate(*payment)
+	if err != nil {
+		if _, err := s.service.SettlePayment(payment.ID, PaymentFailed, "", err.Error(), nil); err != nil {
+			return nil, err
+		}
+		return nil, &PaymentError{Provider: payment.Provider, Err: err}
+	}
+	if err := s.service.SetPaymentReference(payment.ID, reference); err != nil {
+		return nil, err
+	}
+	payment.Reference = reference
+	return payment, nil
+}
+
+// SettlePayment records the outcome a provider reported for a payment and
+// moves its order to paid or failed. A paid order gets an SMS receipt.
+// Providers may report more than once, outcomes for payments that were
+// already settled are ignored unless they turn a failed payment into a paid
+// one. A payment reported paid for another amount than it was for fails
+// with ErrAmountMismatch and is left as it is. Payments that go through for
+// an order that was cancelled or already paid for, e.g. a late callback for
+// an attempt that was given up on, are refunded straight away.
+func (s Service) SettlePayment(result PaymentResult) (*Payment, error) {
+	payment, err := s.service.FindPaymentByReference(s.payments.Name(), result.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if result.Paid && result.Amount != nil && *result.Amount != payment.Amount {
+		return nil, ErrAmountMismatch
+	}
+	status := PaymentFailed
+	var notification *Notification
+	if result.Paid {
+		status = PaymentPaid
+		message := fmt.Sprintf("We have received your payment of %s for order #%d, receipt %s. Thank you!", payment.Amount, payment.OrderID, result.Receipt)
+		if result.Receipt == "" {
+			message = fmt.Sprintf("We have received your payment of %s for order #%d. Thank you!", payment.Amount, payment.OrderID)
+		}
+		notification = &Notification{Recipient: payment.Phone, Message: message}
+	}
+	refund, err := s.service.SettlePayment(payment.ID, status, result.Receipt, result.Reason, notification)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if refund != nil {
+		// the refund is recorded either way, one the provider turns down
+		// is left failed for an admin to deal with
+		log.Printf("order %d: payment %d went through but %s, refunding it", payment.OrderID, payment.ID, refund.Reason)
+		if _, err := s.sendRefund(refund, *payment); err != nil {
+			log.Printf("order %d: refunding payment %d: %v", payment.OrderID, payment.ID, err)
+		}
+	}
+	// settled already, or just now, report it as it is
+	return s.service.FindPaymentByReference(payment.Provider, payment.Reference)
+}
+
+// FakePaymentProvider takes payments without contacting anyone, for
+// development and tests. Payments are settled by posting
+// {"reference": "...", "paid": true} to its callback route, refunds by
+// posting {"reference": "...", "completed": true} to its refund callback
+// route.
+type FakePaymentProvider struct{}
+
+func (FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (FakePaymentProvider) Round(amount Money) Money {
+	return amount
+}
+
+func (FakePaymentProvider) Initiate(payment Payment) (string, error) {
+	if payment.Phone == "" {
+		return "", errors.New("no phone number to ask for payment")
+	}
+	return "FAKE-" + Generate(12, couponAlphabet), nil
+}
+
+func (FakePaymentProvider) ParseCallback(r *http.Request) (*PaymentResult, error) {
+	var body struct {
+		Reference string `json:"reference"`
+		Paid      bool   `json:"paid"`
+		Receipt   string `json:"receipt"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Reference == "" {
+		return nil, errors.New("reference is required")
+	}
+	return &PaymentResult{Reference: body.Reference, Paid: body.Paid, Receipt: body.Receipt, Reason: body.Reason}, nil
+}
+
+// Query reports pending payments as failed, the fake provider only hears
+// about payments through its callback route.
+func (FakePaymentProvider) Query(payment Payment) (*PaymentResult, error) {
+	return &PaymentResult{Reference: payment.Reference, Reason: "timed out"}, nil
+}
+
+func (FakePaymentProvider) Refund(payment Payment, refund Refund) (string, error) {
+	return "FAKE-" + Generate(12, couponAlphabet), nil
+}
+
+func (FakePaymentProvider) ParseRefundCallback(r *http.Request) (*RefundResult, error) {
+	var body struct {
+		Reference string `json:"reference"`
+		Completed bool   `json:"completed"`
+		Receipt   string `json:"receipt"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Reference == "" {
+		return nil, errors.New("reference is required")
+	}
+	return &RefundResult{Reference: body.Reference, Completed: body.Completed, Receipt: body.Receipt, Reason: body.Reason}, nil
+}
@@ -0,0 +1,213 @@
+package savannah
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decliningProvider turns down every payment request.
+type decliningProvider struct {
+	FakePaymentProvider
+}
+
+func (decliningProvider) Initiate(payment Payment) (string, error) {
+	return "", errors.New("insufficient funds")
+}
+
+// shillingProvider rounds up to the shilling the way M-Pesa does.
+type shillingProvider struct {
+	FakePaymentProvider
+}
+
+func (shillingProvider) Round(amount Money) Money {
+	return (&MpesaProvider{}).Round(amount)
+}
+
+// queryingProvider answers queries about payments with what's in results,
+// and fails for payments it has nothing on.
+type queryingProvider struct {
+	FakePaymentProvider
+	results map[string]PaymentResult
+}
+
+func (p queryingProvider) Query(payment Payment) (*PaymentResult, error) {
+	result, ok := p.results[payment.Reference]
+	if !ok {
+		return nil, errors.New("the transaction is being processed")
+	}
+	return &result, nil
+}
+
+func newPaymentOrder(t *testing.T, service Service) *Orders {
+	store := service.service
+	item, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 10})
+	assert.NoError(t, err)
+	order, err := store.CreateOrders(priced(t, store, Orders{UserId: 1, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}), nil)
+	assert.NoError(t, err)
+	return order
+}
+
+func TestService_Payment(t *testing.T) {
+	service := NewMockService()
+	store := service.service.(*MockInMemDB)
+	order := newPaymentOrder(t, service)
+	assert.Equal(t, PaymentUnpaid, order.PaymentStatus)
+
+	payment, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPending, payment.Status)
+	assert.Equal(t, order.Total, payment.Amount)
+	assert.NotEmpty(t, payment.Reference)
+	_, err = service.StartPayment(order, order.Contact)
+	assert.Equal(t, ErrPaymentPending, err)
+
+	short := NewMoney(100, "KES")
+	_, err = service.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true, Receipt: "QKJ4ABC123", Amount: &short})
+	assert.Equal(t, ErrAmountMismatch, err)
+	settled, err := service.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true, Receipt: "QKJ4ABC123", Amount: &order.Total})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, settled.Status)
+	assert.Equal(t, "QKJ4ABC123", settled.Receipt)
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, order.PaymentStatus)
+	notifications, err := store.OrderNotifications(order.ID)
+	assert.NoError(t, err)
+	assert.Len(t, notifications, 1)
+	assert.Contains(t, notifications[0].Message, "QKJ4ABC123")
+
+	// providers may call back more than once
+	settled, err = service.SettlePayment(PaymentResult{Reference: payment.Reference, Reason: "cancelled"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, settled.Status)
+	_, err = service.StartPayment(order, order.Contact)
+	assert.Equal(t, ErrAlreadyPaid, err)
+}
+
+func TestService_Payment_Failed(t *testing.T) {
+	service := NewMockService()
+	store := service.service.(*MockInMemDB)
+	order := newPaymentOrder(t, service)
+
+	service.payments = decliningProvider{}
+	_, err := service.StartPayment(order, order.Contact)
+	var declined *PaymentError
+	assert.True(t, errors.As(err, &declined))
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentFailed, order.PaymentStatus)
+
+	// the customer can try again, and a prompt that's never answered
+	// times out
+	service.payments = FakePaymentProvider{}
+	first, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	stale := store.Payments[first.ID]
+	stale.CreatedAt = time.Now().Add(-paymentTimeout - time.Minute)
+	store.Payments[first.ID] = stale
+	second, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+
+	settled, err := service.SettlePayment(PaymentResult{Reference: second.Reference, Reason: "Request cancelled by user"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentFailed, settled.Status)
+	assert.Equal(t, "Request cancelled by user", settled.FailureReason)
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentFailed, order.PaymentStatus)
+
+	// the timed out payment went through after all
+	settled, err = service.SettlePayment(PaymentResult{Reference: first.Reference, Paid: true, Receipt: "QKJ4ABC124"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, settled.Status)
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, order.PaymentStatus)
+
+	payments, err := store.OrderPayments(order.ID)
+	assert.NoError(t, err)
+	assert.Len(t, payments, 3)
+	assert.Equal(t, second.ID, payments[0].ID)
+}
+
+func TestService_Payment_TimedOut(t *testing.T) {
+	service := NewMockService()
+	store := service.service.(*MockInMemDB)
+	order := newPaymentOrder(t, service)
+	expire := func(payment *Payment) {
+		stale := store.Payments[payment.ID]
+		stale.CreatedAt = time.Now().Add(-paymentTimeout - time.Minute)
+		store.Payments[payment.ID] = stale
+	}
+	provider := queryingProvider{results: map[string]PaymentResult{}}
+	service.payments = provider
+
+	// the provider can't tell yet, so the customer waits
+	first, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	expire(first)
+	_, err = service.StartPayment(order, order.Contact)
+	assert.Equal(t, ErrPaymentPending, err)
+
+	// the customer didn't answer the prompt
+	provider.results[first.Reference] = PaymentResult{Reference: first.Reference, Reason: "Request cancelled by user"}
+	second, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentFailed, store.Payments[first.ID].Status)
+	assert.Equal(t, "Request cancelled by user", store.Payments[first.ID].FailureReason)
+
+	// the customer paid but the callback never came
+	expire(second)
+	provider.results[second.Reference] = PaymentResult{Reference: second.Reference, Paid: true}
+	_, err = service.StartPayment(order, order.Contact)
+	assert.Equal(t, ErrAlreadyPaid, err)
+	assert.Equal(t, PaymentPaid, store.Payments[second.ID].Status)
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, order.PaymentStatus)
+	payments, err := store.OrderPayments(order.ID)
+	assert.NoError(t, err)
+	assert.Len(t, payments, 2)
+}
+
+func TestService_Payment_NotPayable(t *testing.T) {
+	service := NewMockService()
+	order := newPaymentOrder(t, service)
+	_, err := service.TransitionOrder(order.ID, StatusCancelled, "john@example.com", "ordered twice", nil)
+	assert.NoError(t, err)
+	order, err = service.service.FindOrders(order.ID)
+	assert.NoError(t, err)
+	_, err = service.StartPayment(order, order.Contact)
+	assert.Equal(t, ErrNotPayable, err)
+}
+
+func TestService_Payment_Rounded(t *testing.T) {
+	service := NewMockService()
+	service.payments = shillingProvider{}
+	store := service.service
+	item, err := store.CreateItem(Item{Price: NewMoney(12550, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 10})
+	assert.NoError(t, err)
+	order, err := store.CreateOrders(priced(t, store, Orders{UserId: 1, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}), nil)
+	assert.NoError(t, err)
+
+	// the payment is for what the customer is actually charged
+	payment, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(12600, "KES"), payment.Amount)
+	payments, err := store.OrderPayments(order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(12600, "KES"), payments[0].Amount)
+}
+
+func TestFakePaymentProvider_ParseCallback(t *testing.T) {
+	r, err := http.NewRequest("POST", "/payments/fake/callback", strings.NewReader(`{"reference": "FAKE-1", "paid": true}`))
+	assert.NoError(t, err)
+	result, err := FakePaymentProvider{}.ParseCallback(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &PaymentResult{Reference: "FAKE-1", Paid: true}, result)
+}
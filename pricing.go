@@ -0,0 +1,172 @@
+package savannah
+
+import "errors"
+
+// ErrPriceChanged is returned when an item's price changed between pricing
+// an order and placing it.
+var ErrPriceChanged = errors.New("prices changed while ordering, please review the new total")
+
+// ErrSubtotalMismatch is returned when the lines of an order don't add up
+// to its subtotal.
+var ErrSubtotalMismatch = errors.New("the order lines don't add up to its subtotal")
+
+// Pricing holds the store-wide settings order totals are worked out with.
+type Pricing struct {
+	// VAT rate in basis points, 1600 is 16%
+	VATRate int
+	// whether catalog prices already include VAT
+	VATInclusive bool
+	// charged once per order
+	DeliveryFee Money
+}
+
+// Breakdown is how an order's total was arrived at. Amounts are in the
+// order's currency.
+type Breakdown struct {
+	Subtotal     Money `json:"subtotal"`
+	Discount     Money `json:"discount"`
+	DeliveryFee  Money `json:"delivery_fee"`
+	Tax          Money `json:"tax"`
+	TaxRate      int   `json:"tax_rate"`
+	TaxInclusive bool  `json:"tax_inclusive"`
+	Total        Money `json:"total"`
+}
+
+// Discount takes Percent (in basis points) of the subtotal off an order, or
+// a fixed Amount when Percent is zero.
+type Discount struct {
+	Percent int
+	Amount  Money
+}
+
+// Quote is a priced basket that hasn't been ordered.
+type Quote struct {
+	Lines      []OrderLine `json:"lines"`
+	Breakdown  Breakdown   `json:"breakdown"`
+	CouponCode string      `json:"coupon_code,omitempty"`
+	// DeliveryZoneID is the zone the delivery location is in
+	DeliveryZoneID *int `json:"delivery_zone_id,omitempty"`
+}
+
+// Total works out the breakdown of an order for priced lines. Discounts
+// come off the subtotal and never take it below zero, the delivery fee is
+// added after them and VAT is charged on the result. With VATInclusive the
+// VAT is already part of the prices and only reported.
+func (p Pricing) Total(lines []OrderLine, discounts ...Discount) (Breakdown, error) {
+	subtotal, err := orderTotal(lines)
+	if err != nil {
+		return Breakdown{}, err
+	}
+	currency := subtotal.Currency
+	b := Breakdown{
+		Subtotal:     subtotal,
+		Discount:     Money{Currency: currency},
+		DeliveryFee:  Money{Currency: currency},
+		TaxRate:      p.VATRate,
+		TaxInclusive: p.VATInclusive,
+	}
+	for _, discount := range discounts {
+		amount := discount.Amount
+		if discount.Percent > 0 {
+			amount = Money{Amount: divRound(subtotal.Amount*int64(discount.Percent), 10000), Currency: currency}
+		}
+		if amount.Amount != 0 && amount.Currency != currency {
+			return Breakdown{}, ErrCurrencyMismatch
+		}
+		b.Discount.Amount += amount.Amount
+	}
+	if b.Discount.Amount > subtotal.Amount {
+		b.Discount.Amount = subtotal.Amount
+	}
+	if p.DeliveryFee.Amount != 0 {
+		if p.DeliveryFee.Currency != currency {
+			return Breakdown{}, ErrCurrencyMismatch
+		}
+		b.DeliveryFee.Amount = p.DeliveryFee.Amount
+	}
+
+	net := subtotal.Amount - b.Discount.Amount + b.DeliveryFee.Amount
+	rate := int64(p.VATRate)
+	if p.VATInclusive {
+		b.Tax = Money{Amount: divRound(net*rate, 10000+rate), Currency: currency}
+		b.Total = Money{Amount: net, Currency: currency}
+	} else {
+		b.Tax = Money{Amount: divRound(net*rate, 10000), Currency: currency}
+		b.Total = Money{Amount: net + b.Tax.Amount, Currency: currency}
+	}
+	return b, nil
+}
+
+// divRound divides non-negative a by b, rounding halves up.
+func divRound(a, b int64) int64 {
+	return (2*a + b) / (2 * b)
+}
+
+// PriceOrder prices the order's lines at the current catalog prices and
+// works out its breakdown, with the discount of its coupon if it has one
+// and the fee of the delivery zone its delivery location is in.
+// CreateOrders fails with ErrPriceChanged if a price changes before the
+// order is placed. Coupons that can't be used fail with a *CouponError,
+// locations no zone delivers to with a *DeliveryError, and so do orders
+// without a location once any delivery zone is set up.
+func (s Service) PriceOrder(order *Orders) error {
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		if line.VariantID != nil {
+			variant, err := s.service.FindVariant(*line.VariantID)
+			if err != nil {
+				return err
+			}
+			line.UnitPrice = variant.Price
+		} else {
+			item, err := s.service.FindItem(line.ItemID)
+			if err != nil {
+				return err
+			}
+			line.UnitPrice = item.Price
+		}
+		line.LineTotal = line.UnitPrice.Mul(line.Qty)
+	}
+	var discounts []Discount
+	order.CouponID = nil
+	if order.CouponCode != "" {
+		subtotal, err := orderTotal(order.Lines)
+		if err != nil {
+			return err
+		}
+		discount, err := s.couponDiscount(order, subtotal)
+		if err != nil {
+			return err
+		}
+		discounts = append(discounts, discount)
+	}
+	pricing := s.pricing
+	order.DeliveryZoneID = nil
+	if order.DeliveryLocation != nil {
+		subtotal, err := orderTotal(order.Lines)
+		if err != nil {
+			return err
+		}
+		zone, err := s.deliveryZone(*order.DeliveryLocation, subtotal)
+		if err != nil {
+			return err
+		}
+		order.DeliveryZoneID = &zone.ID
+		pricing.DeliveryFee = zone.Fee(subtotal)
+	} else {
+		// the flat fee is only for stores that haven't set up zones
+		zones, err := s.service.ListDeliveryZones()
+		if err != nil {
+			return err
+		}
+		if len(zones) > 0 {
+			return &DeliveryError{Reason: "a delivery location is required"}
+		}
+	}
+	breakdown, err := pricing.Total(order.Lines, discounts...)
+	if err != nil {
+		return err
+	}
+	order.Breakdown, order.Total = breakdown, breakdown.Total
+	return nil
+}
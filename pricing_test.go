@@ -0,0 +1,68 @@
+package savannah
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPricing_Total(t *testing.T) {
+	lines := []OrderLine{
+		{Qty: 2, LineTotal: NewMoney(50000, "KES")},
+		{Qty: 1, LineTotal: NewMoney(20000, "KES")},
+	}
+
+	exclusive := Pricing{VATRate: 1600, DeliveryFee: NewMoney(10000, "KES")}
+	b, err := exclusive.Total(lines, Discount{Percent: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(70000, "KES"), b.Subtotal)
+	assert.Equal(t, NewMoney(7000, "KES"), b.Discount)
+	assert.Equal(t, NewMoney(10000, "KES"), b.DeliveryFee)
+	assert.Equal(t, NewMoney(11680, "KES"), b.Tax)
+	assert.Equal(t, NewMoney(84680, "KES"), b.Total)
+
+	inclusive := Pricing{VATRate: 1600, VATInclusive: true}
+	b, err = inclusive.Total(lines, Discount{Amount: NewMoney(12000, "KES")})
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(58000, "KES"), b.Total)
+	// 58000 * 16 / 116
+	assert.Equal(t, NewMoney(8000, "KES"), b.Tax)
+	assert.True(t, b.TaxInclusive)
+
+	// discounts can't take the subtotal below zero
+	b, err = Pricing{}.Total(lines, Discount{Amount: NewMoney(100000, "KES")})
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(70000, "KES"), b.Discount)
+	assert.Equal(t, NewMoney(0, "KES"), b.Total)
+
+	_, err = exclusive.Total([]OrderLine{{Qty: 1, LineTotal: NewMoney(500, "USD")}})
+	assert.Equal(t, ErrCurrencyMismatch, err)
+}
+
+func TestService_PriceOrder(t *testing.T) {
+	service := NewMockService()
+	service.pricing = Pricing{VATRate: 1600, VATInclusive: true}
+	item, err := service.service.CreateItem(Item{Price: NewMoney(11600, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	order := Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 2}}, Time: time.Now()}
+	assert.NoError(t, service.PriceOrder(&order))
+	assert.Equal(t, NewMoney(23200, "KES"), order.Total)
+	assert.Equal(t, NewMoney(3200, "KES"), order.Breakdown.Tax)
+
+	// the price went up after the order was priced
+	item.Price = NewMoney(12000, "KES")
+	assert.NoError(t, service.service.UpdateItem(*item))
+	_, err = service.service.CreateOrders(order, nil)
+	assert.Equal(t, ErrPriceChanged, err)
+	found, err := service.service.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, found.Stock)
+
+	assert.NoError(t, service.PriceOrder(&order))
+	created, err := service.service.CreateOrders(order, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, order.Breakdown, created.Breakdown)
+	assert.Equal(t, NewMoney(24000, "KES"), created.Total)
+}
@@ -2,14 +2,21 @@ package savannah
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
 var seededRand *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
+// seededRand isn't safe for concurrent use, handlers generate codes at the
+// same time
+var randMu sync.Mutex
+
 const char = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz01233456789"
 
 func Generate(size int, char string) string {
+	randMu.Lock()
+	defer randMu.Unlock()
 	b := make([]byte, size)
 	for i := range b {
 		b[i] = char[seededRand.Intn(len(char))]
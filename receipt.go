@@ -0,0 +1,233 @@
+package savannah
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+)
+
+// ErrNoReceipt is returned for orders that haven't been paid for, only
+// paid orders get receipts.
+var ErrNoReceipt = errors.New("receipts are only issued for paid orders")
+
+// Business is who issues receipts, as configured with the BUSINESS
+// variables.
+type Business struct {
+	Name    string
+	Address string
+	Phone   string
+	Email   string
+	// TaxPIN is the KRA PIN printed on receipts
+	TaxPIN string
+}
+
+// Receipt is what a receipt for a paid order shows.
+type Receipt struct {
+	// Number is the same every time the receipt is downloaded
+	Number   string
+	Business Business
+	Order    *Orders
+	Email    string
+	Lines    []ReceiptLine
+	// Payment is the payment that paid for the order
+	Payment Payment
+}
+
+// ReceiptLine is an order line with the name of what was bought.
+type ReceiptLine struct {
+	Name string
+	OrderLine
+}
+
+// receiptNumber is derived from the order alone, so a receipt keeps its
+// number however often it's downloaded.
+func receiptNumber(order *Orders) string {
+	return fmt.Sprintf("R%s-%06d", order.Time.Format("200601"), order.ID)
+}
+
+// Receipt gathers what goes on the receipt for a paid order, issued by
+// business. Unpaid orders fail with ErrNoReceipt.
+func (s Service) Receipt(order *Orders, business Business) (*Receipt, error) {
+	if order.PaymentStatus != PaymentPaid {
+		return nil, ErrNoReceipt
+	}
+	receipt := Receipt{Number: receiptNumber(order), Business: business, Order: order}
+	payments, err := s.service.OrderPayments(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := s.service.OrderRefunds(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	surplus := make(map[int]bool)
+	for _, refund := range refunds {
+		if refund.Actor == surplusActor {
+			surplus[refund.PaymentID] = true
+		}
+	}
+	// the payment that went through and was kept, others are refunded
+	for _, payment := range payments {
+		if payment.Status == PaymentPaid && !surplus[payment.ID] {
+			receipt.Payment = payment
+		}
+	}
+	user, err := s.service.FindUserIncludingArchived(order.UserId)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if user != nil {
+		receipt.Email = user.Email
+	}
+	for _, line := range order.Lines {
+		item, err := s.service.FindItemIncludingArchived(line.ItemID)
+		if err != nil {
+			return nil, err
+		}
+		name := item.Name
+		if line.VariantID != nil {
+			// variants that were deleted since are listed as their item
+			variant, err := s.service.FindVariant(*line.VariantID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if variant != nil {
+				name = fmt.Sprintf("%s (%s)", item.Name, variant.Name)
+			}
+		}
+		receipt.Lines = append(receipt.Lines, ReceiptLine{Name: name, OrderLine: line})
+	}
+	return &receipt, nil
+}
+
+// Time is when the order was placed, in Nairobi time.
+func (r *Receipt) Time() string {
+	return r.Order.Time.In(mpesaTime).Format("2 Jan 2006 15:04")
+}
+
+// TaxLabel describes the VAT line, e.g. "VAT 16% (included)".
+func (r *Receipt) TaxLabel() string {
+	b := r.Order.Breakdown
+	label := "VAT " + formatRate(b.TaxRate)
+	if b.TaxInclusive {
+		label += " (included)"
+	}
+	return label
+}
+
+// formatRate writes a rate in basis points as a percentage, e.g. 16% or
+// 7.5%.
+func formatRate(basisPoints int) string {
+	if basisPoints%100 == 0 {
+		return fmt.Sprintf("%d%%", basisPoints/100)
+	}
+	return fmt.Sprintf("%s%%", trimZeros(fmt.Sprintf("%.2f", float64(basisPoints)/100)))
+}
+
+func trimZeros(s string) string {
+	for s[len(s)-1] == '0' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Receipt {{.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; max-width: 40em; margin: 2em auto; color: #222; }
+table { width: 100%; border-collapse: collapse; }
+th, td { padding: 0.3em 0; text-align: left; }
+.amount { text-align: right; }
+.total td { border-top: 1px solid #222; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.Business.Name}}</h1>
+<p>{{with .Business.Address}}{{.}}<br>{{end}}{{with .Business.Phone}}{{.}}<br>{{end}}{{with .Business.Email}}{{.}}<br>{{end}}{{with .Business.TaxPIN}}PIN: {{.}}{{end}}</p>
+<h2>Receipt {{.Number}}</h2>
+<p>Order #{{.Order.ID}}, placed {{.Time}}<br>
+{{with .Email}}Customer: {{.}}<br>{{end}}
+{{with .Payment.Receipt}}Paid by {{$.Payment.Provider}}, reference {{.}}{{end}}</p>
+<table>
+<tr><th>Item</th><th class="amount">Qty</th><th class="amount">Unit price</th><th class="amount">Amount</th></tr>
+{{range .Lines}}<tr><td>{{.Name}}</td><td class="amount">{{.Qty}}</td><td class="amount">{{.UnitPrice}}</td><td class="amount">{{.LineTotal}}</td></tr>
+{{end}}
+{{with .Order.Breakdown}}<tr><td colspan="3">Subtotal</td><td class="amount">{{.Subtotal}}</td></tr>
+{{if .Discount.Amount}}<tr><td colspan="3">Discount</td><td class="amount">-{{.Discount}}</td></tr>{{end}}
+{{if .DeliveryFee.Amount}}<tr><td colspan="3">Delivery</td><td class="amount">{{.DeliveryFee}}</td></tr>{{end}}
+<tr><td colspan="3">{{$.TaxLabel}}</td><td class="amount">{{.Tax}}</td></tr>
+<tr class="total"><td colspan="3">Total</td><td class="amount">{{.Total}}</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// HTML writes the receipt as a web page.
+func (r *Receipt) HTML(w io.Writer) error {
+	return receiptTemplate.Execute(w, r)
+}
+
+// PDF writes the receipt as a single A4 page, or more for long orders.
+func (r *Receipt) PDF(w io.Writer) error {
+	doc := newPDF()
+	page := doc.addPage()
+	y := float64(pdfTop)
+	line := func(size float64, bold bool, text string) {
+		if y < pdfBottom {
+			page, y = doc.addPage(), float64(pdfTop)
+		}
+		page.text(pdfLeft, y, size, bold, text)
+		y -= size * 1.5
+	}
+	row := func(bold bool, name, qty, unit, amount string) {
+		if y < pdfBottom {
+			page, y = doc.addPage(), float64(pdfTop)
+		}
+		page.text(pdfLeft, y, 10, bold, pdfTruncate(name, 10, bold, 250))
+		page.textRight(pdfLeft+330, y, 10, bold, qty)
+		page.textRight(pdfLeft+420, y, 10, bold, unit)
+		page.textRight(pdfRight, y, 10, bold, amount)
+		y -= 15
+	}
+
+	line(18, true, r.Business.Name)
+	for _, detail := range []string{r.Business.Address, r.Business.Phone, r.Business.Email} {
+		if detail != "" {
+			line(10, false, detail)
+		}
+	}
+	if r.Business.TaxPIN != "" {
+		line(10, false, "PIN: "+r.Business.TaxPIN)
+	}
+	y -= 10
+	line(14, true, "Receipt "+r.Number)
+	line(10, false, fmt.Sprintf("Order #%d, placed %s", r.Order.ID, r.Time()))
+	if r.Email != "" {
+		line(10, false, "Customer: "+r.Email)
+	}
+	if r.Payment.Receipt != "" {
+		line(10, false, fmt.Sprintf("Paid by %s, reference %s", r.Payment.Provider, r.Payment.Receipt))
+	}
+	y -= 10
+	row(true, "Item", "Qty", "Unit price", "Amount")
+	for _, l := range r.Lines {
+		row(false, l.Name, fmt.Sprint(l.Qty), l.UnitPrice.String(), l.LineTotal.String())
+	}
+	y -= 5
+	b := r.Order.Breakdown
+	row(false, "Subtotal", "", "", b.Subtotal.String())
+	if b.Discount.Amount != 0 {
+		row(false, "Discount", "", "", "-"+b.Discount.String())
+	}
+	if b.DeliveryFee.Amount != 0 {
+		row(false, "Delivery", "", "", b.DeliveryFee.String())
+	}
+	row(false, r.TaxLabel(), "", "", b.Tax.String())
+	row(true, "Total", "", "", b.Total.String())
+	return doc.write(w)
+}
@@ -0,0 +1,75 @@
+package savannah
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Receipt(t *testing.T) {
+	service := NewMockService()
+	store := service.service
+	user, err := store.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	business := Business{Name: "Savannah Ltd", Address: "Moi Avenue, Nairobi", TaxPIN: "P051234567X"}
+	item, err := store.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 10})
+	assert.NoError(t, err)
+	order, err := store.CreateOrders(priced(t, store, Orders{UserId: user.ID, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}), nil)
+	assert.NoError(t, err)
+
+	_, err = service.Receipt(order, business)
+	assert.Equal(t, ErrNoReceipt, err)
+
+	payment, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	_, err = service.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true, Receipt: "QKJ4ABC123"})
+	assert.NoError(t, err)
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	receipt, err := service.Receipt(order, business)
+	assert.NoError(t, err)
+	assert.Equal(t, "john@example.com", receipt.Email)
+	assert.Equal(t, "QKJ4ABC123", receipt.Payment.Receipt)
+	assert.Len(t, receipt.Lines, 1)
+	assert.Equal(t, "Tea", receipt.Lines[0].Name)
+	// downloading it again gives the same number
+	again, err := service.Receipt(order, business)
+	assert.NoError(t, err)
+	assert.Equal(t, receipt.Number, again.Number)
+
+	var html bytes.Buffer
+	assert.NoError(t, receipt.HTML(&html))
+	for _, want := range []string{"Savannah Ltd", "P051234567X", receipt.Number, "john@example.com", "Tea", "KSh 100.00", "VAT 0%"} {
+		assert.Contains(t, html.String(), want)
+	}
+
+	assert.Equal(t, "7.5%", formatRate(750))
+	assert.Equal(t, "16%", formatRate(1600))
+
+	var pdf bytes.Buffer
+	assert.NoError(t, receipt.PDF(&pdf))
+	assert.True(t, strings.HasPrefix(pdf.String(), "%PDF-1.4"))
+	assert.True(t, strings.HasSuffix(pdf.String(), "%%EOF\n"))
+	for _, want := range []string{"(Savannah Ltd)", "(Receipt " + receipt.Number + ")", "(KSh 100.00)", "/Count 1"} {
+		assert.Contains(t, pdf.String(), want)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	doc := newPDF()
+	for i := 0; i < 2; i++ {
+		doc.addPage().text(pdfLeft, pdfTop, 10, false, `Chai (½ kg) \ 100€`)
+	}
+	var out bytes.Buffer
+	assert.NoError(t, doc.write(&out))
+	assert.Contains(t, out.String(), "(Chai \\(\xbd kg\\) \\\\ 100\x80)")
+	assert.Contains(t, out.String(), "/Count 2")
+	assert.Contains(t, out.String(), "xref\n0 9\n")
+
+	assert.Equal(t, 5.56, pdfTextWidth("1", 10, false))
+	assert.Equal(t, "Chai ...", pdfTruncate("Chai masala from the highlands", 10, false, 35))
+	assert.Equal(t, "Chai", pdfTruncate("Chai", 10, false, 35))
+}
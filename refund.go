@@ -0,0 +1,194 @@
+package savannah
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RefundStatus is where a refund is with the provider. Refunds start out
+// pending and are completed or failed once the provider reports back.
+type RefundStatus string
+
+const (
+	RefundPending   RefundStatus = "pending"
+	RefundCompleted RefundStatus = "completed"
+	RefundFailed    RefundStatus = "failed"
+)
+
+// Refund pays back some or all of a payment to the customer.
+type Refund struct {
+	ID        int    `json:"id"`
+	OrderID   int    `json:"order_id"`
+	PaymentID int    `json:"payment_id"`
+	Provider  string `json:"provider"`
+	// Phone is who is refunded, the phone the payment came from
+	Phone  string       `json:"phone"`
+	Amount Money        `json:"amount"`
+	Reason string       `json:"reason"`
+	Status RefundStatus `json:"status"`
+	// Reference is the provider's id for the refund, the ConversationID of
+	// an M-Pesa B2C payment
+	Reference     string `json:"reference,omitempty"`
+	Receipt       string `json:"receipt,omitempty"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	// Actor is the email of the admin who refunded, or system for
+	// payments refunded because the order didn't need them
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RefundResult is what a provider's callback says became of a refund.
+type RefundResult struct {
+	Reference string
+	Completed bool
+	Receipt   string
+	// Reason is why the refund failed
+	Reason string
+}
+
+var (
+	ErrNotPaid        = errors.New("the order hasn't been paid for")
+	ErrRefundTooLarge = errors.New("the refund is more than what's left to refund of the payment")
+	ErrRefundAmount   = errors.New("the provider can't pay out that amount, M-Pesa only pays whole shillings")
+)
+
+// RefundOrder pays amount of the order back to the customer on behalf of
+// actor. It is refunded against one of the order's paid payments and
+// can't be more than what's left of what the payment took after earlier
+// refunds that didn't fail. Amounts the provider can't pay out exactly,
+// such as cents through M-Pesa, fail with ErrRefundAmount rather than
+// being rounded.
+func (s Service) RefundOrder(order *Orders, amount Money, reason, actor string) (*Refund, error) {
+	if amount.Currency != order.Total.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+	if s.payments.Round(amount) != amount {
+		return nil, ErrRefundAmount
+	}
+	payments, err := s.service.OrderPayments(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = ErrNotPaid
+	var refund *Refund
+	for _, payment := range payments {
+		if payment.Status != PaymentPaid {
+			continue
+		}
+		refund, err = s.service.CreateRefund(Refund{
+			OrderID:   order.ID,
+			PaymentID: payment.ID,
+			Provider:  payment.Provider,
+			Phone:     payment.Phone,
+			Amount:    amount,
+			Reason:    reason,
+			Actor:     actor,
+		})
+		if err == nil {
+			break
+		}
+		if err == sql.ErrNoRows {
+			err = ErrNotPaid
+		} else if err != ErrRefundTooLarge {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.sendRefund(refund, findPayment(payments, refund.PaymentID))
+}
+
+// sendRefund asks the provider to pay out a recorded refund of payment.
+func (s Service) sendRefund(refund *Refund, payment Payment) (*Refund, error) {
+	// payments are refunded by the provider that took them
+	if refund.Provider != s.payments.Name() {
+		err := fmt.Errorf("payment %d was taken by %s", refund.PaymentID, refund.Provider)
+		return nil, s.failRefund(refund, err)
+	}
+	reference, err := s.payments.Refund(payment, *refund)
+	if err != nil {
+		return nil, s.failRefund(refund, err)
+	}
+	if err := s.service.SetRefundReference(refund.ID, reference); err != nil {
+		return nil, err
+	}
+	refund.Reference = reference
+	return refund, nil
+}
+
+// surplusActor is the actor of refunds nobody asked for, of payments the
+// order didn't need.
+const surplusActor = "system"
+
+// surplusReason tells why a payment that went through isn't needed by its
+// order, or returns "" when it is.
+func surplusReason(status OrderStatus, paymentStatus PaymentStatus) string {
+	switch {
+	case status == StatusCancelled:
+		return "the order was cancelled"
+	case paymentStatus == PaymentPaid:
+		return "the order was already paid for"
+	}
+	return ""
+}
+
+// surplusRefund is the refund of all of a payment the order didn't need,
+// for the stores to record.
+func surplusRefund(payment Payment, reason string) *Refund {
+	return &Refund{
+		OrderID:   payment.OrderID,
+		PaymentID: payment.ID,
+		Provider:  payment.Provider,
+		Phone:     payment.Phone,
+		Amount:    payment.Amount,
+		Reason:    reason,
+		Actor:     surplusActor,
+	}
+}
+
+// failRefund records that the provider turned the refund down, so it
+// doesn't count against the payment, and returns the *PaymentError.
+func (s Service) failRefund(refund *Refund, err error) error {
+	if err := s.service.SettleRefund(refund.ID, RefundFailed, "", err.Error(), nil); err != nil {
+		return err
+	}
+	return &PaymentError{Provider: refund.Provider, Err: err}
+}
+
+func findPayment(payments []Payment, id int) Payment {
+	for _, payment := range payments {
+		if payment.ID == id {
+			return payment
+		}
+	}
+	return Payment{}
+}
+
+// SettleRefund records the outcome a provider reported for a refund and
+// lets the customer know by SMS when the money was sent. Outcomes for
+// refunds that were already settled are ignored.
+func (s Service) SettleRefund(result RefundResult) (*Refund, error) {
+	refund, err := s.service.FindRefundByReference(s.payments.Name(), result.Reference)
+	if err != nil {
+		return nil, err
+	}
+	status := RefundFailed
+	var notification *Notification
+	if result.Completed {
+		status = RefundCompleted
+		notification = &Notification{
+			Recipient: refund.Phone,
+			Message:   fmt.Sprintf("We have refunded %s for order #%d, receipt %s. Reason: %s.", refund.Amount, refund.OrderID, result.Receipt, refund.Reason),
+		}
+	}
+	err = s.service.SettleRefund(refund.ID, status, result.Receipt, result.Reason, notification)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return s.service.FindRefundByReference(refund.Provider, refund.Reference)
+}
@@ -0,0 +1,164 @@
+package savannah
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decliningRefunds takes payments but turns down every refund.
+type decliningRefunds struct {
+	FakePaymentProvider
+}
+
+func (decliningRefunds) Refund(payment Payment, refund Refund) (string, error) {
+	return "", errors.New("insufficient float")
+}
+
+// TestService_RefundOrder_Shillings refunds an order whose total has cents
+// through a provider that only pays whole shillings.
+func TestService_RefundOrder_Shillings(t *testing.T) {
+	service := NewMockService()
+	service.payments = shillingProvider{}
+	store := service.service
+	item, err := store.CreateItem(Item{Price: NewMoney(12550, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 10})
+	assert.NoError(t, err)
+	order, err := store.CreateOrders(priced(t, store, Orders{UserId: 1, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}), nil)
+	assert.NoError(t, err)
+	payment, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	_, err = service.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true, Receipt: "QKJ4ABC123"})
+	assert.NoError(t, err)
+
+	// never more than asked for, cents are turned down
+	_, err = service.RefundOrder(order, NewMoney(4050, "KES"), "one bag was damaged", adminEmail)
+	assert.Equal(t, ErrRefundAmount, err)
+	partial, err := service.RefundOrder(order, NewMoney(4100, "KES"), "one bag was damaged", adminEmail)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(4100, "KES"), partial.Amount)
+	// the rest of the KSh 126 taken, more than the order's total
+	rest, err := service.RefundOrder(order, NewMoney(8500, "KES"), "the rest", adminEmail)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(8500, "KES"), rest.Amount)
+	_, err = service.RefundOrder(order, NewMoney(100, "KES"), "more", adminEmail)
+	assert.Equal(t, ErrRefundTooLarge, err)
+}
+
+// newPaidOrder places an order for KSh 100 and pays for it.
+func newPaidOrder(t *testing.T, service Service) *Orders {
+	order := newPaymentOrder(t, service)
+	payment, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	_, err = service.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true, Receipt: "QKJ4ABC123"})
+	assert.NoError(t, err)
+	order, err = service.service.FindOrders(order.ID)
+	assert.NoError(t, err)
+	return order
+}
+
+func TestService_RefundOrder(t *testing.T) {
+	service := NewMockService()
+	store := service.service
+
+	unpaid := newPaymentOrder(t, service)
+	_, err := service.RefundOrder(unpaid, NewMoney(1000, "KES"), "damaged", adminEmail)
+	assert.Equal(t, ErrNotPaid, err)
+
+	order := newPaidOrder(t, service)
+	_, err = service.RefundOrder(order, NewMoney(1000, "USD"), "damaged", adminEmail)
+	assert.Equal(t, ErrCurrencyMismatch, err)
+
+	partial, err := service.RefundOrder(order, NewMoney(4000, "KES"), "one bag was damaged", adminEmail)
+	assert.NoError(t, err)
+	assert.Equal(t, RefundPending, partial.Status)
+	assert.Equal(t, adminEmail, partial.Actor)
+	assert.NotEmpty(t, partial.Reference)
+	// pending refunds count against what's left
+	_, err = service.RefundOrder(order, NewMoney(6001, "KES"), "the rest", adminEmail)
+	assert.Equal(t, ErrRefundTooLarge, err)
+
+	// refunds the provider turns down don't
+	service.payments = decliningRefunds{}
+	_, err = service.RefundOrder(order, NewMoney(6000, "KES"), "the rest", adminEmail)
+	var declined *PaymentError
+	assert.True(t, errors.As(err, &declined))
+	service.payments = FakePaymentProvider{}
+	rest, err := service.RefundOrder(order, NewMoney(6000, "KES"), "the rest", adminEmail)
+	assert.NoError(t, err)
+
+	completed, err := service.SettleRefund(RefundResult{Reference: partial.Reference, Completed: true, Receipt: "QKJ5DEF456"})
+	assert.NoError(t, err)
+	assert.Equal(t, RefundCompleted, completed.Status)
+	assert.Equal(t, "QKJ5DEF456", completed.Receipt)
+	// a second report is ignored
+	completed, err = service.SettleRefund(RefundResult{Reference: partial.Reference, Reason: "timed out"})
+	assert.NoError(t, err)
+	assert.Equal(t, RefundCompleted, completed.Status)
+	failed, err := service.SettleRefund(RefundResult{Reference: rest.Reference, Reason: "The initiator information is invalid."})
+	assert.NoError(t, err)
+	assert.Equal(t, RefundFailed, failed.Status)
+
+	// one SMS for the payment and one for the completed refund
+	notifications, err := store.OrderNotifications(order.ID)
+	assert.NoError(t, err)
+	assert.Len(t, notifications, 2)
+	assert.Contains(t, notifications[1].Message, "refunded KSh 40.00")
+
+	refunds, err := store.OrderRefunds(order.ID)
+	assert.NoError(t, err)
+	assert.Len(t, refunds, 3)
+	assert.Equal(t, rest.ID, refunds[0].ID)
+}
+
+func TestService_SettlePayment_Surplus(t *testing.T) {
+	service := NewMockService()
+	store := service.service.(*MockInMemDB)
+
+	// a second payment lands on an order that's already paid for
+	order := newPaymentOrder(t, service)
+	first, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	stale := store.Payments[first.ID]
+	stale.CreatedAt = time.Now().Add(-paymentTimeout - time.Minute)
+	store.Payments[first.ID] = stale
+	second, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	_, err = service.SettlePayment(PaymentResult{Reference: second.Reference, Paid: true, Receipt: "QKJ4ABC123"})
+	assert.NoError(t, err)
+	_, err = service.SettlePayment(PaymentResult{Reference: first.Reference, Paid: true, Receipt: "QKJ4ABC124"})
+	assert.NoError(t, err)
+
+	refunds, err := store.OrderRefunds(order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, refunds, 1) {
+		assert.Equal(t, first.ID, refunds[0].PaymentID)
+		assert.Equal(t, first.Amount, refunds[0].Amount)
+		assert.Equal(t, surplusActor, refunds[0].Actor)
+		assert.Equal(t, "the order was already paid for", refunds[0].Reason)
+	}
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	receipt, err := service.Receipt(order, Business{Name: "Savannah Ltd"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, second.ID, receipt.Payment.ID)
+	}
+
+	// the order is cancelled while the customer is still paying
+	order = newPaymentOrder(t, service)
+	payment, err := service.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CancelOrder(OrderStatusChange{OrderID: order.ID, From: StatusPending, To: StatusCancelled, Actor: adminEmail}, nil))
+	_, err = service.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true, Receipt: "QKJ4ABC125"})
+	assert.NoError(t, err)
+	order, err = store.FindOrders(order.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, PaymentPaid, order.PaymentStatus)
+	refunds, err = store.OrderRefunds(order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, refunds, 1) {
+		assert.Equal(t, payment.ID, refunds[0].PaymentID)
+		assert.Equal(t, "the order was cancelled", refunds[0].Reason)
+	}
+}
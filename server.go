@@ -4,13 +4,20 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -78,8 +85,12 @@ func NewServer(cfg Config) *Server {
 		RedirectURL:  cfg.RedirectURL,
 		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
 	}
-	validate := validator.New()
-	services := NewService(conn, cfg.AUsername, cfg.AtalkingAPI)
+	blobs, err := NewLocalBlobStore(cfg.BlobDir, cfg.PublicURL+"/blobs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	validate := newValidator()
+	services := NewService(conn, cfg.AUsername, cfg.AtalkingAPI, blobs, cfg.Pricing(), cfg.CartTTL, cfg.Payments())
 	server := Server{
 		Router:     mux,
 		Services:   services,
@@ -94,19 +105,91 @@ func NewServer(cfg Config) *Server {
 	return &server
 }
 
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterCustomTypeFunc(moneyAmount, Money{})
+	validate.RegisterValidation("gtin", func(fl validator.FieldLevel) bool {
+		_, ok := normalizeGTIN(fl.Field().String())
+		return ok
+	})
+	return validate
+}
+
 func (server *Server) Routes() {
 	http.Handle("/", server.Router)
 	server.Router.Use(corsmiddleware)
 	server.Router.Use(jsonmiddleware)
 	server.Router.HandleFunc("/login", server.setCallbackCookie).Methods("GET", "OPTIONS")
 	server.Router.HandleFunc("/auth/google/callback", server.googleCallback).Methods("GET", "OPTIONS")
+	server.Router.PathPrefix("/blobs/").HandlerFunc(server.serveBlob).Methods("GET", "OPTIONS")
+	server.Router.HandleFunc("/payments/{provider}/callback", server.paymentCallback).Methods("POST", "OPTIONS")
+	server.Router.HandleFunc("/payments/{provider}/refunds/callback", server.refundCallback).Methods("POST", "OPTIONS")
 	authroutes := server.Router.PathPrefix("/v1").Subrouter()
 	authroutes.Use(server.authmiddleware)
-	authroutes.HandleFunc("/customers", server.createCustomer).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/customers", server.idempotent(server.createCustomer)).Methods("POST", "OPTIONS")
 	authroutes.HandleFunc("/customers/{id}", server.getCustomer).Methods("GET", "OPTIONS")
-	authroutes.HandleFunc("/orders", server.createOrder).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/orders", server.idempotent(server.createOrder)).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/orders/quote", server.quoteOrder).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/cart", server.getCart).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/cart", server.clearCart).Methods("DELETE", "OPTIONS")
+	authroutes.HandleFunc("/cart/lines", server.addCartLine).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/cart/lines/{id}", server.updateCartLine).Methods("PUT", "OPTIONS")
+	authroutes.HandleFunc("/cart/lines/{id}", server.removeCartLine).Methods("DELETE", "OPTIONS")
+	authroutes.HandleFunc("/cart/checkout", server.idempotent(server.checkoutCart)).Methods("POST", "OPTIONS")
 	authroutes.HandleFunc("/orders/{id}", server.getOrder).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/me/orders", server.listMyOrders).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/me/addresses", server.listAddresses).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/me/addresses", server.createAddress).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/me/addresses/{id}", server.getAddress).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/me/addresses/{id}", server.updateAddress).Methods("PUT", "OPTIONS")
+	authroutes.HandleFunc("/me/addresses/{id}", server.deleteAddress).Methods("DELETE", "OPTIONS")
+	authroutes.HandleFunc("/orders/{id}/transitions", server.listOrderTransitions).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/orders/{id}/cancel", server.cancelOrder).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/orders/{id}/payments", server.listOrderPayments).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/orders/{id}/payments", server.startOrderPayment).Methods("POST", "OPTIONS")
+	authroutes.HandleFunc("/orders/{id}/refunds", server.listOrderRefunds).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/orders/{id}/receipt", server.getOrderReceipt).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/items", server.listItems).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/items/search", server.searchItems).Methods("GET", "OPTIONS")
 	authroutes.HandleFunc("/items/{id}", server.getItem).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/items/{id}/variants", server.listItemVariants).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/items/{id}/price-history", server.getItemPriceHistory).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/variants/by-sku/{sku}", server.getVariantBySKU).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/variants/by-barcode/{code}", server.getVariantByBarcode).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/categories", server.listCategories).Methods("GET", "OPTIONS")
+	authroutes.HandleFunc("/categories/{id}/items", server.listCategoryItems).Methods("GET", "OPTIONS")
+
+	adminroutes := authroutes.NewRoute().Subrouter()
+	adminroutes.Use(server.adminmiddleware)
+	adminroutes.HandleFunc("/items", server.createItem).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}", server.updateItem).Methods("PUT", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}", server.deleteItem).Methods("DELETE", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}/restore", server.restoreItem).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/customers/{id}", server.deleteCustomer).Methods("DELETE", "OPTIONS")
+	adminroutes.HandleFunc("/customers/{id}/restore", server.restoreCustomer).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/orders/{id}", server.deleteOrder).Methods("DELETE", "OPTIONS")
+	adminroutes.HandleFunc("/orders/{id}/restore", server.restoreOrder).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/orders/{id}/transitions", server.transitionOrder).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/orders/{id}/notifications", server.listOrderNotifications).Methods("GET", "OPTIONS")
+	adminroutes.HandleFunc("/orders/{id}/refunds", server.refundOrder).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}/categories", server.setItemCategories).Methods("PUT", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}/tags", server.setItemTags).Methods("PUT", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}/images", server.uploadItemImage).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}/images/{imageID}", server.deleteItemImage).Methods("DELETE", "OPTIONS")
+	adminroutes.HandleFunc("/items/{id}/variants", server.createVariant).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/variants/{id}", server.updateVariant).Methods("PUT", "OPTIONS")
+	adminroutes.HandleFunc("/variants/{id}", server.deleteVariant).Methods("DELETE", "OPTIONS")
+	adminroutes.HandleFunc("/categories", server.createCategory).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/coupons", server.listCoupons).Methods("GET", "OPTIONS")
+	adminroutes.HandleFunc("/coupons", server.createCoupon).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/coupons/{id}", server.getCoupon).Methods("GET", "OPTIONS")
+	adminroutes.HandleFunc("/coupons/{id}", server.updateCoupon).Methods("PUT", "OPTIONS")
+	adminroutes.HandleFunc("/coupons/{id}", server.deleteCoupon).Methods("DELETE", "OPTIONS")
+	adminroutes.HandleFunc("/delivery-zones", server.listDeliveryZones).Methods("GET", "OPTIONS")
+	adminroutes.HandleFunc("/delivery-zones", server.createDeliveryZone).Methods("POST", "OPTIONS")
+	adminroutes.HandleFunc("/delivery-zones/{id}", server.getDeliveryZone).Methods("GET", "OPTIONS")
+	adminroutes.HandleFunc("/delivery-zones/{id}", server.updateDeliveryZone).Methods("PUT", "OPTIONS")
+	adminroutes.HandleFunc("/delivery-zones/{id}", server.deleteDeliveryZone).Methods("DELETE", "OPTIONS")
 }
 
 func (server *Server) setCallbackCookie(w http.ResponseWriter, r *http.Request) {
@@ -151,7 +234,11 @@ func (server *Server) googleCallback(w http.ResponseWriter, r *http.Request) {
 		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
 		return
 	}
-	user, err := server.Services.service.FindUserbyEmail(userInfo.Email)
+	user, err := server.Services.service.FindUserbyEmailIncludingArchived(userInfo.Email)
+	if err == nil && user.DeletedAt != nil {
+		serializeResponse(w, http.StatusForbidden, Errorjson{"error": "account is archived"})
+		return
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			user, err = server.Services.service.CreateUser(User{Code: userInfo.Subject, Email: userInfo.Email})
@@ -195,6 +282,9 @@ func (server *Server) createCustomer(w http.ResponseWriter, r *http.Request) {
 	serializeResponse(w, http.StatusCreated, createdCustomer)
 }
 
+// getCustomer shows customers their own record, and admins anyone's.
+// Other customers are reported as missing rather than forbidden, so ids
+// can't be probed.
 func (server *Server) getCustomer(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	idStr := params["id"]
@@ -205,7 +295,17 @@ func (server *Server) getCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	customer, err := server.Services.service.FindUser(id)
+	find := server.Services.service.FindUser
+	if server.includeArchived(r) {
+		find = server.Services.service.FindUserIncludingArchived
+	}
+	customer, err := find(id)
+	if err == nil {
+		var allowed bool
+		if allowed, err = server.canSee(r, customer.ID); err == nil && !allowed {
+			err = sql.ErrNoRows
+		}
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Customer not found"})
@@ -244,133 +344,2042 @@ func (server *Server) createOrder(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	order.Time = time.Now()
+	server.placeOrder(w, user, order, server.Services.service.CreateOrders)
+}
+
+// placeOrder prices the order for user and places it with create, queueing
+// its confirmation SMS.
+func (server *Server) placeOrder(w http.ResponseWriter, user *User, order Orders, create func(order Orders, notify func(order *Orders) *Notification) (*Orders, error)) {
+	if order.AddressID != nil {
+		address, ok := server.findOwnAddress(w, user, *order.AddressID)
+		if !ok {
+			return
+		}
+		if order.Contact == "" {
+			order.Contact = address.Contact
+		}
+	}
 	order.UserId = user.ID
-	createdOrder, err := server.Services.service.CreateOrders(order)
+	if !server.priceOrder(w, &order) {
+		return
+	}
+	summary, err := server.orderSummary(&order)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
 		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
 		return
 	}
-	item, err := server.Services.service.FindItem(order.ItemID)
+	// the confirmation is queued with the order and sent by the outbox
+	// Dispatcher, so a provider outage doesn't fail the order
+	confirmation := func(created *Orders) *Notification {
+		return &Notification{
+			Recipient: created.Contact,
+			Message:   fmt.Sprintf("Thank you for your order! You've successfully ordered %s, totaling an amount of %s. We appreciate your business!", summary, created.Total),
+		}
+	}
+	order.Time = time.Now()
+	createdOrder, err := create(order, confirmation)
 	if err != nil {
+		var outOfStock *OutOfStockError
+		if errors.As(err, &outOfStock) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		if err == ErrPriceChanged || err == ErrCartChanged {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		var coupon *CouponError
+		if errors.As(err, &coupon) {
+			serializeResponse(w, http.StatusUnprocessableEntity, Errorjson{"error": err.Error()})
+			return
+		}
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
 		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
 		return
 	}
+	// ask for payment straight away; the order stands if that fails and
+	// can be paid for later through its payments
+	if payment, err := server.Services.StartPayment(createdOrder, createdOrder.Contact); err == nil {
+		createdOrder.PaymentStatus = payment.Status
+	} else if err != ErrNotPayable {
+		log.Printf("order %d: starting payment: %v", createdOrder.ID, err)
+		var failed *PaymentError
+		if errors.As(err, &failed) {
+			createdOrder.PaymentStatus = PaymentFailed
+		}
+	}
+	serializeResponse(w, http.StatusCreated, createdOrder)
+}
 
-	orderConfirmationMessage := fmt.Sprintf("Thank you for your order! You've successfully created an order for %s. You ordered %d %s(s), totaling an amount of $%.2f. We appreciate your business!", item.Name, order.Qty, item.Name, item.Price*float32(order.Qty))
-	err = server.Services.sms.Send(order.Contact, orderConfirmationMessage)
-	if err != nil {
+// quoteOrder prices a basket the way createOrder would, without ordering
+// it or taking any stock.
+func (server *Server) quoteOrder(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": "Claims not found in context"})
+		return
+	}
+	var body struct {
+		Lines            []OrderLine `json:"lines" validate:"required,min=1,dive"`
+		CouponCode       string      `json:"coupon_code"`
+		DeliveryLocation *LatLng     `json:"delivery_location"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	order := Orders{Lines: body.Lines, CouponCode: body.CouponCode, DeliveryLocation: body.DeliveryLocation}
+	// customers who haven't signed up yet can still get a quote, their
+	// coupon usage just isn't checked
+	user, err := server.Services.service.FindUserbyEmail(claims.Email)
+	if err != nil && err != sql.ErrNoRows {
 		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
 		return
 	}
-	serializeResponse(w, http.StatusCreated, createdOrder)
+	if err == nil {
+		order.UserId = user.ID
+	}
+	if !server.priceOrder(w, &order) {
+		return
+	}
+	serializeResponse(w, http.StatusOK, Quote{Lines: order.Lines, Breakdown: order.Breakdown, CouponCode: order.CouponCode, DeliveryZoneID: order.DeliveryZoneID})
 }
 
-func (server *Server) getOrder(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	idStr := params["id"]
-	id, err := strconv.Atoi(idStr)
+// priceOrder resolves the variants the order's lines name and prices them
+// with Service.PriceOrder, writing the error response and returning false
+// when it can't.
+func (server *Server) priceOrder(w http.ResponseWriter, order *Orders) bool {
+	for i := range order.Lines {
+		line := &order.Lines[i]
+		if line.VariantID == nil {
+			continue
+		}
+		variant, err := server.Services.service.FindVariant(*line.VariantID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Variant not found"})
+				return false
+			}
+			serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+			return false
+		}
+		if line.ItemID != 0 && line.ItemID != variant.ItemID {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Variant does not belong to item"})
+			return false
+		}
+		line.ItemID = variant.ItemID
+	}
+	if err := server.Services.PriceOrder(order); err != nil {
+		var coupon *CouponError
+		var delivery *DeliveryError
+		if errors.As(err, &coupon) || errors.As(err, &delivery) {
+			serializeResponse(w, http.StatusUnprocessableEntity, Errorjson{"error": err.Error()})
+			return false
+		}
+		if err == ErrCurrencyMismatch {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+			return false
+		}
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return false
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func (server *Server) listMyOrders(w http.ResponseWriter, r *http.Request) {
+	filter, err := orderFilterFromQuery(r.URL.Query())
 	if err != nil {
-		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
 		return
 	}
-	order, err := server.Services.service.FindOrders(id)
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	page, err := server.Services.service.ListOrdersByUser(user.ID, filter)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			serializeResponse(w, http.StatusNotFound, "Order not found")
+		if err == ErrInvalidCursor {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
 			return
 		}
 		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
 		return
 	}
-	serializeResponse(w, http.StatusOK, order)
+	serializeResponse(w, http.StatusOK, page)
 }
 
-func (server *Server) getItem(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	idStr := params["id"]
-	id, err := strconv.Atoi(idStr)
+// currentUser resolves the signed in customer, writing the error response
+// when that fails.
+func (server *Server) currentUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": "Claims not found in context"})
+		return nil, false
+	}
+	user, err := server.Services.service.FindUserbyEmail(claims.Email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "No such user"})
+			return nil, false
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return nil, false
+	}
+	return user, true
+}
+
+// findOwnAddress looks up one of user's saved addresses. Other customers'
+// addresses are reported as missing.
+func (server *Server) findOwnAddress(w http.ResponseWriter, user *User, id int) (*Address, bool) {
+	address, err := server.Services.service.FindAddress(id)
+	if err != nil && err != sql.ErrNoRows {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return nil, false
+	}
+	if err == sql.ErrNoRows || address.UserID != user.ID {
+		serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Address not found"})
+		return nil, false
+	}
+	return address, true
+}
+
+func (server *Server) listAddresses(w http.ResponseWriter, r *http.Request) {
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	addresses, err := server.Services.service.ListAddresses(user.ID)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, addresses)
+}
+
+func (server *Server) createAddress(w http.ResponseWriter, r *http.Request) {
+	var address Address
+	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(address); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	address.UserID = user.ID
+	created, err := server.Services.service.CreateAddress(address)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, created)
+}
+
+func (server *Server) getAddress(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
 		return
 	}
-	item, err := server.Services.service.FindItem(id)
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	address, ok := server.findOwnAddress(w, user, id)
+	if !ok {
+		return
+	}
+	serializeResponse(w, http.StatusOK, address)
+}
+
+func (server *Server) updateAddress(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	var address Address
+	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(address); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	existing, ok := server.findOwnAddress(w, user, id)
+	if !ok {
+		return
+	}
+	address.ID, address.UserID, address.CreatedAt = id, user.ID, existing.CreatedAt
+	if err := server.Services.service.UpdateAddress(address); err != nil {
 		if err == sql.ErrNoRows {
-			serializeResponse(w, http.StatusNotFound, "Item not found")
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Address not found"})
 			return
 		}
 		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
 		return
 	}
-	serializeResponse(w, http.StatusOK, item)
+	serializeResponse(w, http.StatusOK, address)
 }
-func corsmiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS,PUT")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
-		w.Header().Set("Access-Control-Expose-Headers", "Authorization")
-		w.Header().Set("Content-Type", "application/json")
-		if r.Method == "OPTIONS" {
+
+func (server *Server) deleteAddress(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := server.findOwnAddress(w, user, id); !ok {
+		return
+	}
+	if err := server.Services.service.DeleteAddress(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Address not found"})
 			return
 		}
-
-		next.ServeHTTP(w, r)
-	})
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-const (
-	authHeaderKey = "authorization"
-	token         = "token"
-	claimsKey     = "claims"
-)
-
-func serializeResponse(w http.ResponseWriter, statuscode int, data interface{}) {
-	w.WriteHeader(statuscode)
-	reqBodyBytes := new(bytes.Buffer)
-	json.NewEncoder(reqBodyBytes).Encode(data)
-	w.Write(reqBodyBytes.Bytes())
+func orderFilterFromQuery(query url.Values) (OrderFilter, error) {
+	filter := OrderFilter{
+		Status: OrderStatus(query.Get("status")),
+		Cursor: query.Get("cursor"),
+	}
+	if filter.Status != "" && !filter.Status.Valid() {
+		return filter, fmt.Errorf("Invalid status %q", filter.Status)
+	}
+	var err error
+	if filter.From, err = parseDate(query.Get("from"), false); err != nil {
+		return filter, errors.New("Invalid from")
+	}
+	if filter.To, err = parseDate(query.Get("to"), true); err != nil {
+		return filter, errors.New("Invalid to")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, errors.New("Invalid limit")
+		}
+	}
+	return filter, nil
 }
 
-type Errorjson map[string]string
-type Claims struct {
-	Email         string `json:"email"`
-	EmailVerified bool   `json:"email_verified"`
+// parseDate reads an optional date range bound, either a date like
+// 2024-05-31 or an RFC 3339 timestamp. With wholeDay a bare date moves to
+// the start of the next day, so an exclusive upper bound still covers it.
+func parseDate(s string, wholeDay bool) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, err
+	}
+	if wholeDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
 }
 
-func (server *Server) authmiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		reqtoken := r.Header.Get(authHeaderKey)
-		tokenvalue := strings.Split(reqtoken, "Bearer ")
-		if len(tokenvalue) == 0 {
-			serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": "authorization header not provided"})
-			return
-		}
-		if len(tokenvalue) < 2 {
-			serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": "invalid authorization header format"})
+func (server *Server) transitionOrder(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": "Claims not found in context"})
+		return
+	}
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		Status OrderStatus `json:"status"`
+		Note   string      `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if !body.Status.Valid() {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": fmt.Sprintf("unknown status %q", body.Status)})
+		return
+	}
+	order, err := server.Services.TransitionOrder(id, body.Status, claims.Email, body.Note, nil)
+	if err != nil {
+		var transition *TransitionError
+		if errors.As(err, &transition) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
 			return
 		}
-		reqtoken = tokenvalue[1]
-		verifier := server.provider.Verifier(&oidc.Config{ClientID: server.Cfg.ClientID})
-		idToken, err := verifier.Verify(r.Context(), reqtoken)
-		if err != nil {
-			serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": err.Error()})
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Order not found"})
 			return
 		}
-		var claims Claims
-		err = idToken.Claims(&claims)
-		if err != nil {
-			serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
-		}
-		ctx := context.WithValue(r.Context(), claimsKey, &claims)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, order)
 }
 
-func jsonmiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		next.ServeHTTP(w, r)
-	})
+// cancelOrder lets customers cancel their own orders within
+// Cfg.CancelWindow of placing them, and admins cancel any order. Orders
+// that are paid for, or being paid for, can only be cancelled by an admin,
+// who refunds them. The stock is put back and the customer is sent an SMS
+// through the outbox.
+func (server *Server) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": "Claims not found in context"})
+		return
+	}
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Reason string `json:"reason" validate:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if !server.Cfg.IsAdmin(claims.Email) {
+		if time.Since(order.Time) > server.Cfg.CancelWindow {
+			serializeResponse(w, http.StatusForbidden, Errorjson{"error": "The order can no longer be cancelled online, please contact us"})
+			return
+		}
+		if order.PaymentStatus == PaymentPaid || order.PaymentStatus == PaymentPending {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": "The order has been paid for or is being paid for, please contact us to cancel it and get a refund"})
+			return
+		}
+	}
+	var notification *Notification
+	if order.Contact != "" {
+		notification = &Notification{
+			Recipient: order.Contact,
+			Message:   fmt.Sprintf("Your order #%d has been cancelled: %s. We hope to serve you again soon.", order.ID, body.Reason),
+		}
+	}
+	cancelled, err := server.Services.TransitionOrder(order.ID, StatusCancelled, claims.Email, body.Reason, notification)
+	if err != nil {
+		var transition *TransitionError
+		if errors.As(err, &transition) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Order not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, cancelled)
+}
+
+func (server *Server) listOrderTransitions(w http.ResponseWriter, r *http.Request) {
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	history, err := server.Services.service.OrderStatusHistory(order.ID)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, history)
+}
+
+// listOrderNotifications shows the SMSes sent about an order, with their
+// delivery attempts and status.
+func (server *Server) listOrderNotifications(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	if _, err := server.Services.service.FindOrdersIncludingArchived(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Order not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	notifications, err := server.Services.service.OrderNotifications(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, notifications)
+}
+
+// orderSummary describes an order's basket for the confirmation SMS, e.g.
+// "2 x Sugar (1kg), 1 x Milk".
+func (server *Server) orderSummary(order *Orders) (string, error) {
+	lines := make([]string, 0, len(order.Lines))
+	for _, line := range order.Lines {
+		item, err := server.Services.service.FindItemIncludingArchived(line.ItemID)
+		if err != nil {
+			return "", err
+		}
+		name := item.Name
+		if line.VariantID != nil {
+			variant, err := server.Services.service.FindVariant(*line.VariantID)
+			if err != nil {
+				return "", err
+			}
+			name = fmt.Sprintf("%s (%s)", item.Name, variant.Name)
+		}
+		lines = append(lines, fmt.Sprintf("%d x %s", line.Qty, name))
+	}
+	return strings.Join(lines, ", "), nil
+}
+
+func (server *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	serializeResponse(w, http.StatusOK, order)
+}
+
+func (server *Server) getItem(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	idStr := params["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	find := server.Services.service.FindItem
+	if server.includeArchived(r) {
+		find = server.Services.service.FindItemIncludingArchived
+	}
+	item, err := find(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, "Item not found")
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if item.Categories, err = server.Services.service.ItemCategories(item.ID); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if item.Tags, err = server.Services.service.ItemTags(item.ID); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if item.Images, err = server.Services.service.ListItemImages(item.ID); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	for i := range item.Images {
+		server.withImageURLs(&item.Images[i])
+	}
+	serializeResponse(w, http.StatusOK, item)
+}
+
+func (server *Server) listItems(w http.ResponseWriter, r *http.Request) {
+	filter, err := itemFilterFromQuery(r.URL.Query())
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	filter.IncludeArchived = server.includeArchived(r)
+	server.serveItemPage(w, filter)
+}
+
+func (server *Server) serveItemPage(w http.ResponseWriter, filter ItemFilter) {
+	page, err := server.Services.service.ListItems(filter)
+	if err != nil {
+		if err == ErrInvalidCursor || err == ErrInvalidSort {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, page)
+}
+
+func itemFilterFromQuery(query url.Values) (ItemFilter, error) {
+	filter := ItemFilter{
+		Name:   query.Get("name"),
+		Tag:    query.Get("tag"),
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+	}
+	var err error
+	if filter.MinPrice, err = parsePrice(query.Get("min_price")); err != nil {
+		return filter, errors.New("Invalid min_price")
+	}
+	if filter.MaxPrice, err = parsePrice(query.Get("max_price")); err != nil {
+		return filter, errors.New("Invalid max_price")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, errors.New("Invalid limit")
+		}
+	}
+	return filter, nil
+}
+
+func (server *Server) searchItems(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "q is required"})
+		return
+	}
+	var limit int
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid limit"})
+			return
+		}
+	}
+	results, err := server.Services.service.SearchItems(q, limit)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, results)
+}
+
+// parsePrice reads an optional price filter given in minor units.
+func parsePrice(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	price, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+func (server *Server) createItem(w http.ResponseWriter, r *http.Request) {
+	var item Item
+	err := json.NewDecoder(r.Body).Decode(&item)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(item); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	createdItem, err := server.Services.service.CreateItem(item)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, createdItem)
+}
+
+func (server *Server) updateItem(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	var item Item
+	err = json.NewDecoder(r.Body).Decode(&item)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(item); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	item.ID = id
+	err = server.Services.service.UpdateItem(item)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, item)
+}
+
+func (server *Server) deleteItem(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.DeleteItem, "Item not found")
+}
+
+func (server *Server) restoreItem(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.RestoreItem, "Archived item not found")
+}
+
+func (server *Server) deleteCustomer(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.DeleteUser, "Customer not found")
+}
+
+func (server *Server) restoreCustomer(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.RestoreUser, "Archived customer not found")
+}
+
+func (server *Server) deleteOrder(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.DeleteOrders, "Order not found")
+}
+
+func (server *Server) restoreOrder(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.RestoreOrders, "Archived order not found")
+}
+
+// applyByID runs an archive or restore against the {id} in the path.
+func (server *Server) applyByID(w http.ResponseWriter, r *http.Request, apply func(id int) error, notFound string) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	if err := apply(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": notFound})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// includeArchived reports whether an admin asked for archived records
+// with ?include_archived=true. Everyone else only ever sees live ones.
+func (server *Server) includeArchived(r *http.Request) bool {
+	if include, _ := strconv.ParseBool(r.URL.Query().Get("include_archived")); !include {
+		return false
+	}
+	return server.isAdmin(r)
+}
+
+func (server *Server) setItemCategories(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		CategoryIDs []int `json:"category_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if _, err := server.Services.service.FindItem(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	err = server.Services.service.SetItemCategories(id, body.CategoryIDs)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Unknown category"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	categories, err := server.Services.service.ItemCategories(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, categories)
+}
+
+func (server *Server) setItemTags(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		Tags []string `json:"tags" validate:"dive,max=64"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	err = server.Services.service.SetItemTags(id, body.Tags)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	tags, err := server.Services.service.ItemTags(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, tags)
+}
+
+func (server *Server) withImageURLs(image *ItemImage) {
+	image.URL = server.Services.blobs.URL(image.Key)
+	image.ThumbnailURL = server.Services.blobs.URL(image.ThumbnailKey)
+}
+
+// uploadItemImage takes a multipart upload in the "image" field, stores it
+// with a thumbnail in the blob store and records it against the item.
+func (server *Server) uploadItemImage(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	if _, err := server.Services.service.FindItem(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	// leave room for the multipart framing around the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			serializeResponse(w, http.StatusRequestEntityTooLarge, Errorjson{"error": ErrImageTooLarge.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+	processed, err := processImage(file)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrImageTooLarge):
+			serializeResponse(w, http.StatusRequestEntityTooLarge, Errorjson{"error": err.Error()})
+		case errors.Is(err, ErrUnsupportedImage):
+			serializeResponse(w, http.StatusUnsupportedMediaType, Errorjson{"error": err.Error()})
+		default:
+			serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		}
+		return
+	}
+	name, err := randString(12)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	image := ItemImage{
+		ItemID:       id,
+		Key:          fmt.Sprintf("items/%d/%s%s", id, name, imageExtensions[processed.contentType]),
+		ThumbnailKey: fmt.Sprintf("items/%d/%s_thumb%s", id, name, imageExtensions[processed.thumbnailContentType]),
+		ContentType:  processed.contentType,
+		Width:        processed.width,
+		Height:       processed.height,
+		Size:         int64(len(processed.data)),
+	}
+	if err := server.Services.blobs.Put(image.Key, bytes.NewReader(processed.data)); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.Services.blobs.Put(image.ThumbnailKey, bytes.NewReader(processed.thumbnail)); err != nil {
+		server.Services.blobs.Delete(image.Key)
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	createdImage, err := server.Services.service.CreateItemImage(image)
+	if err != nil {
+		server.Services.blobs.Delete(image.Key)
+		server.Services.blobs.Delete(image.ThumbnailKey)
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	server.withImageURLs(createdImage)
+	serializeResponse(w, http.StatusCreated, createdImage)
+}
+
+func (server *Server) deleteItemImage(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	imageID, err := strconv.Atoi(params["imageID"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid image ID"})
+		return
+	}
+	image, err := server.Services.service.FindItemImage(imageID)
+	if err != nil || image.ItemID != id {
+		if err == nil || err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Image not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.Services.service.DeleteItemImage(imageID); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	server.Services.blobs.Delete(image.Key)
+	server.Services.blobs.Delete(image.ThumbnailKey)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveBlob streams uploaded files back to clients. Keys are random and
+// never rewritten, so responses can be cached for good.
+func (server *Server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	blob, err := server.Services.blobs.Open(key)
+	if err != nil {
+		if err == ErrBlobNotFound {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	defer blob.Close()
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, blob)
+}
+
+func (server *Server) listItemVariants(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	if _, err := server.Services.service.FindItem(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	variants, err := server.Services.service.ListItemVariants(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, variants)
+}
+
+func (server *Server) getItemPriceHistory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	find := server.Services.service.FindItem
+	if server.includeArchived(r) {
+		find = server.Services.service.FindItemIncludingArchived
+	}
+	if _, err := find(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	history, err := server.Services.service.ItemPriceHistory(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, history)
+}
+
+// decodeVariant reads and validates a variant from the request body,
+// normalising its barcode to GTIN-14.
+func (server *Server) decodeVariant(r *http.Request) (ItemVariant, error) {
+	var variant ItemVariant
+	if err := json.NewDecoder(r.Body).Decode(&variant); err != nil {
+		return variant, err
+	}
+	if err := server.validator.Struct(variant); err != nil {
+		return variant, err
+	}
+	if variant.GTIN != nil {
+		gtin, _ := normalizeGTIN(*variant.GTIN)
+		variant.GTIN = &gtin
+	}
+	return variant, nil
+}
+
+func (server *Server) createVariant(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	variant, err := server.decodeVariant(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if _, err := server.Services.service.FindItem(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	variant.ItemID = id
+	createdVariant, err := server.Services.service.CreateVariant(variant)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": "SKU or barcode already in use"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, createdVariant)
+}
+
+func (server *Server) updateVariant(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	variant, err := server.decodeVariant(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	variant.ID = id
+	err = server.Services.service.UpdateVariant(variant)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Variant not found"})
+			return
+		}
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": "SKU or barcode already in use"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	updatedVariant, err := server.Services.service.FindVariant(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, updatedVariant)
+}
+
+func (server *Server) deleteVariant(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	err = server.Services.service.DeleteVariant(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Variant not found"})
+			return
+		}
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": "Variant is referenced by existing orders"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) getVariantBySKU(w http.ResponseWriter, r *http.Request) {
+	variant, err := server.Services.service.FindVariantBySKU(mux.Vars(r)["sku"])
+	server.serveVariant(w, variant, err)
+}
+
+func (server *Server) getVariantByBarcode(w http.ResponseWriter, r *http.Request) {
+	gtin, ok := normalizeGTIN(mux.Vars(r)["code"])
+	if !ok {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid barcode"})
+		return
+	}
+	variant, err := server.Services.service.FindVariantByGTIN(gtin)
+	server.serveVariant(w, variant, err)
+}
+
+// serveVariant responds with a looked up variant together with its item,
+// so a scanner can show the product in one round trip.
+func (server *Server) serveVariant(w http.ResponseWriter, variant *ItemVariant, err error) {
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Variant not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	item, err := server.Services.service.FindItem(variant.ItemID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Variant not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	response := struct {
+		*ItemVariant
+		Item *Item `json:"item"`
+	}{variant, item}
+	serializeResponse(w, http.StatusOK, response)
+}
+
+func (server *Server) listCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := server.Services.service.ListCategories()
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, categories)
+}
+
+func (server *Server) createCategory(w http.ResponseWriter, r *http.Request) {
+	var category Category
+	err := json.NewDecoder(r.Body).Decode(&category)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(category); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	createdCategory, err := server.Services.service.CreateCategory(category)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Unknown parent category"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, createdCategory)
+}
+
+func (server *Server) listCategoryItems(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	if _, err := server.Services.service.FindCategory(id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Category not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	filter, err := itemFilterFromQuery(r.URL.Query())
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	filter.CategoryID = id
+	filter.IncludeArchived = server.includeArchived(r)
+	server.serveItemPage(w, filter)
+}
+
+func corsmiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS,PUT,DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Authorization, Idempotent-Replayed")
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "OPTIONS" {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+const (
+	authHeaderKey = "authorization"
+	token         = "token"
+	claimsKey     = "claims"
+)
+
+func serializeResponse(w http.ResponseWriter, statuscode int, data interface{}) {
+	w.WriteHeader(statuscode)
+	reqBodyBytes := new(bytes.Buffer)
+	json.NewEncoder(reqBodyBytes).Encode(data)
+	w.Write(reqBodyBytes.Bytes())
+}
+
+type Errorjson map[string]string
+type Claims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func (server *Server) authmiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqtoken := r.Header.Get(authHeaderKey)
+		tokenvalue := strings.Split(reqtoken, "Bearer ")
+		if len(tokenvalue) == 0 {
+			serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": "authorization header not provided"})
+			return
+		}
+		if len(tokenvalue) < 2 {
+			serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": "invalid authorization header format"})
+			return
+		}
+		reqtoken = tokenvalue[1]
+		verifier := server.provider.Verifier(&oidc.Config{ClientID: server.Cfg.ClientID})
+		idToken, err := verifier.Verify(r.Context(), reqtoken)
+		if err != nil {
+			serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": err.Error()})
+			return
+		}
+		var claims Claims
+		err = idToken.Claims(&claims)
+		if err != nil {
+			serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		}
+		ctx := context.WithValue(r.Context(), claimsKey, &claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (server *Server) adminmiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(claimsKey).(*Claims)
+		if !ok || !server.Cfg.IsAdmin(claims.Email) {
+			serializeResponse(w, http.StatusForbidden, Errorjson{"error": "admin access required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxIdempotentBody caps the request bodies idempotent reads to hash.
+const maxIdempotentBody = 1 << 20
+
+// idempotent lets clients retry a POST safely by sending an
+// Idempotency-Key header. The first response for a key is stored and
+// replayed to later requests with the same key and body; reusing a key for
+// a different body fails with 422. Keys are scoped to the caller and route.
+// Server errors aren't stored so the request can be retried for real.
+func (server *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Idempotency-Key is too long"})
+			return
+		}
+		claims, ok := r.Context().Value(claimsKey).(*Claims)
+		if !ok {
+			serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": "Claims not found in context"})
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		if err != nil {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+			return
+		}
+		if len(body) > maxIdempotentBody {
+			serializeResponse(w, http.StatusRequestEntityTooLarge, Errorjson{"error": "request body is too large"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+		scope := claims.Email + " " + r.Method + " " + r.URL.Path
+
+		store := server.Services.idempotency
+		record, err := store.Reserve(scope, key, hash, server.Cfg.IdempotencyTTL)
+		if err != nil {
+			serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+			return
+		}
+		if record != nil {
+			switch {
+			case record.Hash != hash:
+				serializeResponse(w, http.StatusUnprocessableEntity, Errorjson{"error": "Idempotency-Key was already used for a different request"})
+			case record.StatusCode == 0:
+				serializeResponse(w, http.StatusConflict, Errorjson{"error": "A request with this Idempotency-Key is still being processed"})
+			default:
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.StatusCode)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if p := recover(); p != nil {
+				store.Release(scope, key)
+				panic(p)
+			}
+		}()
+		next(recorder, r)
+		if recorder.status >= http.StatusInternalServerError {
+			err = store.Release(scope, key)
+		} else {
+			err = store.Complete(scope, key, recorder.status, recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func jsonmiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) decodeCoupon(r *http.Request) (Coupon, error) {
+	var coupon Coupon
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		return coupon, err
+	}
+	if err := server.validator.Struct(coupon); err != nil {
+		return coupon, err
+	}
+	return coupon, coupon.check()
+}
+
+func (server *Server) createCoupon(w http.ResponseWriter, r *http.Request) {
+	coupon, err := server.decodeCoupon(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	createdCoupon, err := server.Services.CreateCoupon(coupon)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": "Coupon code already in use"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, createdCoupon)
+}
+
+func (server *Server) listCoupons(w http.ResponseWriter, r *http.Request) {
+	coupons, err := server.Services.service.ListCoupons()
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, coupons)
+}
+
+func (server *Server) getCoupon(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	coupon, err := server.Services.service.FindCoupon(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Coupon not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, coupon)
+}
+
+// updateCoupon changes a coupon's terms, its code and redemptions stay as
+// they are.
+func (server *Server) updateCoupon(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	coupon, err := server.decodeCoupon(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	coupon.ID = id
+	if err := server.Services.service.UpdateCoupon(coupon); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Coupon not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	updatedCoupon, err := server.Services.service.FindCoupon(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, updatedCoupon)
+}
+
+func (server *Server) deleteCoupon(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.DeleteCoupon, "Coupon not found")
+}
+
+func (server *Server) decodeDeliveryZone(r *http.Request) (DeliveryZone, error) {
+	var zone DeliveryZone
+	if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+		return zone, err
+	}
+	if err := server.validator.Struct(zone); err != nil {
+		return zone, err
+	}
+	return zone, zone.check()
+}
+
+func (server *Server) createDeliveryZone(w http.ResponseWriter, r *http.Request) {
+	zone, err := server.decodeDeliveryZone(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	createdZone, err := server.Services.service.CreateDeliveryZone(zone)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, createdZone)
+}
+
+func (server *Server) listDeliveryZones(w http.ResponseWriter, r *http.Request) {
+	zones, err := server.Services.service.ListDeliveryZones()
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, zones)
+}
+
+func (server *Server) getDeliveryZone(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	zone, err := server.Services.service.FindDeliveryZone(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Delivery zone not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, zone)
+}
+
+// updateDeliveryZone redraws a zone or changes its fees, orders already
+// placed keep the fee they were charged.
+func (server *Server) updateDeliveryZone(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	zone, err := server.decodeDeliveryZone(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	zone.ID = id
+	if err := server.Services.service.UpdateDeliveryZone(zone); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Delivery zone not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	updatedZone, err := server.Services.service.FindDeliveryZone(id)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, updatedZone)
+}
+
+func (server *Server) deleteDeliveryZone(w http.ResponseWriter, r *http.Request) {
+	server.applyByID(w, r, server.Services.service.DeleteDeliveryZone, "Delivery zone not found")
+}
+
+func (server *Server) getCart(w http.ResponseWriter, r *http.Request) {
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	cart, err := server.Services.Cart(user.ID)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, cart)
+}
+
+func (server *Server) clearCart(w http.ResponseWriter, r *http.Request) {
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if err := server.Services.service.ClearCart(user.ID); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) addCartLine(w http.ResponseWriter, r *http.Request) {
+	var line CartLine
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(line); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	added, err := server.Services.AddToCart(user.ID, line)
+	if err != nil {
+		if err == sql.ErrNoRows || errors.Is(err, ErrConflict) {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Item not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusCreated, added)
+}
+
+func (server *Server) updateCartLine(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		Qty int `json:"qty" validate:"required,gt=0"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if err := server.Services.service.UpdateCartLine(user.ID, CartLine{ID: id, Qty: body.Qty}); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Cart line not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	server.getCart(w, r)
+}
+
+func (server *Server) removeCartLine(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if err := server.Services.service.RemoveCartLine(user.ID, id); err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Cart line not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkoutCart orders everything in the customer's cart the way createOrder
+// orders a basket, and empties the cart in the same transaction.
+func (server *Server) checkoutCart(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Contact          string  `json:"contact" validate:"required_without=AddressID,max=32"`
+		AddressID        *int    `json:"address_id"`
+		CouponCode       string  `json:"coupon_code"`
+		DeliveryLocation *LatLng `json:"delivery_location"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	user, ok := server.currentUser(w, r)
+	if !ok {
+		return
+	}
+	cart, err := server.Services.Cart(user.ID)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if len(cart.Lines) == 0 {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Cart is empty"})
+		return
+	}
+	order := Orders{Contact: body.Contact, AddressID: body.AddressID, CouponCode: body.CouponCode, DeliveryLocation: body.DeliveryLocation}
+	for _, line := range cart.Lines {
+		if !line.InStock {
+			err := &OutOfStockError{ItemID: line.ItemID, VariantID: variantID(line.VariantID), Requested: line.Qty, Available: line.Available}
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		order.Lines = append(order.Lines, OrderLine{ItemID: line.ItemID, VariantID: line.VariantID, Qty: line.Qty})
+	}
+	server.placeOrder(w, user, order, func(order Orders, notify func(order *Orders) *Notification) (*Orders, error) {
+		return server.Services.service.CheckoutCart(user.ID, cart.Lines, order, notify)
+	})
+}
+
+// findOrderFor looks up an order the signed in customer placed, or any
+// order for admins. Other people's orders are reported as missing rather
+// than forbidden, so ids can't be probed.
+func (server *Server) findOrderFor(w http.ResponseWriter, r *http.Request) (*Orders, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "Invalid ID"})
+		return nil, false
+	}
+	find := server.Services.service.FindOrders
+	if server.includeArchived(r) {
+		find = server.Services.service.FindOrdersIncludingArchived
+	}
+	order, err := find(id)
+	if err == nil {
+		var allowed bool
+		if allowed, err = server.canSee(r, order.UserId); err == nil && !allowed {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Order not found"})
+			return nil, false
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return nil, false
+	}
+	return order, true
+}
+
+// canSee reports whether the signed in user may see records belonging to
+// the customer userID: admins may see everyone's, customers only their own.
+func (server *Server) canSee(r *http.Request, userID int) (bool, error) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		return false, errors.New("Claims not found in context")
+	}
+	if server.Cfg.IsAdmin(claims.Email) {
+		return true, nil
+	}
+	user, err := server.Services.service.FindUserbyEmail(claims.Email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return user.ID == userID, nil
+}
+
+// isAdmin reports whether the signed in user is an admin.
+func (server *Server) isAdmin(r *http.Request) bool {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	return ok && server.Cfg.IsAdmin(claims.Email)
+}
+
+// listOrderPayments lists an order's payments. Only admins see the
+// provider's references, with one a customer could forge a callback.
+func (server *Server) listOrderPayments(w http.ResponseWriter, r *http.Request) {
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	payments, err := server.Services.service.OrderPayments(order.ID)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if !server.isAdmin(r) {
+		for i := range payments {
+			payments[i].Reference = ""
+		}
+	}
+	serializeResponse(w, http.StatusOK, payments)
+}
+
+// startOrderPayment asks the customer to pay for an order again, after
+// the payment started when it was placed failed.
+func (server *Server) startOrderPayment(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		// Phone is who pays, the order's contact when left out
+		Phone string `json:"phone"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+			return
+		}
+	}
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	if body.Phone == "" {
+		body.Phone = order.Contact
+	}
+	payment, err := server.Services.StartPayment(order, body.Phone)
+	if err != nil {
+		if err == ErrAlreadyPaid || err == ErrPaymentPending || err == ErrNotPayable {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		var failed *PaymentError
+		if errors.As(err, &failed) {
+			serializeResponse(w, http.StatusBadGateway, Errorjson{"error": err.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if !server.isAdmin(r) {
+		payment.Reference = ""
+	}
+	serializeResponse(w, http.StatusAccepted, payment)
+}
+
+// callbackProvider checks a call to a payment provider's callback routes
+// and returns the provider. The routes sit outside /v1 as providers can't
+// sign in; when PAYMENTCALLBACKTOKEN is set, the token query parameter must
+// match it. The fake provider's callbacks are only taken with
+// ALLOWFAKEPAYMENTS set, anyone could mark orders paid with them.
+func (server *Server) callbackProvider(w http.ResponseWriter, r *http.Request) (PaymentProvider, bool) {
+	provider := server.Services.payments
+	if provider == nil || mux.Vars(r)["provider"] != provider.Name() {
+		serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Unknown payment provider"})
+		return nil, false
+	}
+	if _, fake := provider.(FakePaymentProvider); fake && !server.Cfg.AllowFakePayments {
+		serializeResponse(w, http.StatusForbidden, Errorjson{"error": "The fake payment provider is turned off"})
+		return nil, false
+	}
+	if token := server.Cfg.PaymentCallbackToken; token != "" &&
+		subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+		serializeResponse(w, http.StatusUnauthorized, Errorjson{"error": "Invalid token"})
+		return nil, false
+	}
+	return provider, true
+}
+
+// paymentCallback is where the payment provider reports what became of a
+// payment.
+func (server *Server) paymentCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := server.callbackProvider(w, r)
+	if !ok {
+		return
+	}
+	result, err := provider.ParseCallback(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	payment, err := server.Services.SettlePayment(*result)
+	if err != nil {
+		if err == ErrAmountMismatch {
+			serializeResponse(w, http.StatusUnprocessableEntity, Errorjson{"error": err.Error()})
+			return
+		}
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Payment not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, payment)
+}
+
+func (server *Server) listOrderRefunds(w http.ResponseWriter, r *http.Request) {
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	refunds, err := server.Services.service.OrderRefunds(order.ID)
+	if err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	if !server.isAdmin(r) {
+		for i := range refunds {
+			refunds[i].Reference = ""
+		}
+	}
+	serializeResponse(w, http.StatusOK, refunds)
+}
+
+// getOrderReceipt downloads the receipt for a paid order, as a PDF when
+// ?format=pdf or the Accept header asks for one and as HTML otherwise.
+func (server *Server) getOrderReceipt(w http.ResponseWriter, r *http.Request) {
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	receipt, err := server.Services.Receipt(order, server.Cfg.Business())
+	if err != nil {
+		if err == ErrNoReceipt {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "html"
+		if strings.Contains(r.Header.Get("Accept"), "application/pdf") {
+			format = "pdf"
+		}
+	}
+	var body bytes.Buffer
+	contentType, render := "text/html; charset=utf-8", receipt.HTML
+	switch format {
+	case "pdf":
+		contentType, render = "application/pdf", receipt.PDF
+	case "html":
+	default:
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": "format must be pdf or html"})
+		return
+	}
+	if err := render(&body); err != nil {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", receipt.Number+"."+format))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	body.WriteTo(w)
+}
+
+// refundOrder pays some or all of what a customer paid for an order back
+// to them through the provider that took the payment.
+func (server *Server) refundOrder(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": "Claims not found in context"})
+		return
+	}
+	var body struct {
+		Amount Money  `json:"amount" validate:"gt=0"`
+		Reason string `json:"reason" validate:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	if err := server.validator.Struct(body); err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	order, ok := server.findOrderFor(w, r)
+	if !ok {
+		return
+	}
+	// the amount is in the order's currency unless it says otherwise
+	if body.Amount.Currency == "" {
+		body.Amount.Currency = order.Total.Currency
+	}
+	refund, err := server.Services.RefundOrder(order, body.Amount, body.Reason, claims.Email)
+	if err != nil {
+		if err == ErrNotPaid {
+			serializeResponse(w, http.StatusConflict, Errorjson{"error": err.Error()})
+			return
+		}
+		if err == ErrRefundTooLarge || err == ErrRefundAmount {
+			serializeResponse(w, http.StatusUnprocessableEntity, Errorjson{"error": err.Error()})
+			return
+		}
+		if err == ErrCurrencyMismatch {
+			serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+			return
+		}
+		var failed *PaymentError
+		if errors.As(err, &failed) {
+			serializeResponse(w, http.StatusBadGateway, Errorjson{"error": err.Error()})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusAccepted, refund)
+}
+
+// refundCallback is where the payment provider reports what became of a
+// refund.
+func (server *Server) refundCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := server.callbackProvider(w, r)
+	if !ok {
+		return
+	}
+	result, err := provider.ParseRefundCallback(r)
+	if err != nil {
+		serializeResponse(w, http.StatusBadRequest, Errorjson{"error": err.Error()})
+		return
+	}
+	refund, err := server.Services.SettleRefund(*result)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			serializeResponse(w, http.StatusNotFound, Errorjson{"error": "Refund not found"})
+			return
+		}
+		serializeResponse(w, http.StatusInternalServerError, Errorjson{"error": err.Error()})
+		return
+	}
+	serializeResponse(w, http.StatusOK, refund)
 }
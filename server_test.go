@@ -0,0 +1,1085 @@
+package savannah
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const adminEmail = "admin@example.com"
+
+func newTestServer() *Server {
+	return &Server{
+		Services:  NewMockService(),
+		Router:    mux.NewRouter(),
+		Cfg:       &Config{AdminEmails: []string{adminEmail}, CancelWindow: 30 * time.Minute, IdempotencyTTL: time.Hour},
+		validator: newValidator(),
+	}
+}
+
+// newRequest builds a request as it looks after authmiddleware has run.
+func newRequest(method, target string, body interface{}, email string, vars map[string]string) *http.Request {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	r := httptest.NewRequest(method, target, &buf)
+	r = r.WithContext(context.WithValue(r.Context(), claimsKey, &Claims{Email: email}))
+	return mux.SetURLVars(r, vars)
+}
+
+func TestServer_ListItems(t *testing.T) {
+	server := newTestServer()
+	for i := 0; i < 3; i++ {
+		_, err := server.Services.service.CreateItem(Item{Price: NewMoney(int64(i+1)*100, "KES"), Name: "Item " + strconv.Itoa(i), Description: "Listed"})
+		assert.NoError(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	server.listItems(w, newRequest("GET", "/v1/items?limit=2&sort=-price&min_price=100", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page ItemPage
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	assert.Len(t, page.Items, 2)
+	assert.NotEmpty(t, page.NextCursor)
+
+	w = httptest.NewRecorder()
+	server.listItems(w, newRequest("GET", "/v1/items?cursor="+page.NextCursor+"&limit=2&sort=-price&min_price=100", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = ItemPage{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	assert.Len(t, page.Items, 1)
+	assert.Empty(t, page.NextCursor)
+
+	w = httptest.NewRecorder()
+	server.listItems(w, newRequest("GET", "/v1/items?max_price=cheap", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_SearchItems(t *testing.T) {
+	server := newTestServer()
+	_, err := server.Services.service.CreateItem(Item{Price: NewMoney(10, "KES"), Name: "Green Tea", Description: "Loose leaf"})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	server.searchItems(w, newRequest("GET", "/v1/items/search?q=green", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var results []ItemSearchResult
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&results))
+	assert.Len(t, results, 1)
+	assert.Equal(t, "<mark>Green</mark> Tea Loose leaf", results[0].Snippet)
+
+	w = httptest.NewRecorder()
+	server.searchItems(w, newRequest("GET", "/v1/items/search?q=", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_CreateItem(t *testing.T) {
+	server := newTestServer()
+	item := Item{Price: NewMoney(2999, "KES"), Name: "Sample Item", Description: "A sample description"}
+
+	w := httptest.NewRecorder()
+	server.createItem(w, newRequest("POST", "/v1/items", item, adminEmail, nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created Item
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.NotZero(t, created.ID)
+	assert.Equal(t, item.Name, created.Name)
+
+	w = httptest.NewRecorder()
+	server.createItem(w, newRequest("POST", "/v1/items", Item{Name: "No price"}, adminEmail, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_UpdateItem(t *testing.T) {
+	server := newTestServer()
+	created, err := server.Services.service.CreateItem(Item{Price: NewMoney(2999, "KES"), Name: "Sample Item", Description: "A sample description"})
+	assert.NoError(t, err)
+
+	update := Item{Price: NewMoney(3999, "KES"), Name: "Updated Item", Description: "An updated description"}
+	w := httptest.NewRecorder()
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+	server.updateItem(w, newRequest("PUT", "/v1/items/"+vars["id"], update, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	found, err := server.Services.service.FindItem(created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, update.Name, found.Name)
+
+	w = httptest.NewRecorder()
+	server.updateItem(w, newRequest("PUT", "/v1/items/0", update, adminEmail, map[string]string{"id": "0"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_DeleteItem(t *testing.T) {
+	server := newTestServer()
+	created, err := server.Services.service.CreateItem(Item{Price: NewMoney(2999, "KES"), Name: "Sample Item", Description: "A sample description"})
+	assert.NoError(t, err)
+	ordered, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Ordered Item", Description: "Has orders", Stock: 1})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: 1, Lines: []OrderLine{{ItemID: ordered.ID, Qty: 1}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+
+	vars := map[string]string{"id": strconv.Itoa(ordered.ID)}
+	w := httptest.NewRecorder()
+	server.deleteItem(w, newRequest("DELETE", "/v1/items/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	vars = map[string]string{"id": strconv.Itoa(created.ID)}
+	w = httptest.NewRecorder()
+	server.deleteItem(w, newRequest("DELETE", "/v1/items/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	server.deleteItem(w, newRequest("DELETE", "/v1/items/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_RestoreItem(t *testing.T) {
+	server := newTestServer()
+	created, err := server.Services.service.CreateItem(Item{Price: NewMoney(2999, "KES"), Name: "Sample Item", Description: "A sample description"})
+	assert.NoError(t, err)
+	assert.NoError(t, server.Services.service.DeleteItem(created.ID))
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+
+	w := httptest.NewRecorder()
+	server.getItem(w, newRequest("GET", "/v1/items/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// only admins can see archived items
+	w = httptest.NewRecorder()
+	server.getItem(w, newRequest("GET", "/v1/items/"+vars["id"]+"?include_archived=true", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server.getItem(w, newRequest("GET", "/v1/items/"+vars["id"]+"?include_archived=true", nil, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.restoreItem(w, newRequest("POST", "/v1/items/"+vars["id"]+"/restore", nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	server.restoreItem(w, newRequest("POST", "/v1/items/"+vars["id"]+"/restore", nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getItem(w, newRequest("GET", "/v1/items/"+vars["id"], nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServer_ItemPriceHistory(t *testing.T) {
+	server := newTestServer()
+	created, err := server.Services.service.CreateItem(Item{Price: NewMoney(2999, "KES"), Name: "Sample Item", Description: "A sample description"})
+	assert.NoError(t, err)
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+
+	update := Item{Price: NewMoney(3999, "KES"), Name: "Sample Item", Description: "A sample description"}
+	w := httptest.NewRecorder()
+	server.updateItem(w, newRequest("PUT", "/v1/items/"+vars["id"], update, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getItemPriceHistory(w, newRequest("GET", "/v1/items/"+vars["id"]+"/price-history", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var history []PriceChange
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&history))
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, NewMoney(2999, "KES"), history[0].Price)
+		assert.Equal(t, NewMoney(3999, "KES"), history[1].Price)
+	}
+
+	w = httptest.NewRecorder()
+	server.getItemPriceHistory(w, newRequest("GET", "/v1/items/0/price-history", nil, "john@example.com", map[string]string{"id": "0"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_AdminMiddleware(t *testing.T) {
+	server := newTestServer()
+	handler := server.adminmiddleware(http.HandlerFunc(server.createItem))
+	item := Item{Price: NewMoney(2999, "KES"), Name: "Sample Item", Description: "A sample description"}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("POST", "/v1/items", item, "john@example.com", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("POST", "/v1/items", item, adminEmail, nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestServer_CreateOrder(t *testing.T) {
+	server := newTestServer()
+	_, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	// no SMS provider is set up, the confirmation waits in the outbox
+	order := Orders{Contact: "+254700000000", Lines: []OrderLine{{ItemID: item.ID, Qty: 2}}}
+	w := httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created Orders
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, NewMoney(1998, "KES"), created.Breakdown.Subtotal)
+	assert.Equal(t, created.Total, created.Breakdown.Total)
+
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+	w = httptest.NewRecorder()
+	server.listOrderNotifications(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/notifications", nil, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var notifications []Notification
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&notifications))
+	if assert.Len(t, notifications, 1) {
+		assert.Equal(t, NotificationPending, notifications[0].Status)
+		assert.Equal(t, "+254700000000", notifications[0].Recipient)
+		assert.Contains(t, notifications[0].Message, "2 x Tea")
+		assert.Contains(t, notifications[0].Message, NewMoney(1998, "KES").String())
+	}
+
+	order.Contact = strings.Repeat("7", 33)
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_QuoteOrder(t *testing.T) {
+	server := newTestServer()
+	server.Services.pricing = Pricing{VATRate: 1600, DeliveryFee: NewMoney(15000, "KES")}
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	body := map[string]interface{}{"lines": []OrderLine{{ItemID: item.ID, Qty: 2}}}
+	w := httptest.NewRecorder()
+	server.quoteOrder(w, newRequest("POST", "/v1/orders/quote", body, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var quote Quote
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&quote))
+	assert.Equal(t, NewMoney(20000, "KES"), quote.Breakdown.Subtotal)
+	assert.Equal(t, NewMoney(15000, "KES"), quote.Breakdown.DeliveryFee)
+	assert.Equal(t, NewMoney(5600, "KES"), quote.Breakdown.Tax)
+	assert.Equal(t, NewMoney(40600, "KES"), quote.Breakdown.Total)
+	if assert.Len(t, quote.Lines, 1) {
+		assert.Equal(t, NewMoney(10000, "KES"), quote.Lines[0].UnitPrice)
+	}
+	// quoting takes no stock
+	found, err := server.Services.service.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, found.Stock)
+
+	body = map[string]interface{}{"lines": []OrderLine{{ItemID: item.ID + 1000, Qty: 1}}}
+	w = httptest.NewRecorder()
+	server.quoteOrder(w, newRequest("POST", "/v1/orders/quote", body, "john@example.com", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	server.quoteOrder(w, newRequest("POST", "/v1/orders/quote", map[string]interface{}{}, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_Coupons(t *testing.T) {
+	server := newTestServer()
+	_, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	server.createCoupon(w, newRequest("POST", "/v1/coupons", map[string]interface{}{"percent_off": 10, "amount_off": map[string]interface{}{"amount": 500}}, adminEmail, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	server.createCoupon(w, newRequest("POST", "/v1/coupons", map[string]interface{}{"percent_off": 10, "max_per_customer": 1}, adminEmail, nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var coupon Coupon
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&coupon))
+	assert.NotEmpty(t, coupon.Code)
+
+	order := Orders{Contact: "+254700000000", CouponCode: strings.ToLower(coupon.Code), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created Orders
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, NewMoney(1000, "KES"), created.Breakdown.Discount)
+	assert.Equal(t, coupon.Code, created.CouponCode)
+
+	// once per customer
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	vars := map[string]string{"id": strconv.Itoa(coupon.ID)}
+	w = httptest.NewRecorder()
+	server.getCoupon(w, newRequest("GET", "/v1/coupons/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&coupon))
+	assert.Equal(t, 1, coupon.Redemptions)
+
+	w = httptest.NewRecorder()
+	server.updateCoupon(w, newRequest("PUT", "/v1/coupons/"+vars["id"], map[string]interface{}{"percent_off": 20}, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var updated Coupon
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&updated))
+	assert.Equal(t, 20, updated.PercentOff)
+	assert.Equal(t, coupon.Code, updated.Code)
+	assert.Equal(t, 1, updated.Redemptions)
+
+	w = httptest.NewRecorder()
+	server.deleteCoupon(w, newRequest("DELETE", "/v1/coupons/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	server.quoteOrder(w, newRequest("POST", "/v1/orders/quote", map[string]interface{}{"lines": order.Lines, "coupon_code": coupon.Code}, "jane@example.com", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = httptest.NewRecorder()
+	server.listCoupons(w, newRequest("GET", "/v1/coupons", nil, adminEmail, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, "[]", w.Body.String())
+}
+
+func TestServer_CartCheckout(t *testing.T) {
+	server := newTestServer()
+	_, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	server.checkoutCart(w, newRequest("POST", "/v1/cart/checkout", map[string]interface{}{"contact": "+254700000000"}, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	server.addCartLine(w, newRequest("POST", "/v1/cart/lines", map[string]interface{}{"item_id": 999, "qty": 1}, "john@example.com", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server.addCartLine(w, newRequest("POST", "/v1/cart/lines", map[string]interface{}{"item_id": item.ID, "qty": 1}, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var line CartLine
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&line))
+
+	vars := map[string]string{"id": strconv.Itoa(line.ID)}
+	w = httptest.NewRecorder()
+	server.updateCartLine(w, newRequest("PUT", "/v1/cart/lines/"+vars["id"], map[string]interface{}{"qty": 2}, "jane@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server.updateCartLine(w, newRequest("PUT", "/v1/cart/lines/"+vars["id"], map[string]interface{}{"qty": 2}, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var cart Cart
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&cart))
+	assert.Equal(t, NewMoney(20000, "KES"), cart.Breakdown.Total)
+
+	w = httptest.NewRecorder()
+	server.checkoutCart(w, newRequest("POST", "/v1/cart/checkout", map[string]interface{}{"contact": "+254700000000"}, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created Orders
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, NewMoney(20000, "KES"), created.Total)
+	assert.Len(t, created.Lines, 1)
+
+	w = httptest.NewRecorder()
+	server.getCart(w, newRequest("GET", "/v1/cart", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&cart))
+	assert.Empty(t, cart.Lines)
+	stocked, err := server.Services.service.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stocked.Stock)
+}
+
+func TestServer_Payments(t *testing.T) {
+	server := newTestServer()
+	server.Cfg.PaymentCallbackToken = "secret"
+	server.Cfg.AllowFakePayments = true
+	_, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	// placing the order asks for payment
+	order := Orders{Contact: "+254700000000", Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}
+	w := httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created Orders
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, PaymentPending, created.PaymentStatus)
+
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+	w = httptest.NewRecorder()
+	server.listOrderPayments(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/payments", nil, "jane@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server.listOrderPayments(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/payments", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var payments []Payment
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&payments))
+	if assert.Len(t, payments, 1) {
+		// customers could forge callbacks with the reference
+		assert.Empty(t, payments[0].Reference)
+	}
+	w = httptest.NewRecorder()
+	server.listOrderPayments(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/payments", nil, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&payments))
+	assert.NotEmpty(t, payments[0].Reference)
+
+	w = httptest.NewRecorder()
+	server.startOrderPayment(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/payments", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	callback := map[string]interface{}{"reference": payments[0].Reference, "paid": true, "receipt": "QKJ4ABC123"}
+	w = httptest.NewRecorder()
+	server.paymentCallback(w, newRequest("POST", "/payments/fake/callback?token=wrong", callback, "", map[string]string{"provider": "fake"}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	server.paymentCallback(w, newRequest("POST", "/payments/mpesa/callback?token=secret", callback, "", map[string]string{"provider": "mpesa"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	server.Cfg.AllowFakePayments = false
+	w = httptest.NewRecorder()
+	server.paymentCallback(w, newRequest("POST", "/payments/fake/callback?token=secret", callback, "", map[string]string{"provider": "fake"}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	server.Cfg.AllowFakePayments = true
+	w = httptest.NewRecorder()
+	server.paymentCallback(w, newRequest("POST", "/payments/fake/callback?token=secret", callback, "", map[string]string{"provider": "fake"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	paid, err := server.Services.service.FindOrders(created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentPaid, paid.PaymentStatus)
+	w = httptest.NewRecorder()
+	server.startOrderPayment(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/payments", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestServer_Refunds(t *testing.T) {
+	server := newTestServer()
+	server.Cfg.AllowFakePayments = true
+	user, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: user.ID, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}), nil)
+	assert.NoError(t, err)
+	vars := map[string]string{"id": strconv.Itoa(order.ID)}
+
+	refund := map[string]interface{}{"amount": map[string]interface{}{"amount": 4000}, "reason": "one bag was damaged"}
+	w := httptest.NewRecorder()
+	server.refundOrder(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/refunds", refund, adminEmail, vars))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	payment, err := server.Services.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	_, err = server.Services.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true})
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	server.refundOrder(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/refunds", map[string]interface{}{"amount": map[string]interface{}{"amount": 4000}}, adminEmail, vars))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	server.refundOrder(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/refunds", refund, adminEmail, vars))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var created Refund
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, NewMoney(4000, "KES"), created.Amount)
+	w = httptest.NewRecorder()
+	server.refundOrder(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/refunds", map[string]interface{}{"amount": map[string]interface{}{"amount": 6001}, "reason": "the rest"}, adminEmail, vars))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = httptest.NewRecorder()
+	server.refundCallback(w, newRequest("POST", "/payments/fake/refunds/callback", map[string]interface{}{"reference": created.Reference, "completed": true}, "", map[string]string{"provider": "fake"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.listOrderRefunds(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/refunds", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var refunds []Refund
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&refunds))
+	assert.Len(t, refunds, 1)
+	assert.Equal(t, RefundCompleted, refunds[0].Status)
+}
+
+func TestServer_DeliveryZones(t *testing.T) {
+	server := newTestServer()
+	john, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(40000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+
+	zone := map[string]interface{}{
+		"name":     "Westlands",
+		"center":   map[string]interface{}{"lat": -1.2676, "lng": 36.8108},
+		"radius_m": 3000,
+		"fees":     []interface{}{map[string]interface{}{"fee": map[string]interface{}{"amount": 15000}}},
+	}
+	w := httptest.NewRecorder()
+	server.createDeliveryZone(w, newRequest("POST", "/v1/delivery-zones", map[string]interface{}{"name": "Nowhere", "fees": zone["fees"]}, adminEmail, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	server.createDeliveryZone(w, newRequest("POST", "/v1/delivery-zones", zone, adminEmail, nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created DeliveryZone
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, NewMoney(15000, "KES"), created.Fees[0].Fee)
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+
+	zone["min_order"] = map[string]interface{}{"amount": 50000}
+	w = httptest.NewRecorder()
+	server.updateDeliveryZone(w, newRequest("PUT", "/v1/delivery-zones/"+vars["id"], zone, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	server.listDeliveryZones(w, newRequest("GET", "/v1/delivery-zones", nil, adminEmail, nil))
+	var zones []DeliveryZone
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&zones))
+	if assert.Len(t, zones, 1) {
+		assert.Equal(t, NewMoney(50000, "KES"), zones[0].MinOrder)
+	}
+
+	order := Orders{Contact: "+254700000000", DeliveryLocation: &LatLng{-1.2864, 36.8172}, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	order.Lines[0].Qty = 2
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var placed Orders
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&placed))
+	assert.Equal(t, created.ID, *placed.DeliveryZoneID)
+	assert.Equal(t, NewMoney(15000, "KES"), placed.Breakdown.DeliveryFee)
+	assert.Equal(t, NewMoney(95000, "KES"), placed.Total)
+
+	// once there are zones, orders need a location
+	order.DeliveryLocation = nil
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	_, err = server.Services.AddToCart(john.ID, CartLine{ItemID: item.ID, Qty: 2})
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	server.checkoutCart(w, newRequest("POST", "/v1/cart/checkout", map[string]interface{}{"contact": "+254700000000"}, "john@example.com", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	order.DeliveryLocation = &LatLng{-1.3197, 36.7076}
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	order.DeliveryLocation = &LatLng{-100, 36.7076}
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	server.deleteDeliveryZone(w, newRequest("DELETE", "/v1/delivery-zones/"+vars["id"], nil, adminEmail, vars))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	server.updateDeliveryZone(w, newRequest("PUT", "/v1/delivery-zones/"+vars["id"], zone, adminEmail, vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_OrderReceipt(t *testing.T) {
+	server := newTestServer()
+	user, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(10000, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: user.ID, Contact: "+254700000000", Time: time.Now(), Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}), nil)
+	assert.NoError(t, err)
+	vars := map[string]string{"id": strconv.Itoa(order.ID)}
+
+	w := httptest.NewRecorder()
+	server.getOrderReceipt(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/receipt", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	payment, err := server.Services.StartPayment(order, order.Contact)
+	assert.NoError(t, err)
+	_, err = server.Services.SettlePayment(PaymentResult{Reference: payment.Reference, Paid: true})
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	server.getOrderReceipt(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/receipt", nil, "jane@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getOrderReceipt(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/receipt", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "john@example.com")
+	disposition := w.Header().Get("Content-Disposition")
+
+	r := newRequest("GET", "/v1/orders/"+vars["id"]+"/receipt", nil, adminEmail, vars)
+	r.Header.Set("Accept", "application/pdf")
+	w = httptest.NewRecorder()
+	server.getOrderReceipt(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "%PDF-"))
+	// the same receipt whichever format it's downloaded in
+	assert.Equal(t, strings.TrimSuffix(disposition, `.html"`), strings.TrimSuffix(w.Header().Get("Content-Disposition"), `.pdf"`))
+
+	w = httptest.NewRecorder()
+	server.getOrderReceipt(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/receipt?format=docx", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_CreateOrder_OutOfStock(t *testing.T) {
+	server := newTestServer()
+	_, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Scarce Item", Description: "Only one left", Stock: 1})
+	assert.NoError(t, err)
+
+	order := Orders{Contact: "+254700000000", Lines: []OrderLine{{ItemID: item.ID, Qty: 2}}}
+	w := httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	order.Lines[0].Qty = -1
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	order.Lines = nil
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_ListMyOrders(t *testing.T) {
+	server := newTestServer()
+	john, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	ordered := time.Date(2024, 5, 31, 18, 0, 0, 0, time.UTC)
+	for _, userID := range []int{john.ID, john.ID + 1000} {
+		_, err := server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: userID, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: ordered}), nil)
+		assert.NoError(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	server.listMyOrders(w, newRequest("GET", "/v1/me/orders?status=pending&from=2024-05-31&to=2024-05-31", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page OrderPage
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	if assert.Len(t, page.Orders, 1) {
+		assert.Equal(t, john.ID, page.Orders[0].UserId)
+	}
+
+	w = httptest.NewRecorder()
+	server.listMyOrders(w, newRequest("GET", "/v1/me/orders?to=2024-05-30", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = OrderPage{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	assert.Empty(t, page.Orders)
+
+	for _, query := range []string{"status=lost", "from=yesterday", "limit=x", "cursor=bogus"} {
+		w = httptest.NewRecorder()
+		server.listMyOrders(w, newRequest("GET", "/v1/me/orders?"+query, nil, "john@example.com", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	w = httptest.NewRecorder()
+	server.listMyOrders(w, newRequest("GET", "/v1/me/orders", nil, "nobody@example.com", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_GetOrder(t *testing.T) {
+	server := newTestServer()
+	john, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: john.ID, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	get := func(id, email string) *httptest.ResponseRecorder {
+		vars := map[string]string{"id": id}
+		w := httptest.NewRecorder()
+		server.getOrder(w, newRequest("GET", "/v1/orders/"+id, nil, email, vars))
+		return w
+	}
+	id := strconv.Itoa(order.ID)
+
+	w := get(id, "john@example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found Orders
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Equal(t, order.ID, found.ID)
+	assert.Equal(t, http.StatusOK, get(id, adminEmail).Code)
+	// someone else's order looks the same as one that doesn't exist
+	assert.Equal(t, http.StatusNotFound, get(id, "jane@example.com").Code)
+	assert.Equal(t, get(strconv.Itoa(order.ID+1000), "jane@example.com").Body.String(), get(id, "jane@example.com").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(id, "nobody@example.com").Code)
+	assert.Equal(t, http.StatusBadRequest, get("one", "john@example.com").Code)
+}
+
+func TestServer_GetCustomer(t *testing.T) {
+	server := newTestServer()
+	john, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+	get := func(id, email string) *httptest.ResponseRecorder {
+		vars := map[string]string{"id": id}
+		w := httptest.NewRecorder()
+		server.getCustomer(w, newRequest("GET", "/v1/customers/"+id, nil, email, vars))
+		return w
+	}
+	id := strconv.Itoa(john.ID)
+
+	w := get(id, "john@example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found User
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Equal(t, "john@example.com", found.Email)
+	assert.Equal(t, http.StatusOK, get(id, adminEmail).Code)
+	assert.Equal(t, http.StatusNotFound, get(id, "jane@example.com").Code)
+	assert.Equal(t, get(strconv.Itoa(john.ID+1000), "jane@example.com").Body.String(), get(id, "jane@example.com").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(id, "nobody@example.com").Code)
+	assert.Equal(t, http.StatusBadRequest, get("one", "john@example.com").Code)
+}
+
+func TestServer_CancelOrder(t *testing.T) {
+	server := newTestServer()
+	john, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order := func(placed time.Time) int {
+		created, err := server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: john.ID, Lines: []OrderLine{{ItemID: item.ID, Qty: 2}}, Time: placed}), nil)
+		assert.NoError(t, err)
+		return created.ID
+	}
+	cancel := func(id int, email string, body interface{}) int {
+		vars := map[string]string{"id": strconv.Itoa(id)}
+		w := httptest.NewRecorder()
+		server.cancelOrder(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/cancel", body, email, vars))
+		return w.Code
+	}
+	reason := map[string]string{"reason": "ordered twice"}
+
+	recent := order(time.Now())
+	assert.Equal(t, http.StatusBadRequest, cancel(recent, "john@example.com", map[string]string{}))
+	assert.Equal(t, http.StatusNotFound, cancel(recent, "jane@example.com", reason))
+	assert.Equal(t, http.StatusOK, cancel(recent, "john@example.com", reason))
+	assert.Equal(t, http.StatusConflict, cancel(recent, "john@example.com", reason))
+	found, err := server.Services.service.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3+2, found.Stock)
+
+	// a payment is being made, only an admin can cancel and refund it
+	paying := order(time.Now())
+	unpaid, err := server.Services.service.FindOrders(paying)
+	assert.NoError(t, err)
+	pending, err := server.Services.StartPayment(unpaid, "+254700000000")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, cancel(paying, "john@example.com", reason))
+	_, err = server.Services.SettlePayment(PaymentResult{Reference: pending.Reference, Paid: true, Receipt: "QKJ4ABC123"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, cancel(paying, "john@example.com", reason))
+
+	old := order(time.Now().Add(-time.Hour))
+	assert.Equal(t, http.StatusForbidden, cancel(old, "john@example.com", reason))
+	assert.Equal(t, http.StatusOK, cancel(old, adminEmail, reason))
+
+	history, err := server.Services.service.OrderStatusHistory(old)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, adminEmail, history[0].Actor)
+		assert.Equal(t, "ordered twice", history[0].Note)
+	}
+}
+
+func TestServer_Addresses(t *testing.T) {
+	server := newTestServer()
+	_, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	_, err = server.Services.service.CreateUser(User{Email: "jane@example.com"})
+	assert.NoError(t, err)
+
+	home := Address{Label: "Home", Contact: "+254700000000", Line1: "12 Riverside Drive", City: "Nairobi"}
+	w := httptest.NewRecorder()
+	server.createAddress(w, newRequest("POST", "/v1/me/addresses", home, "john@example.com", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created Address
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	vars := map[string]string{"id": strconv.Itoa(created.ID)}
+
+	w = httptest.NewRecorder()
+	server.createAddress(w, newRequest("POST", "/v1/me/addresses", Address{Label: "Work"}, "john@example.com", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	home.City = "Kisumu"
+	w = httptest.NewRecorder()
+	server.updateAddress(w, newRequest("PUT", "/v1/me/addresses/"+vars["id"], home, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.listAddresses(w, newRequest("GET", "/v1/me/addresses", nil, "john@example.com", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var addresses []Address
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&addresses))
+	if assert.Len(t, addresses, 1) {
+		assert.Equal(t, "Kisumu", addresses[0].City)
+	}
+
+	// someone else's address is as good as missing, including for orders
+	w = httptest.NewRecorder()
+	server.getAddress(w, newRequest("GET", "/v1/me/addresses/"+vars["id"], nil, "jane@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server.deleteAddress(w, newRequest("DELETE", "/v1/me/addresses/"+vars["id"], nil, "jane@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order := Orders{AddressID: &created.ID, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}}
+	w = httptest.NewRecorder()
+	server.createOrder(w, newRequest("POST", "/v1/orders", order, "jane@example.com", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	server.deleteAddress(w, newRequest("DELETE", "/v1/me/addresses/"+vars["id"], nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	server.getAddress(w, newRequest("GET", "/v1/me/addresses/"+vars["id"], nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_Idempotent(t *testing.T) {
+	server := newTestServer()
+	handler := server.idempotent(server.createCustomer)
+	post := func(key string, customer User) *httptest.ResponseRecorder {
+		r := newRequest("POST", "/v1/customers", customer, "john@example.com", nil)
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	first := post("signup-1", User{Email: "john@example.com"})
+	assert.Equal(t, http.StatusCreated, first.Code)
+	retry := post("signup-1", User{Email: "john@example.com"})
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, post("signup-1", User{Email: "jane@example.com"}).Code)
+
+	// a new key is a new request
+	other := post("signup-2", User{Email: "john@example.com"})
+	assert.Equal(t, http.StatusCreated, other.Code)
+	assert.NotEqual(t, first.Body.String(), other.Body.String())
+
+	// validation errors are replayed too, they aren't going to change
+	assert.Equal(t, http.StatusBadRequest, post("signup-3", User{}).Code)
+	assert.Equal(t, http.StatusBadRequest, post("signup-3", User{}).Code)
+
+	// a retry while the first request is still running
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(User{Email: "john@example.com"})
+	sum := sha256.Sum256(body.Bytes())
+	_, err := server.Services.idempotency.Reserve("john@example.com POST /v1/customers", "signup-4", hex.EncodeToString(sum[:]), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, post("signup-4", User{Email: "john@example.com"}).Code)
+}
+
+func TestServer_TransitionOrder(t *testing.T) {
+	server := newTestServer()
+	john, err := server.Services.service.CreateUser(User{Email: "john@example.com"})
+	assert.NoError(t, err)
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := server.Services.service.CreateOrders(priced(t, server.Services.service, Orders{UserId: john.ID, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	vars := map[string]string{"id": strconv.Itoa(order.ID)}
+	transition := func(status OrderStatus) int {
+		w := httptest.NewRecorder()
+		body := map[string]string{"status": string(status)}
+		server.transitionOrder(w, newRequest("POST", "/v1/orders/"+vars["id"]+"/transitions", body, adminEmail, vars))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, transition(StatusConfirmed))
+	assert.Equal(t, http.StatusConflict, transition(StatusPending))
+	assert.Equal(t, http.StatusBadRequest, transition("lost"))
+	assert.Equal(t, http.StatusOK, transition(StatusCancelled))
+	assert.Equal(t, http.StatusConflict, transition(StatusConfirmed))
+
+	w := httptest.NewRecorder()
+	server.listOrderTransitions(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/transitions", nil, "jane@example.com", vars))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server.listOrderTransitions(w, newRequest("GET", "/v1/orders/"+vars["id"]+"/transitions", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var history []OrderStatusChange
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&history))
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, StatusCancelled, history[1].To)
+		assert.Equal(t, adminEmail, history[1].Actor)
+	}
+}
+
+func TestServer_Categories(t *testing.T) {
+	server := newTestServer()
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Green Tea", Description: "Loose leaf"})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	server.createCategory(w, newRequest("POST", "/v1/categories", Category{Name: "Drinks"}, adminEmail, nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var drinks Category
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&drinks))
+
+	missing := 0
+	w = httptest.NewRecorder()
+	server.createCategory(w, newRequest("POST", "/v1/categories", Category{Name: "Tea", ParentID: &missing}, adminEmail, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	vars := map[string]string{"id": strconv.Itoa(item.ID)}
+	w = httptest.NewRecorder()
+	server.setItemCategories(w, newRequest("PUT", "/v1/items/"+vars["id"]+"/categories", map[string][]int{"category_ids": {drinks.ID}}, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.setItemTags(w, newRequest("PUT", "/v1/items/"+vars["id"]+"/tags", map[string][]string{"tags": {"Organic"}}, adminEmail, vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getItem(w, newRequest("GET", "/v1/items/"+vars["id"], nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found Item
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Equal(t, []Category{drinks}, found.Categories)
+	assert.Equal(t, []string{"organic"}, found.Tags)
+
+	vars = map[string]string{"id": strconv.Itoa(drinks.ID)}
+	w = httptest.NewRecorder()
+	server.listCategoryItems(w, newRequest("GET", "/v1/categories/"+vars["id"]+"/items", nil, "john@example.com", vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page ItemPage
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	assert.Len(t, page.Items, 1)
+
+	w = httptest.NewRecorder()
+	server.listCategoryItems(w, newRequest("GET", "/v1/categories/0/items", nil, "john@example.com", map[string]string{"id": "0"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_Variants(t *testing.T) {
+	server := newTestServer()
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(500, "KES"), Name: "Milk", Description: "Fresh"})
+	assert.NoError(t, err)
+
+	upc := "036000291452"
+	variant := ItemVariant{SKU: "MILK-1L", GTIN: &upc, Name: "1 litre", Price: NewMoney(900, "KES"), Stock: 5}
+	vars := map[string]string{"id": strconv.Itoa(item.ID)}
+	w := httptest.NewRecorder()
+	server.createVariant(w, newRequest("POST", "/v1/items/"+vars["id"]+"/variants", variant, adminEmail, vars))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	server.createVariant(w, newRequest("POST", "/v1/items/"+vars["id"]+"/variants", variant, adminEmail, vars))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	bad := "036000291453"
+	variant.SKU, variant.GTIN = "MILK-2L", &bad
+	w = httptest.NewRecorder()
+	server.createVariant(w, newRequest("POST", "/v1/items/"+vars["id"]+"/variants", variant, adminEmail, vars))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getVariantByBarcode(w, newRequest("GET", "/v1/variants/by-barcode/0036000291452", nil, "john@example.com", map[string]string{"code": "0036000291452"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found struct {
+		ItemVariant
+		Item Item `json:"item"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Equal(t, "MILK-1L", found.SKU)
+	assert.Equal(t, "00036000291452", *found.GTIN)
+	assert.Equal(t, item.Name, found.Item.Name)
+
+	w = httptest.NewRecorder()
+	server.getVariantBySKU(w, newRequest("GET", "/v1/variants/by-sku/MILK-1L", nil, "john@example.com", map[string]string{"sku": "MILK-1L"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getVariantBySKU(w, newRequest("GET", "/v1/variants/by-sku/NOPE", nil, "john@example.com", map[string]string{"sku": "NOPE"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getVariantByBarcode(w, newRequest("GET", "/v1/variants/by-barcode/123", nil, "john@example.com", map[string]string{"code": "123"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_UploadItemImage(t *testing.T) {
+	server := newTestServer()
+	blobs, err := NewLocalBlobStore(t.TempDir(), "/blobs")
+	assert.NoError(t, err)
+	server.Services.blobs = blobs
+	item, err := server.Services.service.CreateItem(Item{Price: NewMoney(500, "KES"), Name: "Milk", Description: "Fresh"})
+	assert.NoError(t, err)
+	vars := map[string]string{"id": strconv.Itoa(item.ID)}
+
+	upload := func(name string, data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, err := form.CreateFormFile("image", name)
+		assert.NoError(t, err)
+		part.Write(data)
+		form.Close()
+		r := httptest.NewRequest("POST", "/v1/items/"+vars["id"]+"/images", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		server.uploadItemImage(w, mux.SetURLVars(r, vars))
+		return w
+	}
+
+	w := upload("milk.png", encodePNG(t, 640, 480))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var image ItemImage
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&image))
+	assert.Equal(t, "image/png", image.ContentType)
+	assert.True(t, strings.HasPrefix(image.ThumbnailURL, "/blobs/items/"+vars["id"]+"/"))
+
+	w = upload("milk.txt", []byte("not an image"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = httptest.NewRecorder()
+	server.getItem(w, newRequest("GET", "/v1/items/"+vars["id"], nil, "john@example.com", vars))
+	var found Item
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Len(t, found.Images, 1)
+	assert.Equal(t, image.URL, found.Images[0].URL)
+
+	w = httptest.NewRecorder()
+	server.serveBlob(w, httptest.NewRequest("GET", image.ThumbnailURL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	server.serveBlob(w, httptest.NewRequest("GET", "/blobs/items/../../etc/passwd", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -11,8 +11,19 @@ import (
 
 type Service struct {
 	service database
-	// small api to handle sending of sms to users
-	sms *ATalkingService
+	// small api to handle sending of sms to users, only the outbox
+	// Dispatcher sends with it
+	sms Sender
+	// uploaded files such as item images
+	blobs BlobStore
+	// responses to requests sent with an Idempotency-Key
+	idempotency IdempotencyStore
+	// VAT and fees order totals are worked out with
+	pricing Pricing
+	// how long carts are kept after they were last changed
+	cartTTL time.Duration
+	// takes payments for orders
+	payments PaymentProvider
 }
 
 // africas talking service
@@ -77,11 +88,16 @@ func (service ATalkingService) newPostRequest(url string, values url.Values, hea
 	return client.Do(req)
 }
 
-func NewService(conn *sql.DB, username, apikey string) Service {
+func NewService(conn *sql.DB, username, apikey string, blobs BlobStore, pricing Pricing, cartTTL time.Duration, payments PaymentProvider) Service {
 	db := Newdb(conn)
 	asms := NewATalkingService(username, apikey)
 	return Service{
-		service: db,
-		sms:     asms,
+		service:     db,
+		sms:         asms,
+		blobs:       blobs,
+		idempotency: NewDBIdempotencyStore(conn),
+		pricing:     pricing,
+		cartTTL:     cartTTL,
+		payments:    payments,
 	}
 }
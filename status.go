@@ -0,0 +1,104 @@
+package savannah
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// OrderStatus is where an order is in its lifecycle. Orders start out
+// pending and move forward through orderTransitions until they are
+// delivered or cancelled.
+type OrderStatus string
+
+const (
+	StatusPending    OrderStatus = "pending"
+	StatusConfirmed  OrderStatus = "confirmed"
+	StatusPreparing  OrderStatus = "preparing"
+	StatusDispatched OrderStatus = "dispatched"
+	StatusDelivered  OrderStatus = "delivered"
+	StatusCancelled  OrderStatus = "cancelled"
+)
+
+// orderTransitions lists the statuses an order may move to from each
+// status. Delivered and cancelled orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:    {StatusConfirmed, StatusCancelled},
+	StatusConfirmed:  {StatusPreparing, StatusCancelled},
+	StatusPreparing:  {StatusDispatched, StatusCancelled},
+	StatusDispatched: {StatusDelivered},
+	StatusDelivered:  {},
+	StatusCancelled:  {},
+}
+
+// Valid reports whether s is one of the known statuses.
+func (s OrderStatus) Valid() bool {
+	_, ok := orderTransitions[s]
+	return ok
+}
+
+// CanTransition reports whether an order in status s may move to status to.
+func (s OrderStatus) CanTransition(to OrderStatus) bool {
+	for _, next := range orderTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderStatusChange is an entry in an order's status history. Actor is the
+// email of whoever made the change.
+type OrderStatusChange struct {
+	OrderID   int         `json:"order_id"`
+	From      OrderStatus `json:"from"`
+	To        OrderStatus `json:"to"`
+	Actor     string      `json:"actor"`
+	Note      string      `json:"note,omitempty"`
+	ChangedAt time.Time   `json:"changed_at"`
+}
+
+// TransitionError is returned when an order can't move from its current
+// status to the requested one.
+type TransitionError struct {
+	OrderID int
+	From    OrderStatus
+	To      OrderStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %d can't move from %s to %s", e.OrderID, e.From, e.To)
+}
+
+// TransitionOrder moves an order to status to on behalf of actor and records
+// the change in its history. Cancelling puts the order's stock back. A
+// non-nil notification is queued in the outbox along with the change. Moves
+// orderTransitions doesn't allow fail with a *TransitionError, as does
+// losing a race against another change to the same order.
+func (s Service) TransitionOrder(orderID int, to OrderStatus, actor, note string, notification *Notification) (*Orders, error) {
+	order, err := s.service.FindOrders(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.Status.CanTransition(to) {
+		return nil, &TransitionError{OrderID: orderID, From: order.Status, To: to}
+	}
+	change := OrderStatusChange{OrderID: orderID, From: order.Status, To: to, Actor: actor, Note: note}
+	update := s.service.UpdateOrderStatus
+	if to == StatusCancelled {
+		update = s.service.CancelOrder
+	}
+	if err := update(change, notification); err != nil {
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		// the order changed since we read it, report its status as it is now
+		current, err := s.service.FindOrders(orderID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &TransitionError{OrderID: orderID, From: current.Status, To: to}
+	}
+	order.Status = to
+	return order, nil
+}
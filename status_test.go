@@ -0,0 +1,68 @@
+package savannah
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatus_CanTransition(t *testing.T) {
+	assert.True(t, StatusPending.CanTransition(StatusConfirmed))
+	assert.True(t, StatusPreparing.CanTransition(StatusCancelled))
+	assert.True(t, StatusDispatched.CanTransition(StatusDelivered))
+	assert.False(t, StatusPending.CanTransition(StatusDelivered))
+	assert.False(t, StatusDispatched.CanTransition(StatusCancelled))
+	assert.False(t, StatusDelivered.CanTransition(StatusPending))
+	assert.False(t, StatusCancelled.CanTransition(StatusConfirmed))
+	assert.False(t, OrderStatus("lost").Valid())
+}
+
+func TestService_TransitionOrder(t *testing.T) {
+	service := NewMockService()
+	item, err := service.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	order, err := service.service.CreateOrders(priced(t, service.service, Orders{UserId: 1, Lines: []OrderLine{{ItemID: item.ID, Qty: 1}}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, order.Status)
+
+	order, err = service.TransitionOrder(order.ID, StatusConfirmed, adminEmail, "paid at the counter", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, order.Status)
+
+	_, err = service.TransitionOrder(order.ID, StatusDelivered, adminEmail, "", nil)
+	var transition *TransitionError
+	assert.ErrorAs(t, err, &transition)
+	assert.Equal(t, StatusConfirmed, transition.From)
+
+	history, err := service.service.OrderStatusHistory(order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, StatusPending, history[0].From)
+		assert.Equal(t, StatusConfirmed, history[0].To)
+		assert.Equal(t, adminEmail, history[0].Actor)
+		assert.Equal(t, "paid at the counter", history[0].Note)
+	}
+}
+
+func TestService_TransitionOrder_CancelRestoresStock(t *testing.T) {
+	service := NewMockService()
+	item, err := service.service.CreateItem(Item{Price: NewMoney(999, "KES"), Name: "Tea", Description: "Loose leaf", Stock: 5})
+	assert.NoError(t, err)
+	variant, err := service.service.CreateVariant(ItemVariant{ItemID: item.ID, SKU: "TEA-1KG", Name: "1kg", Price: NewMoney(4999, "KES"), Stock: 3})
+	assert.NoError(t, err)
+	order, err := service.service.CreateOrders(priced(t, service.service, Orders{UserId: 1, Lines: []OrderLine{
+		{ItemID: item.ID, Qty: 2},
+		{ItemID: item.ID, VariantID: &variant.ID, Qty: 3},
+	}, Time: time.Now()}), nil)
+	assert.NoError(t, err)
+
+	_, err = service.TransitionOrder(order.ID, StatusCancelled, adminEmail, "out of delivery area", nil)
+	assert.NoError(t, err)
+	found, err := service.service.FindItem(item.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, found.Stock)
+	foundVariant, err := service.service.FindVariant(variant.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, foundVariant.Stock)
+}
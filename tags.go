@@ -0,0 +1,28 @@
+package savannah
+
+import (
+	"sort"
+	"strings"
+)
+
+// normalizeTag folds free-form tags so "Organic " and "organic" are the
+// same tag.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// normalizeTags normalises, de-duplicates and sorts tags, dropping blanks.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return normalized
+}